@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/Dimss/exa/pkg/revocation"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	adminURL       string
+	adminTokenFile string
+	expiresAt      string
+	before         string
+	ttl            time.Duration
+)
+
+func init() {
+	revocationsCmd.PersistentFlags().StringVar(&adminURL, "admin-url", "http://127.0.0.1:7778", "authz admin api url")
+	revocationsCmd.PersistentFlags().StringVar(&adminTokenFile, "admin-token-file", "", "file with the bearer token of the admin api")
+	revokeJTICmd.Flags().StringVar(&expiresAt, "expires-at", "", "token exp (RFC3339), the revocation is dropped after it")
+	revokeJTICmd.Flags().DurationVar(&ttl, "ttl", 0, "revocation ttl, used when --expires-at is not set, defaults to the server revocation lifetime")
+	revokeSubjectCmd.Flags().StringVar(&before, "before", "", "revoke tokens issued before (RFC3339), defaults to now")
+	revokeSubjectCmd.Flags().StringVar(&expiresAt, "expires-at", "", "cutoff expiry (RFC3339), should be past the exp of the longest living token")
+	revokeSubjectCmd.Flags().DurationVar(&ttl, "ttl", 0, "cutoff ttl, used when --expires-at is not set, defaults to the server revocation lifetime")
+
+	revocationsCmd.AddCommand(listRevocationsCmd, revokeJTICmd, revokeSubjectCmd, deleteJTICmd, deleteSubjectCmd)
+	rootCmd.AddCommand(revocationsCmd)
+}
+
+var revocationsCmd = &cobra.Command{
+	Use:   "revocations",
+	Short: "manage token revocations of a running authz server",
+}
+
+var listRevocationsCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list revoked tokens and subjects",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		revocations, err := newRevocationsClient().List()
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(revocations)
+	},
+}
+
+var revokeJTICmd = &cobra.Command{
+	Use:   "revoke-jti <jti>",
+	Short: "revoke a single token by its jti",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		exp, err := parseTime(expiresAt, expiry(time.Now()))
+		if err != nil {
+			return err
+		}
+		return newRevocationsClient().RevokeJTI(args[0], exp)
+	},
+}
+
+var revokeSubjectCmd = &cobra.Command{
+	Use:   "revoke-subject <sub>",
+	Short: "revoke every token of a subject issued before the cutoff",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cutoff, err := parseTime(before, time.Now())
+		if err != nil {
+			return err
+		}
+		exp, err := parseTime(expiresAt, expiry(cutoff))
+		if err != nil {
+			return err
+		}
+		return newRevocationsClient().RevokeSubject(args[0], cutoff, exp)
+	},
+}
+
+var deleteJTICmd = &cobra.Command{
+	Use:   "delete-jti <jti>",
+	Short: "delete a token revocation",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return newRevocationsClient().DeleteJTI(args[0])
+	},
+}
+
+var deleteSubjectCmd = &cobra.Command{
+	Use:   "delete-subject <sub>",
+	Short: "delete a subject cutoff",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return newRevocationsClient().DeleteSubject(args[0])
+	},
+}
+
+// newRevocationsClient returns the admin api client, exits when the token file can't be read
+func newRevocationsClient() *revocation.Client {
+	client := revocation.NewClient(adminURL)
+	if adminTokenFile != "" {
+		token, err := os.ReadFile(adminTokenFile)
+		cobra.CheckErr(err)
+		client.Token = strings.TrimSpace(string(token))
+	}
+	return client
+}
+
+func parseTime(value string, defaultTime time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultTime, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// expiry returns from plus the ttl flag, the zero time lets the server apply its revocation lifetime
+func expiry(from time.Time) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return from.Add(ttl)
+}
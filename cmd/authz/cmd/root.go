@@ -10,7 +10,10 @@ import (
 )
 
 var (
-	rootCmd = &cobra.Command{
+	cfgFile string
+	// logLevel is the level of the global logger, changed at runtime from the admin api
+	logLevel zap.AtomicLevel
+	rootCmd  = &cobra.Command{
 		Use:   "authz",
 		Short: "exa authz server",
 	}
@@ -25,13 +28,26 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "f", "", "config file (yaml|json), keys are the flag names, reloaded on change and on SIGHUP")
 }
 
 func initConfig() {
 	initZapLog()
-	viper.AutomaticEnv()
-	viper.SetEnvPrefix("EXA_AUTHZ")
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	bindEnv(viper.GetViper())
+	if cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+		if err := viper.ReadInConfig(); err != nil {
+			zap.S().Fatalf("failed to read config file: %s", err)
+		}
+		zap.S().Infof("using config file: %s", viper.ConfigFileUsed())
+	}
+}
+
+// bindEnv reads the settings from the EXA_AUTHZ_ prefixed env
+func bindEnv(v *viper.Viper) {
+	v.AutomaticEnv()
+	v.SetEnvPrefix("EXA_AUTHZ")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 }
 
 func initZapLog() {
@@ -40,6 +56,7 @@ func initZapLog() {
 	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	config.EncoderConfig.TimeKey = "timestamp"
 	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	logLevel = config.Level
 	logger, _ := config.Build()
 
 	zap.ReplaceGlobals(logger)
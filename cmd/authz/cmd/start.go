@@ -1,9 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"github.com/Dimss/exa/pkg/admin"
 	"github.com/Dimss/exa/pkg/authz"
 	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/tlsutil"
+	"github.com/Dimss/exa/pkg/tracing"
 	"github.com/Dimss/exa/pkg/validator"
 	grpcprometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -11,12 +16,14 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"net"
 	"net/http"
-	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func init() {
@@ -35,6 +42,11 @@ func init() {
 		"",
 		"authorization",
 		"authentication header name")
+	startCmd.PersistentFlags().StringSlice(
+		"token-sources",
+		[]string{},
+		"token sources in precedence order, header:<name>[:<scheme>]|cookie:<name>|query:<param>|websocket-protocol[:<prefix>], "+
+			"defaults to cookie:<auth-cookie>,header:<token-src-header>")
 	startCmd.PersistentFlags().StringP(
 		"user-id-header",
 		"",
@@ -42,8 +54,28 @@ func init() {
 		"the header to add to the user is")
 	startCmd.PersistentFlags().BoolP(
 		"insecure-skip-verify",
-		"s", true,
-		"enable=true|disable=false https verification")
+		"s", false,
+		"skip https verification of jwks servers")
+	startCmd.PersistentFlags().StringSlice(
+		"tls-ca-files",
+		[]string{},
+		"ca bundle files used to verify jwks servers, system roots are used when empty")
+	startCmd.PersistentFlags().String(
+		"tls-client-cert",
+		"",
+		"client certificate file for mTLS to jwks servers")
+	startCmd.PersistentFlags().String(
+		"tls-client-key",
+		"",
+		"client key file for mTLS to jwks servers")
+	startCmd.PersistentFlags().String(
+		"tls-server-name",
+		"",
+		"override the SNI and verified server name of jwks servers")
+	startCmd.PersistentFlags().String(
+		"proxy-url",
+		"",
+		"http proxy for jwks servers, defaults to HTTPS_PROXY/NO_PROXY env")
 	startCmd.PersistentFlags().StringP(
 		"metrics-addr",
 		"m", "0.0.0.0:2113",
@@ -52,6 +84,58 @@ func init() {
 		"jwks-servers",
 		[]string{},
 		"list of jwks server")
+	startCmd.PersistentFlags().StringSlice(
+		"jwks-files",
+		[]string{},
+		"list of local jwks json files, reloaded on change")
+	startCmd.PersistentFlags().StringSlice(
+		"public-key-dirs",
+		[]string{},
+		"list of directories with pem public keys or certificates, the kid is the file name without extension")
+	startCmd.PersistentFlags().StringSlice(
+		"hmac-secret-files",
+		[]string{},
+		"list of files with HS256 shared secrets, the kid is the file name")
+	startCmd.PersistentFlags().StringSlice(
+		"jwe-key-files",
+		[]string{},
+		"pem private keys for encrypted (JWE) tokens, all keys are active to allow rotation, the kid is the file name without extension")
+	startCmd.PersistentFlags().StringSlice(
+		"oidc-issuers",
+		[]string{},
+		"list of oidc issuers, jwks are discovered from <issuer>/.well-known/openid-configuration")
+	startCmd.PersistentFlags().StringSlice(
+		"token-algorithms",
+		[]string{},
+		"allowed token signing algorithms, per issuer algorithms take precedence")
+	startCmd.PersistentFlags().Duration(
+		"token-leeway",
+		0,
+		"clock skew leeway for exp, nbf and iat checks")
+	startCmd.PersistentFlags().Duration(
+		"token-max-age",
+		0,
+		"reject tokens issued (iat) longer than max age ago, 0 disables the check")
+	startCmd.PersistentFlags().StringSlice(
+		"token-required-claims",
+		[]string{},
+		"claims which must be present in the token")
+	startCmd.PersistentFlags().StringSlice(
+		"token-types",
+		[]string{},
+		"allowed values of the typ header, ex: JWT,at+jwt, any type is allowed when empty")
+	startCmd.PersistentFlags().Bool(
+		"dpop-required",
+		false,
+		"reject bearer tokens which aren't bound (cnf claim) to a DPoP key or a client certificate")
+	startCmd.PersistentFlags().StringSlice(
+		"dpop-algorithms",
+		[]string{"ES256", "ES384", "ES512", "RS256", "PS256", "EdDSA"},
+		"allowed DPoP proof signing algorithms")
+	startCmd.PersistentFlags().Duration(
+		"dpop-proof-lifetime",
+		time.Minute*5,
+		"max age of a DPoP proof (iat), proof jti replays are rejected within this window")
 	startCmd.PersistentFlags().StringP(
 		"oauth2-token-issuer",
 		"",
@@ -62,6 +146,179 @@ func init() {
 		"",
 		"https://github.com",
 		"central sso redirect url, ex: https://<current-domain>/centralsso/dex-login")
+	startCmd.PersistentFlags().Int(
+		"decision-cache-size",
+		10000,
+		"max number of verified tokens to cache, 0 disables the cache")
+	startCmd.PersistentFlags().Duration(
+		"decision-cache-ttl",
+		time.Minute*5,
+		"max time a verified token is cached, entries never outlive the token exp")
+	startCmd.PersistentFlags().String(
+		"revocation-file",
+		"",
+		"file to persist token revocations in, it is watched so replicas may share it, revocations are kept in memory only when empty")
+	startCmd.PersistentFlags().String(
+		"admin-addr",
+		"127.0.0.1:7778",
+		"admin api listen address, an address other than loopback requires the admin api auth, without it the api is read-only")
+	startCmd.PersistentFlags().String(
+		"admin-token-file",
+		"",
+		"file with the bearer token of the admin api")
+	startCmd.PersistentFlags().String(
+		"admin-tls-cert",
+		"",
+		"admin api server certificate file, the admin api is served over https when set")
+	startCmd.PersistentFlags().String(
+		"admin-tls-key",
+		"",
+		"admin api server key file")
+	startCmd.PersistentFlags().StringSlice(
+		"admin-client-ca-files",
+		[]string{},
+		"ca bundle files verifying the admin api client certificates, a verified certificate authenticates the client")
+	startCmd.PersistentFlags().StringSlice(
+		"admin-allowed-clients",
+		[]string{},
+		"SANs or SPIFFE IDs of the accepted admin api client certificates, a trailing * matches any suffix")
+	startCmd.PersistentFlags().String(
+		"grpc-tls-cert",
+		"",
+		"grpc server certificate file, checks are served over tls when set, reloaded on change")
+	startCmd.PersistentFlags().String(
+		"grpc-tls-key",
+		"",
+		"grpc server key file")
+	startCmd.PersistentFlags().StringSlice(
+		"grpc-client-ca-files",
+		[]string{},
+		"ca bundle files verifying the grpc client certificates, client certificates are required when set")
+	startCmd.PersistentFlags().StringSlice(
+		"grpc-allowed-clients",
+		[]string{},
+		"SANs or SPIFFE IDs of the accepted grpc client certificates, ex: spiffe://cluster.local/ns/istio-system/sa/gateway, "+
+			"a trailing * matches any suffix")
+	startCmd.PersistentFlags().String(
+		"metrics-tls-cert",
+		"",
+		"metrics server certificate file, metrics and health checks are served over https when set, reloaded on change")
+	startCmd.PersistentFlags().String(
+		"metrics-tls-key",
+		"",
+		"metrics server key file")
+	startCmd.PersistentFlags().StringSlice(
+		"metrics-client-ca-files",
+		[]string{},
+		"ca bundle files verifying the metrics client certificates, required for /metrics, the health checks stay open")
+	startCmd.PersistentFlags().StringSlice(
+		"metrics-allowed-clients",
+		[]string{},
+		"SANs or SPIFFE IDs of the accepted metrics client certificates, a trailing * matches any suffix")
+	startCmd.PersistentFlags().String(
+		"route-rules-file",
+		"",
+		"yaml|json route rules file, reloaded on change, the sso login routes are public when empty")
+	startCmd.PersistentFlags().StringSlice(
+		"allow-cidrs",
+		[]string{},
+		"client networks allowed to reach any route, empty allows every network")
+	startCmd.PersistentFlags().StringSlice(
+		"deny-cidrs",
+		[]string{},
+		"client networks denied on every route, deny wins over allow")
+	startCmd.PersistentFlags().Int(
+		"xff-trusted-hops",
+		0,
+		"trusted proxies in front of envoy, the client address is the n-th x-forwarded-for entry from the right, 0 uses the envoy peer address")
+	startCmd.PersistentFlags().Float64(
+		"identity-rate-limit",
+		0,
+		"allowed requests per second of an identity on a route, anonymous requests are limited by client address, 0 disables the limit")
+	startCmd.PersistentFlags().Int(
+		"identity-rate-burst",
+		0,
+		"identity rate limit burst, defaults to one second of requests")
+	startCmd.PersistentFlags().Float64(
+		"failed-auth-rate-limit",
+		0,
+		"failed authentications per second of a client address, 0 disables the limit")
+	startCmd.PersistentFlags().Int(
+		"failed-auth-rate-burst",
+		0,
+		"failed authentications rate limit burst, defaults to one second of attempts")
+	startCmd.PersistentFlags().String(
+		"rls-config-file",
+		"",
+		"yaml|json envoy rate limit service descriptors file with a top level domains list, the service is disabled when empty")
+	startCmd.PersistentFlags().Bool(
+		"audit-only",
+		false,
+		"log and count the denials but allow the requests, route rules can override it")
+	startCmd.PersistentFlags().StringSlice(
+		"decision-log-sinks",
+		[]string{},
+		"ndjson decision log sinks: stdout, file, webhook, the decision log is disabled when empty")
+	startCmd.PersistentFlags().StringSlice(
+		"decision-log-redact-fields",
+		[]string{},
+		"decision log fields replaced with their hmac-sha256 under the redact key: requestId, host, path, sourceIp, subject")
+	startCmd.PersistentFlags().String(
+		"decision-log-redact-key-file",
+		"",
+		"file with the secret key (at least 32 bytes) of the decision log redaction, required with redact fields")
+	startCmd.PersistentFlags().String(
+		"decision-log-file",
+		"",
+		"decision log file of the file sink")
+	startCmd.PersistentFlags().Int64(
+		"decision-log-file-max-size-mb",
+		100,
+		"decision log file size which triggers a rotation")
+	startCmd.PersistentFlags().Int(
+		"decision-log-file-max-backups",
+		5,
+		"rotated decision log files to keep")
+	startCmd.PersistentFlags().String(
+		"decision-log-webhook-url",
+		"",
+		"url the webhook sink posts the ndjson batches to")
+	startCmd.PersistentFlags().Int(
+		"decision-log-webhook-batch-size",
+		100,
+		"records per webhook post")
+	startCmd.PersistentFlags().Duration(
+		"decision-log-webhook-flush-interval",
+		time.Second*5,
+		"max time a record waits for its webhook batch")
+	startCmd.PersistentFlags().StringSlice(
+		"metrics-path-templates",
+		[]string{},
+		"path templates of the check metrics path label, e.g. /notebook/{ns}/{name}/*, other paths are labeled other")
+	startCmd.PersistentFlags().StringSlice(
+		"metrics-hosts",
+		[]string{},
+		"hosts of the check metrics host label, exact or *.<domain> wildcards, other hosts are labeled other")
+	startCmd.PersistentFlags().String(
+		"tracing-exporter",
+		tracing.ExporterNone,
+		fmt.Sprintf("span exporter - %s|%s|%s, the W3C traceparent and B3 headers are propagated either way", tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout))
+	startCmd.PersistentFlags().String(
+		"tracing-otlp-endpoint",
+		"",
+		"host:port of the otlp grpc collector, defaults to OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317")
+	startCmd.PersistentFlags().Bool(
+		"tracing-otlp-insecure",
+		false,
+		"connect to the otlp collector without tls")
+	startCmd.PersistentFlags().Float64(
+		"tracing-sample-ratio",
+		1,
+		"ratio of the traces started by exa which are sampled, the sampling decision of the caller is respected")
+	startCmd.PersistentFlags().Duration(
+		"drain-timeout",
+		time.Second*15,
+		"time to wait for the in-flight checks on shutdown, the remaining connections are closed after the timeout")
 	startCmd.PersistentFlags().StringSlice(
 		"disable-validators",
 		[]string{},
@@ -70,12 +327,74 @@ func init() {
 	viper.BindPFlag("bind-addr", startCmd.PersistentFlags().Lookup("bind-addr"))
 	viper.BindPFlag("auth-cookie", startCmd.PersistentFlags().Lookup("auth-cookie"))
 	viper.BindPFlag("token-src-header", startCmd.PersistentFlags().Lookup("token-src-header"))
+	viper.BindPFlag("token-sources", startCmd.PersistentFlags().Lookup("token-sources"))
 	viper.BindPFlag("user-id-header", startCmd.PersistentFlags().Lookup("user-id-header"))
 	viper.BindPFlag("insecure-skip-verify", startCmd.PersistentFlags().Lookup("insecure-skip-verify"))
+	viper.BindPFlag("tls-ca-files", startCmd.PersistentFlags().Lookup("tls-ca-files"))
+	viper.BindPFlag("tls-client-cert", startCmd.PersistentFlags().Lookup("tls-client-cert"))
+	viper.BindPFlag("tls-client-key", startCmd.PersistentFlags().Lookup("tls-client-key"))
+	viper.BindPFlag("tls-server-name", startCmd.PersistentFlags().Lookup("tls-server-name"))
+	viper.BindPFlag("proxy-url", startCmd.PersistentFlags().Lookup("proxy-url"))
 	viper.BindPFlag("metrics-addr", startCmd.PersistentFlags().Lookup("metrics-addr"))
 	viper.BindPFlag("jwks-servers", startCmd.PersistentFlags().Lookup("jwks-servers"))
+	viper.BindPFlag("jwks-files", startCmd.PersistentFlags().Lookup("jwks-files"))
+	viper.BindPFlag("public-key-dirs", startCmd.PersistentFlags().Lookup("public-key-dirs"))
+	viper.BindPFlag("hmac-secret-files", startCmd.PersistentFlags().Lookup("hmac-secret-files"))
+	viper.BindPFlag("jwe-key-files", startCmd.PersistentFlags().Lookup("jwe-key-files"))
+	viper.BindPFlag("oidc-issuers", startCmd.PersistentFlags().Lookup("oidc-issuers"))
+	viper.BindPFlag("token-algorithms", startCmd.PersistentFlags().Lookup("token-algorithms"))
+	viper.BindPFlag("token-leeway", startCmd.PersistentFlags().Lookup("token-leeway"))
+	viper.BindPFlag("token-max-age", startCmd.PersistentFlags().Lookup("token-max-age"))
+	viper.BindPFlag("token-required-claims", startCmd.PersistentFlags().Lookup("token-required-claims"))
+	viper.BindPFlag("token-types", startCmd.PersistentFlags().Lookup("token-types"))
+	viper.BindPFlag("dpop-required", startCmd.PersistentFlags().Lookup("dpop-required"))
+	viper.BindPFlag("dpop-algorithms", startCmd.PersistentFlags().Lookup("dpop-algorithms"))
+	viper.BindPFlag("dpop-proof-lifetime", startCmd.PersistentFlags().Lookup("dpop-proof-lifetime"))
 	viper.BindPFlag("oauth2-token-issuer", startCmd.PersistentFlags().Lookup("oauth2-token-issuer"))
 	viper.BindPFlag("oauth2-claims-validate", startCmd.PersistentFlags().Lookup("oauth2-claims-validate"))
+	viper.BindPFlag("decision-cache-size", startCmd.PersistentFlags().Lookup("decision-cache-size"))
+	viper.BindPFlag("decision-cache-ttl", startCmd.PersistentFlags().Lookup("decision-cache-ttl"))
+	viper.BindPFlag("revocation-file", startCmd.PersistentFlags().Lookup("revocation-file"))
+	viper.BindPFlag("admin-addr", startCmd.PersistentFlags().Lookup("admin-addr"))
+	viper.BindPFlag("admin-token-file", startCmd.PersistentFlags().Lookup("admin-token-file"))
+	viper.BindPFlag("admin-tls-cert", startCmd.PersistentFlags().Lookup("admin-tls-cert"))
+	viper.BindPFlag("admin-tls-key", startCmd.PersistentFlags().Lookup("admin-tls-key"))
+	viper.BindPFlag("admin-client-ca-files", startCmd.PersistentFlags().Lookup("admin-client-ca-files"))
+	viper.BindPFlag("admin-allowed-clients", startCmd.PersistentFlags().Lookup("admin-allowed-clients"))
+	viper.BindPFlag("grpc-tls-cert", startCmd.PersistentFlags().Lookup("grpc-tls-cert"))
+	viper.BindPFlag("grpc-tls-key", startCmd.PersistentFlags().Lookup("grpc-tls-key"))
+	viper.BindPFlag("grpc-client-ca-files", startCmd.PersistentFlags().Lookup("grpc-client-ca-files"))
+	viper.BindPFlag("grpc-allowed-clients", startCmd.PersistentFlags().Lookup("grpc-allowed-clients"))
+	viper.BindPFlag("metrics-tls-cert", startCmd.PersistentFlags().Lookup("metrics-tls-cert"))
+	viper.BindPFlag("metrics-tls-key", startCmd.PersistentFlags().Lookup("metrics-tls-key"))
+	viper.BindPFlag("metrics-client-ca-files", startCmd.PersistentFlags().Lookup("metrics-client-ca-files"))
+	viper.BindPFlag("metrics-allowed-clients", startCmd.PersistentFlags().Lookup("metrics-allowed-clients"))
+	viper.BindPFlag("route-rules-file", startCmd.PersistentFlags().Lookup("route-rules-file"))
+	viper.BindPFlag("allow-cidrs", startCmd.PersistentFlags().Lookup("allow-cidrs"))
+	viper.BindPFlag("deny-cidrs", startCmd.PersistentFlags().Lookup("deny-cidrs"))
+	viper.BindPFlag("xff-trusted-hops", startCmd.PersistentFlags().Lookup("xff-trusted-hops"))
+	viper.BindPFlag("identity-rate-limit", startCmd.PersistentFlags().Lookup("identity-rate-limit"))
+	viper.BindPFlag("identity-rate-burst", startCmd.PersistentFlags().Lookup("identity-rate-burst"))
+	viper.BindPFlag("failed-auth-rate-limit", startCmd.PersistentFlags().Lookup("failed-auth-rate-limit"))
+	viper.BindPFlag("failed-auth-rate-burst", startCmd.PersistentFlags().Lookup("failed-auth-rate-burst"))
+	viper.BindPFlag("rls-config-file", startCmd.PersistentFlags().Lookup("rls-config-file"))
+	viper.BindPFlag("audit-only", startCmd.PersistentFlags().Lookup("audit-only"))
+	viper.BindPFlag("decision-log-sinks", startCmd.PersistentFlags().Lookup("decision-log-sinks"))
+	viper.BindPFlag("decision-log-redact-fields", startCmd.PersistentFlags().Lookup("decision-log-redact-fields"))
+	viper.BindPFlag("decision-log-redact-key-file", startCmd.PersistentFlags().Lookup("decision-log-redact-key-file"))
+	viper.BindPFlag("decision-log-file", startCmd.PersistentFlags().Lookup("decision-log-file"))
+	viper.BindPFlag("decision-log-file-max-size-mb", startCmd.PersistentFlags().Lookup("decision-log-file-max-size-mb"))
+	viper.BindPFlag("decision-log-file-max-backups", startCmd.PersistentFlags().Lookup("decision-log-file-max-backups"))
+	viper.BindPFlag("decision-log-webhook-url", startCmd.PersistentFlags().Lookup("decision-log-webhook-url"))
+	viper.BindPFlag("decision-log-webhook-batch-size", startCmd.PersistentFlags().Lookup("decision-log-webhook-batch-size"))
+	viper.BindPFlag("decision-log-webhook-flush-interval", startCmd.PersistentFlags().Lookup("decision-log-webhook-flush-interval"))
+	viper.BindPFlag("metrics-path-templates", startCmd.PersistentFlags().Lookup("metrics-path-templates"))
+	viper.BindPFlag("metrics-hosts", startCmd.PersistentFlags().Lookup("metrics-hosts"))
+	viper.BindPFlag("tracing-exporter", startCmd.PersistentFlags().Lookup("tracing-exporter"))
+	viper.BindPFlag("tracing-otlp-endpoint", startCmd.PersistentFlags().Lookup("tracing-otlp-endpoint"))
+	viper.BindPFlag("tracing-otlp-insecure", startCmd.PersistentFlags().Lookup("tracing-otlp-insecure"))
+	viper.BindPFlag("tracing-sample-ratio", startCmd.PersistentFlags().Lookup("tracing-sample-ratio"))
+	viper.BindPFlag("drain-timeout", startCmd.PersistentFlags().Lookup("drain-timeout"))
 	viper.BindPFlag("disable-validators", startCmd.PersistentFlags().Lookup("disable-validators"))
 	viper.BindPFlag("redirect-url", startCmd.PersistentFlags().Lookup("redirect-url"))
 
@@ -86,18 +405,24 @@ var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "start exa authz server",
 	Run: func(cmd *cobra.Command, args []string) {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/profile", pprof.Profile)
-		go func() { http.ListenAndServe(":7777", mux) }()
-
-		startServer()
-		// handle interrupts
+		shutdownTracing := startTracing("exa-authz")
+		grpcServer, store, health := startServer(cmd)
+		// handle interrupts, SIGHUP reloads the config file
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 		for {
 			select {
 			case s := <-sigCh:
+				if s == syscall.SIGHUP {
+					zap.S().Infof("signal: %s, reloading the configuration", s)
+					store.Reload()
+					continue
+				}
 				zap.S().Infof("signal: %s, shutting down", s)
+				health.Drain()
+				stopServer(grpcServer, viper.GetDuration("drain-timeout"))
+				shutdownTracing()
+				store.Close()
 				zap.S().Info("bye bye 👋")
 				os.Exit(0)
 			}
@@ -105,7 +430,7 @@ var startCmd = &cobra.Command{
 	},
 }
 
-func startServer() {
+func startServer(cmd *cobra.Command) (*grpc.Server, *options.Store, *authz.Health) {
 	var grpcServer *grpc.Server
 
 	metricsInterceptor := authz.GrpcMetrics.UnaryServerInterceptor()
@@ -115,34 +440,220 @@ func startServer() {
 		zap.S().Fatalf("failed to listen: %v", err)
 	}
 
-	grpcServerOption := grpc.UnaryInterceptor(metricsInterceptor)
+	grpcServerOptions := []grpc.ServerOption{grpc.UnaryInterceptor(metricsInterceptor)}
+	tlsCfg := serverTLS("grpc")
+	if tlsCfg.Enabled() {
+		cfg, err := tlsCfg.TLSConfig()
+		if err != nil {
+			zap.S().Fatalf("invalid grpc tls: %s", err)
+		}
+		// grpc adds the h2 protocol to its copy of the config, not to the per connection configs
+		cfg.NextProtos = []string{"h2"}
+		grpcServerOptions = append(grpcServerOptions, grpc.Creds(credentials.NewTLS(cfg)))
+	}
 
-	grpcServer = grpc.NewServer(grpcServerOption)
+	grpcServer = grpc.NewServer(grpcServerOptions...)
 	grpcprometheus.Register(grpcServer)
+	store, err := options.NewStore(viper.ConfigFileUsed(), func() *viper.Viper { return newConfig(cmd) })
+	if err != nil {
+		zap.S().Fatalf("invalid configuration: %s", err)
+	}
 	authz.NewAuthzService(
 		grpcServer,
-		options.NewOptionsFromFlags(),
+		store,
+	)
+	authz.NewRateLimitService(
+		grpcServer,
+		store,
 	)
+	health := authz.NewHealth(grpcServer, store)
 	// Initialize all metrics.
 	authz.GrpcMetrics.InitializeMetrics(grpcServer)
 	authz.GrpcMetrics.EnableHandlingTimeHistogram()
-	startMetrics()
+	startMetrics(health)
+	startAdmin(store)
+
+	zap.S().Infof("grpc authz server listening on %s, tls: %t, client certificates: %t",
+		viper.GetString("bind-addr"), tlsCfg.Enabled(), tlsCfg.ClientAuth())
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			zap.S().Fatal(err)
+		}
+	}()
+	return grpcServer, store, health
+}
 
-	zap.S().Infof("grpc authz server listening on %s", viper.GetString("bind-addr"))
-	if err := grpcServer.Serve(lis); err != nil {
-		zap.S().Fatal(err)
+// stopServer waits for the in-flight checks up to the drain timeout, the clients get a
+// GOAWAY and reconnect to the other instances, the remaining connections are then closed
+func stopServer(grpcServer *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		zap.S().Info("in-flight checks completed")
+	case <-time.After(timeout):
+		zap.S().Warnf("drain timeout %s exceeded, closing the remaining connections", timeout)
+		grpcServer.Stop()
 	}
 }
 
-func startMetrics() {
+// startTracing installs the tracer provider, the returned function flushes the pending spans
+func startTracing(serviceName string) func() {
+	shutdown, err := tracing.Init(tracing.Config{
+		ServiceName:  serviceName,
+		Exporter:     viper.GetString("tracing-exporter"),
+		OTLPEndpoint: viper.GetString("tracing-otlp-endpoint"),
+		OTLPInsecure: viper.GetBool("tracing-otlp-insecure"),
+		SampleRatio:  viper.GetFloat64("tracing-sample-ratio"),
+	})
+	if err != nil {
+		zap.S().Fatalf("failed to init tracing: %s", err)
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			zap.S().Errorf("failed to flush spans: %s", err)
+		}
+	}
+}
+
+// startMetrics serves the metrics and the health checks, the health checks are unauthenticated
+// so the probes without client certificate pass, the metrics require one when client CAs are set
+func startMetrics(health *authz.Health) {
 	addr := viper.GetString("metrics-addr")
-	http.Handle("/metrics", promhttp.HandlerFor(authz.Reg, promhttp.HandlerOpts{}))
+	tlsCfg := serverTLS("metrics")
+	var metricsHandler http.Handler = promhttp.HandlerFor(authz.Reg, promhttp.HandlerOpts{})
+	if tlsCfg.ClientAuth() {
+		metricsHandler = requireClientCert(metricsHandler)
+	}
+	http.Handle("/metrics", metricsHandler)
+	http.HandleFunc(authz.HealthzPath, health.HealthzHandler)
+	http.HandleFunc(authz.ReadyzPath, health.ReadyzHandler)
+	srv := &http.Server{Addr: addr}
+	if tlsCfg.Enabled() {
+		cfg, err := tlsCfg.TLSConfig()
+		if err != nil {
+			zap.S().Fatalf("invalid metrics tls: %s", err)
+		}
+		if tlsCfg.ClientAuth() {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		srv.TLSConfig = cfg
+	}
 	go func() {
-		zap.S().Infof("metrics exporter on %s/metrics", viper.GetString("metrics-addr"))
-		err := http.ListenAndServe(addr, nil)
+		zap.S().Infof("metrics exporter on %s/metrics, tls: %t, client certificates: %t",
+			addr, tlsCfg.Enabled(), tlsCfg.ClientAuth())
+		var err error
+		if tlsCfg.Enabled() {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
 		if err != nil {
 			zap.S().Error("failed to start metrics server: ", err)
 			return
 		}
 	}()
 }
+
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newConfig returns a viper with the env and the cmd flags bound, the options store reads
+// the config file into it on every reload, so the global viper holds the startup config
+// only and is never written while serving
+func newConfig(cmd *cobra.Command) *viper.Viper {
+	v := viper.New()
+	bindEnv(v)
+	if err := v.BindPFlags(cmd.PersistentFlags()); err != nil {
+		zap.S().Fatalf("failed to bind the flags: %s", err)
+	}
+	return v
+}
+
+// startAdmin serves the admin api, clients authenticate with the bearer token or
+// a verified client certificate, the api is open read-only only on a loopback address
+func startAdmin(store *options.Store) {
+	addr := viper.GetString("admin-addr")
+	tlsCfg := serverTLS("admin")
+	var token string
+	if tokenFile := viper.GetString("admin-token-file"); tokenFile != "" {
+		raw, err := os.ReadFile(tokenFile)
+		if err != nil {
+			zap.S().Fatalf("failed to read the admin token: %s", err)
+		}
+		if token = strings.TrimSpace(string(raw)); token == "" {
+			zap.S().Fatalf("admin token file %s is empty", tokenFile)
+		}
+	}
+	if token == "" && !tlsCfg.ClientAuth() && !loopback(addr) {
+		zap.S().Fatalf("admin api on %s requires admin-token-file or admin-client-ca-files", addr)
+	}
+	if token == "" && !tlsCfg.ClientAuth() {
+		zap.S().Warnf("admin api on %s is unauthenticated and read-only, "+
+			"set admin-token-file or admin-client-ca-files to enable the write endpoints and pprof", addr)
+	}
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: admin.NewServer(store, logLevel, token, tlsCfg.ClientAuth()).Handler(),
+	}
+	if tlsCfg.Enabled() {
+		cfg, err := tlsCfg.TLSConfig()
+		if err != nil {
+			zap.S().Fatalf("invalid admin api tls: %s", err)
+		}
+		// the token authenticates the clients without a certificate
+		if token != "" && tlsCfg.ClientAuth() {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		srv.TLSConfig = cfg
+	}
+	go func() {
+		zap.S().Infof("admin api on %s, tls: %t, client certificates: %t, token: %t",
+			addr, tlsCfg.Enabled(), tlsCfg.ClientAuth(), token != "")
+		var err error
+		if tlsCfg.Enabled() {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
+			zap.S().Error("failed to start admin server: ", err)
+		}
+	}()
+}
+
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serverTLS returns the tls settings of a listener from the <name>-tls-cert, <name>-tls-key,
+// <name>-client-ca-files and <name>-allowed-clients flags
+func serverTLS(name string) tlsutil.ServerConfig {
+	return tlsutil.ServerConfig{
+		CertFile:       viper.GetString(name + "-tls-cert"),
+		KeyFile:        viper.GetString(name + "-tls-key"),
+		ClientCAFiles:  viper.GetStringSlice(name + "-client-ca-files"),
+		AllowedClients: viper.GetStringSlice(name + "-allowed-clients"),
+	}
+}
@@ -1,13 +1,17 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"github.com/Dimss/exa/pkg/ssocentral/srv"
+	"github.com/Dimss/exa/pkg/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func init() {
@@ -31,11 +35,61 @@ func init() {
 		"",
 		":8080/dex-callback",
 		"dex callback url")
+	startCmd.PersistentFlags().Bool(
+		"insecure-skip-verify",
+		false,
+		"skip https verification of the oidc provider")
+	startCmd.PersistentFlags().StringSlice(
+		"tls-ca-files",
+		[]string{},
+		"ca bundle files used to verify the oidc provider, system roots are used when empty")
+	startCmd.PersistentFlags().String(
+		"tls-client-cert",
+		"",
+		"client certificate file for mTLS to the oidc provider")
+	startCmd.PersistentFlags().String(
+		"tls-client-key",
+		"",
+		"client key file for mTLS to the oidc provider")
+	startCmd.PersistentFlags().String(
+		"tls-server-name",
+		"",
+		"override the SNI and verified server name of the oidc provider")
+	startCmd.PersistentFlags().String(
+		"proxy-url",
+		"",
+		"http proxy for the oidc provider, defaults to HTTPS_PROXY/NO_PROXY env")
+	startCmd.PersistentFlags().String(
+		"tracing-exporter",
+		tracing.ExporterNone,
+		fmt.Sprintf("span exporter - %s|%s|%s, the W3C traceparent and B3 headers are propagated either way", tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout))
+	startCmd.PersistentFlags().String(
+		"tracing-otlp-endpoint",
+		"",
+		"host:port of the otlp grpc collector, defaults to OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317")
+	startCmd.PersistentFlags().Bool(
+		"tracing-otlp-insecure",
+		false,
+		"connect to the otlp collector without tls")
+	startCmd.PersistentFlags().Float64(
+		"tracing-sample-ratio",
+		1,
+		"ratio of the traces started by sso central which are sampled, the sampling decision of the caller is respected")
 
 	viper.BindPFlag("bind-addr", startCmd.PersistentFlags().Lookup("bind-addr"))
 	viper.BindPFlag("dex-issuer-suffix", startCmd.PersistentFlags().Lookup("dex-issuer-suffix"))
 	viper.BindPFlag("dex-redirect-suffix", startCmd.PersistentFlags().Lookup("dex-redirect-suffix"))
 	viper.BindPFlag("base-url", startCmd.PersistentFlags().Lookup("base-url"))
+	viper.BindPFlag("insecure-skip-verify", startCmd.PersistentFlags().Lookup("insecure-skip-verify"))
+	viper.BindPFlag("tls-ca-files", startCmd.PersistentFlags().Lookup("tls-ca-files"))
+	viper.BindPFlag("tls-client-cert", startCmd.PersistentFlags().Lookup("tls-client-cert"))
+	viper.BindPFlag("tls-client-key", startCmd.PersistentFlags().Lookup("tls-client-key"))
+	viper.BindPFlag("tls-server-name", startCmd.PersistentFlags().Lookup("tls-server-name"))
+	viper.BindPFlag("proxy-url", startCmd.PersistentFlags().Lookup("proxy-url"))
+	viper.BindPFlag("tracing-exporter", startCmd.PersistentFlags().Lookup("tracing-exporter"))
+	viper.BindPFlag("tracing-otlp-endpoint", startCmd.PersistentFlags().Lookup("tracing-otlp-endpoint"))
+	viper.BindPFlag("tracing-otlp-insecure", startCmd.PersistentFlags().Lookup("tracing-otlp-insecure"))
+	viper.BindPFlag("tracing-sample-ratio", startCmd.PersistentFlags().Lookup("tracing-sample-ratio"))
 
 	rootCmd.AddCommand(startCmd)
 }
@@ -45,7 +99,20 @@ var startCmd = &cobra.Command{
 	Short:   "start sso central server",
 	Aliases: []string{"central"},
 	Run: func(cmd *cobra.Command, args []string) {
-		srv.Run(viper.GetString("bind-addr"), "white", "SSO CENTRAL")
+		shutdown, err := tracing.Init(tracing.Config{
+			ServiceName:  "exa-ssocentral",
+			Exporter:     viper.GetString("tracing-exporter"),
+			OTLPEndpoint: viper.GetString("tracing-otlp-endpoint"),
+			OTLPInsecure: viper.GetBool("tracing-otlp-insecure"),
+			SampleRatio:  viper.GetFloat64("tracing-sample-ratio"),
+		})
+		if err != nil {
+			zap.S().Fatalf("failed to init tracing: %s", err)
+		}
+		if err := srv.InitOIDCClient(); err != nil {
+			zap.S().Fatal(err)
+		}
+		go srv.Run(viper.GetString("bind-addr"), "white", "SSO CENTRAL")
 		// handle interrupts
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -53,6 +120,11 @@ var startCmd = &cobra.Command{
 			select {
 			case s := <-sigCh:
 				zap.S().Infof("signal: %s, shutting down", s)
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+				if err := shutdown(ctx); err != nil {
+					zap.S().Errorf("failed to flush spans: %s", err)
+				}
+				cancel()
 				zap.S().Info("bye bye 👋")
 				os.Exit(0)
 			}
@@ -0,0 +1,157 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/revocation"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+const (
+	ConfigPath   = "/config"
+	JwksPath     = "/jwks"
+	CachePath    = "/cache"
+	RulesPath    = "/rules"
+	LogLevelPath = "/log-level"
+	ReloadPath   = "/reload"
+	PprofPath    = "/debug/pprof/"
+)
+
+// Server serves the admin API:
+//
+//	GET          /config       effective config, secrets redacted, and the reload status
+//	POST         /reload       reloads the config file
+//	GET          /jwks         key sources with their kids and last refresh
+//	GET, DELETE  /cache        decision cache stats, DELETE flushes the cache
+//	GET          /rules        token policies and route rules with hit counts
+//	GET, PUT     /log-level    zap log level, ex: {"level":"debug"}
+//	             /revocations  token revocations
+//	             /debug/pprof/ runtime profiles
+type Server struct {
+	store *options.Store
+	level zap.AtomicLevel
+	// token is the bearer token of the admin API, clients can present a verified certificate instead
+	token string
+	// open allows unauthenticated read-only requests, set only when neither a token nor client certificates
+	// are configured
+	open bool
+}
+
+func NewServer(store *options.Store, level zap.AtomicLevel, token string, clientAuth bool) *Server {
+	return &Server{
+		store: store,
+		level: level,
+		token: token,
+		open:  token == "" && !clientAuth,
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ConfigPath, s.configHandler)
+	mux.HandleFunc(ReloadPath, s.reloadHandler)
+	mux.HandleFunc(JwksPath, s.jwksHandler)
+	mux.HandleFunc(CachePath, s.cacheHandler)
+	mux.HandleFunc(RulesPath, s.rulesHandler)
+	mux.Handle(LogLevelPath, s.level)
+	// the revocations store is kept across config reloads
+	revocations := s.store.Load().Revocations.Handler()
+	mux.Handle(revocation.PathPrefix, revocations)
+	mux.Handle(revocation.PathPrefix+"/", revocations)
+	mux.HandleFunc(PprofPath, pprof.Index)
+	mux.HandleFunc(PprofPath+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(PprofPath+"profile", pprof.Profile)
+	mux.HandleFunc(PprofPath+"symbol", pprof.Symbol)
+	mux.HandleFunc(PprofPath+"trace", pprof.Trace)
+	return s.authenticate(mux)
+}
+
+// authenticate accepts a verified client certificate or the bearer token, an open server
+// accepts only read-only requests
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (s.open && readOnly(r)) || (r.TLS != nil && len(r.TLS.VerifiedChains) > 0) || s.validToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		zap.S().Warnf("unauthenticated admin api request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="exa-admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// readOnly reports whether r doesn't change the state of the server, the profiles are
+// excluded since they expose the process memory and command line
+func readOnly(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return !strings.HasPrefix(r.URL.Path, PprofPath)
+}
+
+func (s *Server) validToken(r *http.Request) bool {
+	if s.token == "" {
+		return false
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"settings": redactMap(s.store.Load().Settings),
+		"reload":   s.store.Status(),
+	})
+}
+
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	zap.S().Infof("config reload requested from the admin api by %s", r.RemoteAddr)
+	if err := s.store.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	decisionCache := s.store.Load().DecisionCache
+	if decisionCache == nil {
+		http.Error(w, "decision cache is disabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, decisionCache.Stats())
+	case http.MethodDelete:
+		decisionCache.Purge()
+		zap.S().Infof("decision cache flushed from the admin api by %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		zap.S().Errorf("failed to write admin api response: %s", err)
+	}
+}
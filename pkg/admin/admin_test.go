@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+	tests := []struct {
+		name       string
+		token      string
+		clientAuth bool
+		method     string
+		path       string
+		header     string
+		tls        *tls.ConnectionState
+		want       int
+	}{
+		{name: "open read", method: http.MethodGet, path: ConfigPath, want: http.StatusOK},
+		{name: "open revocations list", method: http.MethodGet, path: "/revocations", want: http.StatusOK},
+		{name: "open reload", method: http.MethodPost, path: ReloadPath, want: http.StatusUnauthorized},
+		{name: "open log level", method: http.MethodPut, path: LogLevelPath, want: http.StatusUnauthorized},
+		{name: "open revoke", method: http.MethodPut, path: "/revocations/jtis/a", want: http.StatusUnauthorized},
+		{name: "open cache flush", method: http.MethodDelete, path: CachePath, want: http.StatusUnauthorized},
+		{name: "open pprof", method: http.MethodGet, path: PprofPath + "heap", want: http.StatusUnauthorized},
+		{name: "token", token: "t0k3n", method: http.MethodPost, path: ReloadPath, header: "Bearer t0k3n", want: http.StatusOK},
+		{name: "wrong token", token: "t0k3n", method: http.MethodGet, path: ConfigPath, header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "missing token", token: "t0k3n", method: http.MethodGet, path: ConfigPath, want: http.StatusUnauthorized},
+		{name: "client certificate", clientAuth: true, method: http.MethodPost, path: ReloadPath, tls: verified, want: http.StatusOK},
+		{name: "missing client certificate", clientAuth: true, method: http.MethodGet, path: ConfigPath, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil, zap.NewAtomicLevel(), tt.token, tt.clientAuth)
+			h := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			req.TLS = tt.tls
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
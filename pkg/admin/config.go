@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"net/url"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// secretKeys are the config keys holding secrets, file paths are not redacted.
+// Webhook urls are secrets as a whole, e.g. the token in the path of a slack webhook
+var secretKeys = []string{"token", "secret", "password", "private-key", "webhook-url", "webhook-urls"}
+
+// redactMap redacts the secrets of the merged flags, env and config file settings,
+// the credentials and the query values of urls (e.g. a proxy or an issuer) are redacted too
+func redactMap(settings map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if secretKey(key) {
+			out[key] = redacted
+			continue
+		}
+		out[key] = redactValue(value)
+	}
+	return out
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return redactMap(v)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i := range v {
+			values[i] = redactValue(v[i])
+		}
+		return values
+	case []string:
+		values := make([]string, len(v))
+		for i := range v {
+			values[i] = redactURL(v[i])
+		}
+		return values
+	case string:
+		return redactURL(v)
+	}
+	return value
+}
+
+func secretKey(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "-file") || strings.HasSuffix(key, "-files") || strings.HasSuffix(key, "-dirs") {
+		return false
+	}
+	for _, secret := range secretKeys {
+		if strings.HasSuffix(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL redacts the user info, the query values and the fragment of urls,
+// other strings are returned as is, an unparsable url is redacted as a whole
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{"redacted"}
+		}
+		u.RawQuery = query.Encode()
+	}
+	if u.Fragment != "" {
+		u.Fragment = "redacted"
+	}
+	return u.String()
+}
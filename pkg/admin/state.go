@@ -0,0 +1,137 @@
+package admin
+
+import (
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/ratelimit"
+	"github.com/Dimss/exa/pkg/routes"
+	"net/http"
+	"time"
+)
+
+// KeySource is a key source of the validator with its refresh result,
+// the refresh fields are set on the sources fetched from a jwks server
+type KeySource struct {
+	Name        string     `json:"name"`
+	Issuer      bool       `json:"issuer,omitempty"`
+	JwksURI     string     `json:"jwksUri,omitempty"`
+	Ready       bool       `json:"ready"`
+	KIDs        []string   `json:"kids"`
+	Refreshes   *uint64    `json:"refreshes,omitempty"`
+	Failures    *uint64    `json:"failures,omitempty"`
+	LastRefresh *time.Time `json:"lastRefresh,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+func (k *KeySource) setStats(stats *options.JwksStats) {
+	refreshes, failures := stats.Refreshes(), stats.Failures()
+	k.Refreshes, k.Failures = &refreshes, &failures
+	if last, err := stats.LastRefresh(); !last.IsZero() {
+		k.LastRefresh = &last
+		if err != nil {
+			k.LastError = err.Error()
+		}
+	}
+}
+
+type Policy struct {
+	Algorithms     []string `json:"algorithms,omitempty"`
+	Leeway         string   `json:"leeway"`
+	MaxAge         string   `json:"maxAge"`
+	RequiredClaims []string `json:"requiredClaims,omitempty"`
+	Types          []string `json:"types,omitempty"`
+}
+
+func newPolicy(p options.TokenPolicy) *Policy {
+	return &Policy{
+		Algorithms:     p.Algorithms,
+		Leeway:         p.Leeway.String(),
+		MaxAge:         p.MaxAge.String(),
+		RequiredClaims: p.RequiredClaims,
+		Types:          p.Types,
+	}
+}
+
+type IssuerPolicy struct {
+	Issuer    string   `json:"issuer"`
+	Audiences []string `json:"audiences,omitempty"`
+	Policy    *Policy  `json:"policy"`
+}
+
+type Rule struct {
+	Name      string           `json:"name"`
+	Hosts     []string         `json:"hosts,omitempty"`
+	Methods   []string         `json:"methods,omitempty"`
+	Path      string           `json:"path,omitempty"`
+	Auth      routes.AuthMode  `json:"auth"`
+	AuditOnly *bool            `json:"auditOnly,omitempty"`
+	RateLimit *ratelimit.Limit `json:"rateLimit,omitempty"`
+	CORS      bool             `json:"cors,omitempty"`
+	CSRF      bool             `json:"csrf,omitempty"`
+	Network   bool             `json:"network,omitempty"`
+	Hits      uint64           `json:"hits"`
+}
+
+// Rules is the loaded token policies and route rules, in match order
+type Rules struct {
+	TokenPolicy       *Policy         `json:"tokenPolicy"`
+	ShadowTokenPolicy *Policy         `json:"shadowTokenPolicy,omitempty"`
+	Issuers           []*IssuerPolicy `json:"issuers,omitempty"`
+	Rules             []*Rule         `json:"rules"`
+}
+
+func (s *Server) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	opts := s.store.Load()
+	keySources := []*KeySource{}
+	for _, src := range opts.KeySources {
+		ks := &KeySource{Name: src.Name(), KIDs: src.KIDs(), Ready: options.KeySourceReady(src)}
+		if rs, ok := src.(options.RefreshStats); ok {
+			ks.setStats(rs.Stats())
+		}
+		keySources = append(keySources, ks)
+	}
+	for _, iss := range opts.Issuers {
+		ks := &KeySource{Name: iss.URL, Issuer: true, JwksURI: iss.JwksURI(), Ready: iss.Ready(), KIDs: iss.KIDs()}
+		ks.setStats(iss.Stats())
+		keySources = append(keySources, ks)
+	}
+	writeJSON(w, http.StatusOK, keySources)
+}
+
+func (s *Server) rulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	opts := s.store.Load()
+	rules := &Rules{TokenPolicy: newPolicy(opts.TokenPolicy), Rules: []*Rule{}}
+	if opts.ShadowTokenPolicy != nil {
+		rules.ShadowTokenPolicy = newPolicy(*opts.ShadowTokenPolicy)
+	}
+	for _, iss := range opts.Issuers {
+		rules.Issuers = append(rules.Issuers, &IssuerPolicy{
+			Issuer:    iss.URL,
+			Audiences: iss.Audiences,
+			Policy:    newPolicy(iss.Policy()),
+		})
+	}
+	for _, rule := range opts.Routes.Rules() {
+		rules.Rules = append(rules.Rules, &Rule{
+			Name:      rule.Name,
+			Hosts:     rule.Hosts,
+			Methods:   rule.Methods,
+			Path:      rule.Path,
+			Auth:      rule.Auth,
+			AuditOnly: rule.AuditOnly,
+			RateLimit: rule.RateLimit,
+			CORS:      rule.CORS != nil,
+			CSRF:      rule.CSRF != nil,
+			Network:   rule.Network != nil,
+			Hits:      rule.Hits(),
+		})
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
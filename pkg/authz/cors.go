@@ -0,0 +1,130 @@
+package authz
+
+import (
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/Dimss/exa/pkg/validator"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gogo/googleapis/google/rpc"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	originHeader                = "origin"
+	accessControlRequestMethod  = "access-control-request-method"
+	accessControlRequestHeaders = "access-control-request-headers"
+	accessControlAllowOrigin    = "Access-Control-Allow-Origin"
+	accessControlAllowMethods   = "Access-Control-Allow-Methods"
+	accessControlAllowHeaders   = "Access-Control-Allow-Headers"
+	accessControlAllowCreds     = "Access-Control-Allow-Credentials"
+	accessControlExposeHeaders  = "Access-Control-Expose-Headers"
+	accessControlMaxAge         = "Access-Control-Max-Age"
+	preflightVary               = "Origin, Access-Control-Request-Method, Access-Control-Request-Headers"
+)
+
+// isPreflight reports whether the request is a CORS preflight, preflights never carry credentials
+func isPreflight(method string, headers map[string]string) bool {
+	return method == http.MethodOptions && headers[originHeader] != "" && headers[accessControlRequestMethod] != ""
+}
+
+// answerPreflight answers the preflight directly, so it doesn't get the login redirect,
+// a rejected preflight gets no CORS headers and the browser blocks the actual request
+func (s *Service) answerPreflight(authCtx *validator.AuthContext, cors *routes.CORS, headers map[string]string) (*authv3.CheckResponse, error) {
+	origin := headers[originHeader]
+	method := headers[accessControlRequestMethod]
+	requestHeaders := headers[accessControlRequestHeaders]
+
+	if !cors.OriginAllowed(origin) || !cors.MethodAllowed(method) || !cors.HeadersAllowed(requestHeaders) {
+		authCtx.Log.Info("cors preflight rejected",
+			zap.String("rule", authCtx.Rule.Name),
+			zap.String("origin", origin),
+			zap.String("method", method),
+			zap.String("headers", requestHeaders))
+		return preflightResponse(typev3.StatusCode_Forbidden, []*corev3.HeaderValueOption{
+			headerValue("Vary", preflightVary),
+		}), nil
+	}
+
+	responseHeaders := []*corev3.HeaderValueOption{
+		headerValue(accessControlAllowOrigin, allowOrigin(cors, origin)),
+		headerValue(accessControlAllowMethods, allowMethods(cors, method)),
+		headerValue("Vary", preflightVary),
+	}
+	if requestHeaders != "" {
+		responseHeaders = append(responseHeaders, headerValue(accessControlAllowHeaders, requestHeaders))
+	}
+	if cors.AllowCredentials {
+		responseHeaders = append(responseHeaders, headerValue(accessControlAllowCreds, "true"))
+	}
+	if cors.MaxAge > 0 {
+		responseHeaders = append(responseHeaders,
+			headerValue(accessControlMaxAge, strconv.Itoa(int(cors.MaxAge.Seconds()))))
+	}
+	authCtx.Log.Debug("cors preflight allowed", zap.String("rule", authCtx.Rule.Name), zap.String("origin", origin))
+	return preflightResponse(typev3.StatusCode_NoContent, responseHeaders), nil
+}
+
+func preflightResponse(code typev3.StatusCode, headers []*corev3.HeaderValueOption) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(rpc.PERMISSION_DENIED)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: code},
+				Headers: headers,
+			},
+		},
+	}
+}
+
+// corsResponseHeaders returns the CORS headers of an allowed cross-origin request
+func corsResponseHeaders(cors *routes.CORS, headers map[string]string) []*corev3.HeaderValueOption {
+	origin := headers[originHeader]
+	if cors == nil || !cors.OriginAllowed(origin) {
+		return nil
+	}
+	responseHeaders := []*corev3.HeaderValueOption{
+		headerValue(accessControlAllowOrigin, allowOrigin(cors, origin)),
+	}
+	if cors.AllowCredentials {
+		responseHeaders = append(responseHeaders, headerValue(accessControlAllowCreds, "true"))
+	}
+	if len(cors.ExposeHeaders) > 0 {
+		responseHeaders = append(responseHeaders,
+			headerValue(accessControlExposeHeaders, strings.Join(cors.ExposeHeaders, ", ")))
+	}
+	if !cors.AnyOrigin() {
+		responseHeaders = append(responseHeaders, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: "Vary", Value: "Origin"},
+			AppendAction: corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+		})
+	}
+	return responseHeaders
+}
+
+// allowOrigin echoes the origin, unless every origin is allowed without credentials
+func allowOrigin(cors *routes.CORS, origin string) string {
+	if cors.AnyOrigin() {
+		return "*"
+	}
+	return origin
+}
+
+func allowMethods(cors *routes.CORS, method string) string {
+	if len(cors.AllowMethods) == 0 {
+		return strings.ToUpper(method)
+	}
+	return strings.Join(cors.AllowMethods, ", ")
+}
+
+// headerValue overwrites the upstream header, the authz policy is authoritative
+func headerValue(key, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header:       &corev3.HeaderValue{Key: key, Value: value},
+		AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}
+}
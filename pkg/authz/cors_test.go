@@ -0,0 +1,170 @@
+package authz
+
+import (
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/Dimss/exa/pkg/validator"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"go.uber.org/zap"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func headerMap(headers []*corev3.HeaderValueOption) map[string]string {
+	m := map[string]string{}
+	for _, h := range headers {
+		m[h.Header.Key] = h.Header.Value
+	}
+	return m
+}
+
+func compiledCORS(t *testing.T, cors *routes.CORS) *routes.CORS {
+	t.Helper()
+	if _, err := routes.CompileRules([]*routes.Rule{{Name: "cors", CORS: cors}}); err != nil {
+		t.Fatal(err)
+	}
+	return cors
+}
+
+func TestAnswerPreflight(t *testing.T) {
+	credentials := &routes.CORS{
+		AllowOrigins:     []string{"https://app.example.com"},
+		AllowMethods:     []string{"GET", "POST"},
+		AllowHeaders:     []string{"content-type"},
+		AllowCredentials: true,
+		MaxAge:           time.Minute * 10,
+	}
+	anyOrigin := &routes.CORS{AllowOrigins: []string{"*"}}
+	tests := []struct {
+		name        string
+		cors        *routes.CORS
+		headers     map[string]string
+		wantCode    typev3.StatusCode
+		wantHeaders map[string]string
+	}{
+		{
+			name:     "allowed with credentials",
+			cors:     credentials,
+			headers:  map[string]string{originHeader: "https://app.example.com", accessControlRequestMethod: "POST", accessControlRequestHeaders: "Content-Type"},
+			wantCode: typev3.StatusCode_NoContent,
+			wantHeaders: map[string]string{
+				accessControlAllowOrigin:  "https://app.example.com",
+				accessControlAllowMethods: "GET, POST",
+				accessControlAllowHeaders: "Content-Type",
+				accessControlAllowCreds:   "true",
+				accessControlMaxAge:       "600",
+				"Vary":                    preflightVary,
+			},
+		},
+		{
+			name:     "any origin",
+			cors:     anyOrigin,
+			headers:  map[string]string{originHeader: "https://other.example.com", accessControlRequestMethod: "delete"},
+			wantCode: typev3.StatusCode_NoContent,
+			wantHeaders: map[string]string{
+				accessControlAllowOrigin:  "*",
+				accessControlAllowMethods: "DELETE",
+				"Vary":                    preflightVary,
+			},
+		},
+		{
+			name:        "origin not allowed",
+			cors:        credentials,
+			headers:     map[string]string{originHeader: "https://evil.com", accessControlRequestMethod: "GET"},
+			wantCode:    typev3.StatusCode_Forbidden,
+			wantHeaders: map[string]string{"Vary": preflightVary},
+		},
+		{
+			name:        "method not allowed",
+			cors:        credentials,
+			headers:     map[string]string{originHeader: "https://app.example.com", accessControlRequestMethod: "DELETE"},
+			wantCode:    typev3.StatusCode_Forbidden,
+			wantHeaders: map[string]string{"Vary": preflightVary},
+		},
+		{
+			name:        "header not allowed",
+			cors:        credentials,
+			headers:     map[string]string{originHeader: "https://app.example.com", accessControlRequestMethod: "GET", accessControlRequestHeaders: "authorization"},
+			wantCode:    typev3.StatusCode_Forbidden,
+			wantHeaders: map[string]string{"Vary": preflightVary},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cors := compiledCORS(t, tt.cors)
+			authCtx := &validator.AuthContext{Rule: &routes.Rule{Name: "cors"}, Log: zap.NewNop()}
+			resp, err := (&Service{}).answerPreflight(authCtx, cors, tt.headers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			denied := resp.GetDeniedResponse()
+			if got := denied.GetStatus().GetCode(); got != tt.wantCode {
+				t.Errorf("status = %s, want %s", got, tt.wantCode)
+			}
+			if got := headerMap(denied.GetHeaders()); !reflect.DeepEqual(got, tt.wantHeaders) {
+				t.Errorf("headers = %v, want %v", got, tt.wantHeaders)
+			}
+		})
+	}
+}
+
+func TestCORSResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		cors   *routes.CORS
+		origin string
+		want   map[string]string
+	}{
+		{name: "no policy", origin: "https://app.example.com", want: map[string]string{}},
+		{
+			name:   "allowed origin",
+			cors:   &routes.CORS{AllowOrigins: []string{"https://app.example.com"}, AllowCredentials: true, ExposeHeaders: []string{"X-Request-Id", "Location"}},
+			origin: "https://app.example.com",
+			want: map[string]string{
+				accessControlAllowOrigin:   "https://app.example.com",
+				accessControlAllowCreds:    "true",
+				accessControlExposeHeaders: "X-Request-Id, Location",
+				"Vary":                     "Origin",
+			},
+		},
+		{name: "any origin", cors: &routes.CORS{AllowOrigins: []string{"*"}}, origin: "https://app.example.com", want: map[string]string{accessControlAllowOrigin: "*"}},
+		{name: "origin not allowed", cors: &routes.CORS{AllowOrigins: []string{"https://app.example.com"}}, origin: "https://evil.com", want: map[string]string{}},
+		{name: "same origin request", cors: &routes.CORS{AllowOrigins: []string{"https://app.example.com"}}, want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.cors != nil {
+				compiledCORS(t, tt.cors)
+			}
+			headers := map[string]string{}
+			if tt.origin != "" {
+				headers[originHeader] = tt.origin
+			}
+			if got := headerMap(corsResponseHeaders(tt.cors, headers)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("headers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    bool
+	}{
+		{name: "preflight", method: "OPTIONS", headers: map[string]string{originHeader: "https://app.example.com", accessControlRequestMethod: "POST"}, want: true},
+		{name: "options without request method", method: "OPTIONS", headers: map[string]string{originHeader: "https://app.example.com"}, want: false},
+		{name: "options without origin", method: "OPTIONS", headers: map[string]string{accessControlRequestMethod: "POST"}, want: false},
+		{name: "cross-origin get", method: "GET", headers: map[string]string{originHeader: "https://app.example.com", accessControlRequestMethod: "POST"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPreflight(tt.method, tt.headers); got != tt.want {
+				t.Errorf("isPreflight() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package authz
+
+import (
+	"context"
+	"github.com/Dimss/exa/pkg/decisionlog"
+	"github.com/Dimss/exa/pkg/tracing"
+	"github.com/Dimss/exa/pkg/validator"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"net/http"
+	"time"
+)
+
+// logDecision writes the decision record, the latency covers the whole check
+func (s *Service) logDecision(ctx context.Context, authCtx *validator.AuthContext, resp *authv3.CheckResponse, auditOnly bool, start time.Time) {
+	if s.opts.DecisionLog == nil || resp == nil {
+		return
+	}
+	httpReq := authCtx.Request().Attributes.Request.Http
+	record := &decisionlog.Record{
+		Time:      start.UTC(),
+		RequestID: httpReq.Headers["x-request-id"],
+		TraceID:   tracing.TraceID(ctx),
+		Host:      httpReq.Host,
+		Path:      httpReq.Path,
+		Method:    httpReq.Method,
+		Subject:   authCtx.LoggableSubject(),
+		Rule:      authCtx.Rule.Name,
+		Decision:  decisionOf(authCtx, resp),
+		Reason:    string(authCtx.Reason),
+		Status:    http.StatusOK,
+		AuditOnly: auditOnly,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if authCtx.ClientIP.IsValid() {
+		record.SourceIP = authCtx.ClientIP.String()
+	}
+	if denied := resp.GetDeniedResponse(); denied != nil {
+		record.Status = int(denied.GetStatus().GetCode())
+	}
+	for _, o := range authCtx.Outcomes() {
+		record.Validators = append(record.Validators, decisionlog.Validator{
+			Name:   o.Validator,
+			Valid:  o.Valid,
+			Reason: string(o.Reason),
+		})
+	}
+	s.opts.DecisionLog.Log(record)
+}
+
+// decisionOf returns the final decision of the check response
+func decisionOf(authCtx *validator.AuthContext, resp *authv3.CheckResponse) string {
+	if resp.GetDeniedResponse() == nil {
+		return decisionAllow
+	}
+	// cors preflights are answered by exa without a deny reason
+	if authCtx.Reason == validator.ReasonNone {
+		return decisionPreflight
+	}
+	return decisionDeny
+}
@@ -0,0 +1,46 @@
+package authz
+
+import (
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/Dimss/exa/pkg/validator"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"go.uber.org/zap"
+)
+
+// routeResponseHeaders renders the response headers of the matched rule,
+// a header failing to render is skipped, it must not fail the request
+func routeResponseHeaders(authCtx *validator.AuthContext, identityHeaders []*corev3.HeaderValueOption) (headers []*corev3.HeaderValueOption) {
+	if len(authCtx.Rule.ResponseHeaders) == 0 {
+		return nil
+	}
+	httpReq := authCtx.Request().Attributes.Request.Http
+	data := routes.HeaderData{
+		Identity:  map[string]string{},
+		Host:      httpReq.Host,
+		Method:    httpReq.Method,
+		Path:      httpReq.Path,
+		Scheme:    httpReq.Scheme,
+		RequestID: httpReq.Headers["x-request-id"],
+	}
+	for _, h := range identityHeaders {
+		data.Identity[h.Header.Key] = h.Header.Value
+	}
+
+	for _, h := range authCtx.Rule.ResponseHeaders {
+		value, err := h.Render(data)
+		if err != nil {
+			authCtx.Log.Error("failed to render response header",
+				zap.String("rule", authCtx.Rule.Name), zap.String("header", h.Name), zap.Error(err))
+			continue
+		}
+		action := corev3.HeaderValueOption_ADD_IF_ABSENT
+		if h.Overwrite {
+			action = corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD
+		}
+		headers = append(headers, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: h.Name, Value: value},
+			AppendAction: action,
+		})
+	}
+	return headers
+}
@@ -0,0 +1,75 @@
+package authz
+
+import (
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/Dimss/exa/pkg/validator"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"reflect"
+	"testing"
+)
+
+func TestRouteResponseHeaders(t *testing.T) {
+	type header struct {
+		key    string
+		value  string
+		action corev3.HeaderValueOption_HeaderAppendAction
+	}
+	tests := []struct {
+		name     string
+		headers  []*routes.ResponseHeader
+		identity []*corev3.HeaderValueOption
+		want     []header
+	}{
+		{name: "no headers"},
+		{
+			name:    "upstream header is kept by default",
+			headers: []*routes.ResponseHeader{{Name: "x-frame-options", Value: "DENY"}},
+			want:    []header{{"X-Frame-Options", "DENY", corev3.HeaderValueOption_ADD_IF_ABSENT}},
+		},
+		{
+			name:    "overwrite",
+			headers: []*routes.ResponseHeader{{Name: "content-security-policy", Value: "default-src 'self' {{ .Host }}", Overwrite: true}},
+			want:    []header{{"Content-Security-Policy", "default-src 'self' kubeflow.example.com", corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD}},
+		},
+		{
+			name:     "identity",
+			headers:  []*routes.ResponseHeader{{Name: "x-user", Value: `{{ index .Identity "kubeflow-userid" }}`}},
+			identity: []*corev3.HeaderValueOption{headerValue("kubeflow-userid", "jane@example.com")},
+			want:     []header{{"X-User", "jane@example.com", corev3.HeaderValueOption_ADD_IF_ABSENT}},
+		},
+		{
+			name: "header with a line break is skipped",
+			headers: []*routes.ResponseHeader{
+				{Name: "x-user", Value: `{{ index .Identity "kubeflow-userid" }}`},
+				{Name: "x-frame-options", Value: "DENY"},
+			},
+			identity: []*corev3.HeaderValueOption{headerValue("kubeflow-userid", "jane\r\nSet-Cookie: a=b")},
+			want:     []header{{"X-Frame-Options", "DENY", corev3.HeaderValueOption_ADD_IF_ABSENT}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := routes.CompileRules([]*routes.Rule{{Name: "headers", ResponseHeaders: tt.headers}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := &options.Options{Routes: routes.NewRulesTable(rules)}
+			request := &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{Http: &authv3.AttributeContext_HttpRequest{
+					Host: "kubeflow.example.com", Method: "GET", Path: "/", Headers: map[string]string{},
+				}},
+			}}
+			authCtx := validator.NewAuthContext(request, opts)
+
+			var got []header
+			for _, h := range routeResponseHeaders(authCtx, tt.identity) {
+				got = append(got, header{h.Header.Key, h.Header.Value, h.AppendAction})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("routeResponseHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package authz
+
+import (
+	"github.com/Dimss/exa/pkg/options"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthv1 "google.golang.org/grpc/health/grpc_health_v1"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+
+	readinessInterval = time.Second
+)
+
+// healthServices are the services reported over grpc.health.v1, the empty name is the server
+var healthServices = []string{
+	"",
+	authv3.Authorization_ServiceDesc.ServiceName,
+	rlsv3.RateLimitService_ServiceDesc.ServiceName,
+}
+
+// Health reports the serving status over grpc.health.v1 and http, the services are
+// NOT_SERVING until the options are ready (see options.Options.Ready) and while draining
+type Health struct {
+	store    *options.Store
+	server   *health.Server
+	serving  atomic.Bool
+	draining atomic.Bool
+	done     chan struct{}
+}
+
+func NewHealth(grpcServer *grpc.Server, store *options.Store) *Health {
+	h := &Health{
+		store:  store,
+		server: health.NewServer(),
+		done:   make(chan struct{}),
+	}
+	h.setServing(false)
+	healthv1.RegisterHealthServer(grpcServer, h.server)
+	go h.watch()
+	return h
+}
+
+// watch follows the readiness of the active options, a reload may add issuers
+// which aren't discovered yet, the other key sources are ready once loaded
+func (h *Health) watch() {
+	ticker := time.NewTicker(readinessInterval)
+	defer ticker.Stop()
+	h.update()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			h.update()
+		}
+	}
+}
+
+func (h *Health) update() {
+	ready := h.store.Load().Ready()
+	if ready == h.serving.Load() {
+		return
+	}
+	if ready {
+		zap.S().Info("key sources are ready, serving")
+	} else {
+		zap.S().Warn("no key source is ready, not serving")
+	}
+	h.setServing(ready)
+}
+
+func (h *Health) setServing(serving bool) {
+	status := healthv1.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthv1.HealthCheckResponse_SERVING
+	}
+	for _, service := range healthServices {
+		h.server.SetServingStatus(service, status)
+	}
+	h.serving.Store(serving)
+}
+
+// Drain reports NOT_SERVING until the process exits, the clients move to the other
+// instances while the in-flight checks complete
+func (h *Health) Drain() {
+	if h.draining.Swap(true) {
+		return
+	}
+	close(h.done)
+	h.serving.Store(false)
+	h.server.Shutdown()
+}
+
+// Serving reports whether the checks are served
+func (h *Health) Serving() bool {
+	return h.serving.Load() && !h.draining.Load()
+}
+
+// HealthzHandler reports the liveness, it fails only while draining
+func (h *Health) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// ReadyzHandler mirrors the grpc health status
+func (h *Health) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.Serving() {
+		http.Error(w, healthv1.HealthCheckResponse_NOT_SERVING.String(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte(healthv1.HealthCheckResponse_SERVING.String() + "\n"))
+}
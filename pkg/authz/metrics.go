@@ -1,8 +1,14 @@
 package authz
 
 import (
+	"github.com/Dimss/exa/pkg/cache"
+	"github.com/Dimss/exa/pkg/decisionlog"
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/validator"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	grpcprom "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
 )
 
 const (
@@ -12,7 +18,7 @@ const (
 
 func init() {
 	// Register standard server metrics and customized metrics to registry.
-	Reg.MustRegister(GrpcMetrics, AuthenticationChecksMetric)
+	Reg.MustRegister(GrpcMetrics, AuthenticationChecksMetric, ValidatorDurationMetric, TokenRejectionsMetric, RateLimitedMetric, RateLimitDecisionsMetric, DecisionShadowMetric, DecisionLogDroppedMetric)
 }
 
 var (
@@ -22,10 +28,216 @@ var (
 	// GrpcMetrics create some standard server metrics.
 	GrpcMetrics = grpcprom.NewServerMetrics()
 
+	// AuthenticationChecksMetric path is the matching metrics path template, the validator
+	// is the one which decided, it is empty when the request was decided before the validation
 	AuthenticationChecksMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: metricsNamespace,
 		Subsystem: metricsSubsystems,
 		Name:      "envoy_service_auth_v3_authorization_check_method_handle_count",
 		Help:      "Total number of authorization checks performed",
-	}, []string{"host", "path", "result"})
+	}, []string{"host", "path", "result", "reason", "validator"})
+
+	ValidatorDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystems,
+		Name:      "validator_duration_seconds",
+		Help:      "Duration of a single validator of the validation chain",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"validator", "valid"})
+
+	TokenRejectionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystems,
+		Name:      "token_rejections_total",
+		Help:      "Total number of denied authentication checks by deny reason",
+	}, []string{"reason"})
+
+	RateLimitedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystems,
+		Name:      "rate_limited_total",
+		Help:      "Total number of requests denied by a rate limit",
+	}, []string{"limit", "rule"})
+
+	RateLimitDecisionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystems,
+		Name:      "rls_decisions_total",
+		Help:      "Total number of envoy rate limit service decisions by domain and code",
+	}, []string{"domain", "code"})
+
+	DecisionShadowMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystems,
+		Name:      "decision_shadow_total",
+		Help:      "Total number of decisions not enforced, by audit only mode or shadow token policy",
+	}, []string{"mode", "active", "shadow", "reason"})
+
+	DecisionLogDroppedMetric = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystems,
+		Name:      "decision_log_dropped_total",
+		Help:      "Total number of decision records the sinks dropped",
+	}, func() float64 { return float64(decisionlog.DroppedRecords.Load()) })
 )
+
+// registerDecisionCacheMetrics exports the stats of the active decision cache, zero when it is disabled
+func registerDecisionCacheMetrics(store *options.Store) {
+	stats := func() cache.Stats {
+		if c := store.Load().DecisionCache; c != nil {
+			return c.Stats()
+		}
+		return cache.Stats{}
+	}
+	Reg.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystems,
+			Name:      "decision_cache_hits_total",
+			Help:      "Total number of tokens verified from the decision cache",
+		}, func() float64 { return float64(stats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystems,
+			Name:      "decision_cache_misses_total",
+			Help:      "Total number of decision cache misses",
+		}, func() float64 { return float64(stats().Misses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystems,
+			Name:      "decision_cache_evictions_total",
+			Help:      "Total number of entries evicted from the full decision cache",
+		}, func() float64 { return float64(stats().Evictions) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystems,
+			Name:      "decision_cache_entries",
+			Help:      "Number of entries in the decision cache",
+		}, func() float64 { return float64(stats().Size) }),
+	)
+}
+
+// registerRateLimitMetrics exports the rate limits and their tracked buckets
+func (s *Service) registerRateLimitMetrics() {
+	limits := []struct {
+		name string
+		rate func() float64
+		len  func() int
+	}{
+		{identityLimit, func() float64 { return s.store.Load().IdentityRateLimit.Rate }, s.identityBuckets.Len},
+		{failedAuthLimit, func() float64 { return s.store.Load().FailedAuthRateLimit.Rate }, s.failedAuthBuckets.Len},
+	}
+	for _, l := range limits {
+		l := l
+		Reg.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Subsystem:   metricsSubsystems,
+				Name:        "rate_limit_per_second",
+				Help:        "Configured default rate limit, 0 when disabled",
+				ConstLabels: prometheus.Labels{"limit": l.name},
+			}, l.rate),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Subsystem:   metricsSubsystems,
+				Name:        "rate_limit_buckets",
+				Help:        "Number of tracked rate limit buckets",
+				ConstLabels: prometheus.Labels{"limit": l.name},
+			}, func() float64 { return float64(l.len()) }),
+		)
+	}
+}
+
+// recordCheck records the check and the validators latency, the labels are bounded:
+// the path and the client controlled host are normalized with the metrics path templates and hosts
+func (s *Service) recordCheck(authCtx *validator.AuthContext, resp *authv3.CheckResponse) {
+	if resp == nil {
+		return
+	}
+	httpReq := authCtx.Request().Attributes.Request.Http
+	decision := decisionOf(authCtx, resp)
+
+	var decidedBy string
+	for _, o := range authCtx.Outcomes() {
+		ValidatorDurationMetric.WithLabelValues(o.Validator, strconv.FormatBool(o.Valid)).Observe(o.Duration.Seconds())
+		if (decision == decisionAllow && o.Valid) || (decision == decisionDeny && o.Reason == authCtx.Reason) {
+			decidedBy = o.Validator
+		}
+	}
+	AuthenticationChecksMetric.WithLabelValues(
+		s.opts.MetricsHosts.Normalize(httpReq.Host),
+		s.opts.MetricsPathTemplates.Normalize(httpReq.Path),
+		decision,
+		string(authCtx.Reason),
+		decidedBy,
+	).Inc()
+}
+
+// jwksCollector exports the key count of every key source and issuer,
+// and the fetch results of the ones fetched from a jwks server
+type jwksCollector struct {
+	store     *options.Store
+	refreshes *prometheus.Desc
+	keys      *prometheus.Desc
+}
+
+func newJwksCollector(store *options.Store) *jwksCollector {
+	return &jwksCollector{
+		store: store,
+		refreshes: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystems, "jwks_refreshes_total"),
+			"Total number of jwks fetches by result",
+			[]string{"source", "result"}, nil),
+		keys: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystems, "jwks_keys"),
+			"Number of keys of the key source",
+			[]string{"source"}, nil),
+	}
+}
+
+func (c *jwksCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.refreshes
+	ch <- c.keys
+}
+
+func (c *jwksCollector) Collect(ch chan<- prometheus.Metric) {
+	collect := func(name string, kids []string, stats *options.JwksStats) {
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(len(kids)), name)
+		if stats == nil {
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(c.refreshes, prometheus.CounterValue, float64(stats.Refreshes()), name, "success")
+		ch <- prometheus.MustNewConstMetric(c.refreshes, prometheus.CounterValue, float64(stats.Failures()), name, "failure")
+	}
+	opts := c.store.Load()
+	for _, src := range opts.KeySources {
+		var stats *options.JwksStats
+		if s, ok := src.(options.RefreshStats); ok {
+			stats = s.Stats()
+		}
+		collect(src.Name(), src.KIDs(), stats)
+	}
+	for _, iss := range opts.Issuers {
+		collect(iss.URL, iss.KIDs(), iss.Stats())
+	}
+}
+
+// registerConfigReloadMetrics exports the results of the config reloads
+func registerConfigReloadMetrics(store *options.Store) {
+	Reg.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   metricsSubsystems,
+			Name:        "config_reloads_total",
+			Help:        "Total number of config reloads by result",
+			ConstLabels: prometheus.Labels{"result": "success"},
+		}, func() float64 { return float64(store.Status().Reloads) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Subsystem:   metricsSubsystems,
+			Name:        "config_reloads_total",
+			Help:        "Total number of config reloads by result",
+			ConstLabels: prometheus.Labels{"result": "failure"},
+		}, func() float64 { return float64(store.Status().Failures) }),
+	)
+}
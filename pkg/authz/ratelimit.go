@@ -0,0 +1,84 @@
+package authz
+
+import (
+	"github.com/Dimss/exa/pkg/validator"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gogo/googleapis/google/rpc"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	identityLimit   = "identity"
+	failedAuthLimit = "failed_auth"
+)
+
+// identityLimited takes a token from the identity bucket of the route,
+// anonymous requests share the bucket of their client address
+func (s *Service) identityLimited(authCtx *validator.AuthContext) (bool, time.Duration) {
+	limit := s.opts.IdentityRateLimit
+	if authCtx.Rule.RateLimit != nil {
+		limit = *authCtx.Rule.RateLimit
+	}
+	key := "sub:" + authCtx.Subject
+	if authCtx.Subject == "" {
+		key = "ip:" + authCtx.ClientIP.String()
+	}
+	ok, retryAfter := s.identityBuckets.Take(authCtx.Rule.Name+"|"+key, limit)
+	return !ok, retryAfter
+}
+
+// failedAuthBlocked reports whether the client address ran out of failed authentications
+func (s *Service) failedAuthBlocked(authCtx *validator.AuthContext) (bool, time.Duration) {
+	ok, retryAfter := s.failedAuthBuckets.Peek(authCtx.ClientIP.String(), s.opts.FailedAuthRateLimit)
+	return !ok, retryAfter
+}
+
+// recordFailedAuth counts the failed authentication of the client address,
+// requests without a token are regular first visits and don't count
+func (s *Service) recordFailedAuth(authCtx *validator.AuthContext) {
+	switch authCtx.Reason {
+	case validator.ReasonNoToken, validator.ReasonNetworkDenied, validator.ReasonCSRFViolation,
+		validator.ReasonRateLimited, validator.ReasonTooManyFailedAttempts:
+		return
+	}
+	s.failedAuthBuckets.Take(authCtx.ClientIP.String(), s.opts.FailedAuthRateLimit)
+}
+
+func (s *Service) denyRequestRateLimited(authCtx *validator.AuthContext, limit string, retryAfter time.Duration) (*authv3.CheckResponse, error) {
+	authCtx.Log.Info("rate limit exceeded, request denied",
+		zap.String("reason", string(authCtx.Reason)),
+		zap.String("rule", authCtx.Rule.Name),
+		zap.String("client", authCtx.ClientIP.String()),
+		zap.Duration("retryAfter", retryAfter))
+	TokenRejectionsMetric.WithLabelValues(string(authCtx.Reason)).Inc()
+	RateLimitedMetric.WithLabelValues(limit, authCtx.Rule.Name).Inc()
+
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(rpc.RESOURCE_EXHAUSTED)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status: &typev3.HttpStatus{Code: typev3.StatusCode_TooManyRequests},
+				Headers: []*corev3.HeaderValueOption{
+					{
+						Header: &corev3.HeaderValue{
+							Key:   "Retry-After",
+							Value: strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))),
+						},
+					},
+					{
+						Header: &corev3.HeaderValue{
+							Key:   "Cache-Control",
+							Value: "private, max-age=0, no-store",
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
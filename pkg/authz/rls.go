@@ -0,0 +1,99 @@
+package authz
+
+import (
+	"context"
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/ratelimit"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"strings"
+	"time"
+)
+
+var rlsUnits = map[string]rlsv3.RateLimitResponse_RateLimit_Unit{
+	"second": rlsv3.RateLimitResponse_RateLimit_SECOND,
+	"minute": rlsv3.RateLimitResponse_RateLimit_MINUTE,
+	"hour":   rlsv3.RateLimitResponse_RateLimit_HOUR,
+	"day":    rlsv3.RateLimitResponse_RateLimit_DAY,
+}
+
+// RateLimitService implements the envoy rate limit service with in-memory counters,
+// the descriptors can use the identity exa sets in the ext_authz dynamic metadata
+type RateLimitService struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	store    *options.Store
+	counters *ratelimit.Counters
+}
+
+func (s *RateLimitService) ShouldRateLimit(c context.Context, request *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	// the descriptors may have been dropped by a config reload, nothing is limited then
+	var config ratelimit.Config
+	if descriptors := s.store.Load().RateLimitDescriptors; descriptors != nil {
+		config = descriptors.Config()
+	}
+	hits := request.HitsAddend
+	if hits == 0 {
+		hits = 1
+	}
+
+	resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	for _, descriptor := range request.Descriptors {
+		var entries []ratelimit.Entry
+		var key strings.Builder
+		key.WriteString(request.Domain)
+		for _, e := range descriptor.Entries {
+			entries = append(entries, ratelimit.Entry{Key: e.Key, Value: e.Value})
+			key.WriteString("|" + e.Key + "=" + e.Value)
+		}
+
+		quota := config.Lookup(request.Domain, entries)
+		// the route limit override of the descriptor wins over the config
+		if override := descriptor.GetLimit(); override != nil {
+			if unit := strings.ToLower(override.Unit.String()); rlsUnits[unit] != 0 {
+				quota = &ratelimit.Quota{Unit: unit, RequestsPerUnit: override.RequestsPerUnit}
+			}
+		}
+		if quota == nil {
+			resp.Statuses = append(resp.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{
+				Code: rlsv3.RateLimitResponse_OK,
+			})
+			continue
+		}
+
+		count, reset := s.counters.Hit(key.String(), quota, hits)
+		status := &rlsv3.RateLimitResponse_DescriptorStatus{
+			Code: rlsv3.RateLimitResponse_OK,
+			CurrentLimit: &rlsv3.RateLimitResponse_RateLimit{
+				RequestsPerUnit: quota.RequestsPerUnit,
+				Unit:            rlsUnits[quota.Unit],
+			},
+			DurationUntilReset: durationpb.New(time.Until(reset)),
+		}
+		if count > quota.RequestsPerUnit {
+			status.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			zap.S().Infof("rate limit exceeded, domain: %s, descriptor: %s", request.Domain, key.String())
+		} else {
+			status.LimitRemaining = quota.RequestsPerUnit - count
+		}
+		resp.Statuses = append(resp.Statuses, status)
+	}
+	RateLimitDecisionsMetric.WithLabelValues(request.Domain, resp.OverallCode.String()).Inc()
+	return resp, nil
+}
+
+// NewRateLimitService registers the rate limit service when descriptors are configured on startup
+func NewRateLimitService(grpcServer *grpc.Server, store *options.Store) {
+	if store.Load().RateLimitDescriptors == nil {
+		return
+	}
+	counters := ratelimit.NewCounters()
+	store.OnClose(counters.Close)
+	rlsv3.RegisterRateLimitServiceServer(grpcServer, &RateLimitService{
+		store:    store,
+		counters: counters,
+	})
+	zap.S().Info("envoy rate limit service enabled")
+}
@@ -3,46 +3,164 @@ package authz
 import (
 	"context"
 	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/ratelimit"
 	"github.com/Dimss/exa/pkg/validator"
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/gogo/googleapis/google/rpc"
-	"github.com/spf13/viper"
+	"go.uber.org/zap"
 	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+	"strings"
+	"time"
+)
+
+const (
+	csrfViolationBody = "<html><body><h1>403 Forbidden</h1><p>Cross-site request rejected.</p></body></html>"
+	networkDeniedBody = "<html><body><h1>403 Forbidden</h1><p>Access from your network is not allowed.</p></body></html>"
 )
 
 type Service struct {
 	authv3.UnimplementedAuthorizationServer
-	opts *options.Options
+	store *options.Store
+	// opts is the options snapshot of the check, set by withSnapshot
+	opts              *options.Options
+	identityBuckets   *ratelimit.Buckets
+	failedAuthBuckets *ratelimit.Buckets
+}
+
+// withSnapshot returns the service bound to the active options, a config reload during
+// the check doesn't change the options it uses, the caller must call opts.Done
+func (s *Service) withSnapshot() *Service {
+	svc := *s
+	svc.opts = s.store.Acquire()
+	return &svc
 }
 
 func (s *Service) Check(c context.Context, request *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	s = s.withSnapshot()
+	defer s.opts.Done()
 	// init authentication context
+	start := time.Now()
 	authCtx := validator.NewAuthContext(request, s.opts)
+	ctx, span := startCheckSpan(c, authCtx)
+	defer span.End()
+	resp, err := s.check(ctx, authCtx)
+	s.reportShadowPolicy(authCtx)
+	auditOnly := err == nil && resp.GetDeniedResponse() != nil && authCtx.Reason != validator.ReasonNone && s.auditOnly(authCtx.Rule)
+	if auditOnly {
+		resp, err = s.auditOnlyAllow(authCtx)
+	}
+	s.recordCheck(authCtx, resp)
+	s.logDecision(ctx, authCtx, resp, auditOnly, start)
+	endCheckSpan(span, authCtx, resp, auditOnly)
+	return resp, err
+}
+
+// check executes the checks stages, the response is the decision of the active policy
+func (s *Service) check(ctx context.Context, authCtx *validator.AuthContext) (*authv3.CheckResponse, error) {
+	request := authCtx.Request()
+	// blocked networks are denied whatever the credentials
+	if !authCtx.NetworkAllowed() {
+		return s.denyRequest(authCtx)
+	}
+	// slow down token guessing before spending any work on it
+	if blocked, retryAfter := s.failedAuthBlocked(authCtx); blocked {
+		authCtx.Reason = validator.ReasonTooManyFailedAttempts
+		return s.denyRequestRateLimited(authCtx, failedAuthLimit, retryAfter)
+	}
+	httpReq := request.Attributes.Request.Http
+	// answer cors preflights before the validation, they never carry credentials
+	if cors := authCtx.Rule.CORS; cors != nil && isPreflight(httpReq.Method, httpReq.Headers) {
+		return s.answerPreflight(authCtx, cors, httpReq.Headers)
+	}
 	// execute validation chain
-	if valid, validatedIdentity := authCtx.Valid(context.Background()); valid {
-		return s.allowRequest(validatedIdentity)
-	} else {
-		authCtx.Log.Info("authentication context is not valid, request denied")
-		return s.denyRequestWithRedirect(viper.GetString("redirect-url"))
+	if valid, validatedIdentity := authCtx.Valid(ctx); valid {
+		if limited, retryAfter := s.identityLimited(authCtx); limited {
+			authCtx.Reason = validator.ReasonRateLimited
+			return s.denyRequestRateLimited(authCtx, identityLimit, retryAfter)
+		}
+		return s.allowRequest(authCtx, validatedIdentity)
+	}
+	s.recordFailedAuth(authCtx)
+	return s.denyRequest(authCtx)
+}
+
+func (s *Service) denyRequest(authCtx *validator.AuthContext) (*authv3.CheckResponse, error) {
+	authCtx.Log.Info("authentication context is not valid, request denied",
+		zap.String("reason", string(authCtx.Reason)))
+	TokenRejectionsMetric.WithLabelValues(string(authCtx.Reason)).Inc()
+	// the login page can't help these requests
+	switch authCtx.Reason {
+	case validator.ReasonCSRFViolation:
+		return s.denyRequestWithHtml(csrfViolationBody)
+	case validator.ReasonNetworkDenied:
+		return s.denyRequestWithHtml(networkDeniedBody)
 	}
+	return s.denyRequestWithRedirect(s.opts.RedirectUrl)
 }
 
-func (s *Service) allowRequest(identityHeaders []*corev3.HeaderValueOption) (*authv3.CheckResponse, error) {
+func (s *Service) allowRequest(authCtx *validator.AuthContext, identityHeaders []*corev3.HeaderValueOption) (*authv3.CheckResponse, error) {
 	resp := &authv3.CheckResponse{
 		Status: &status.Status{Code: int32(rpc.OK)},
 		HttpResponse: &authv3.CheckResponse_OkResponse{
 			OkResponse: &authv3.OkHttpResponse{
-				Headers: identityHeaders,
+				Headers:              identityHeaders,
+				HeadersToRemove:      s.unsetIdentityHeaders(identityHeaders),
+				ResponseHeadersToAdd: s.responseHeaders(authCtx, identityHeaders),
 			},
 		},
-		DynamicMetadata: nil,
+		DynamicMetadata: dynamicMetadata(authCtx),
 	}
 	return resp, nil
 }
 
+// dynamicMetadata exposes the identity to the next envoy filters under the
+// envoy.filters.http.ext_authz namespace, e.g. to the rate limit descriptors
+func dynamicMetadata(authCtx *validator.AuthContext) *structpb.Struct {
+	metadata, err := structpb.NewStruct(map[string]interface{}{
+		"sub":       authCtx.LoggableSubject(),
+		"rule":      authCtx.Rule.Name,
+		"client_ip": authCtx.ClientIP.String(),
+	})
+	if err != nil {
+		authCtx.Log.Error("failed to build the dynamic metadata", zap.Error(err))
+		return nil
+	}
+	return metadata
+}
+
+// responseHeaders returns the headers envoy adds to the upstream response of an allowed request
+func (s *Service) responseHeaders(authCtx *validator.AuthContext, identityHeaders []*corev3.HeaderValueOption) []*corev3.HeaderValueOption {
+	httpReq := authCtx.Request().Attributes.Request.Http
+	headers := corsResponseHeaders(authCtx.Rule.CORS, httpReq.Headers)
+	headers = append(headers, routeResponseHeaders(authCtx, identityHeaders)...)
+	if csrfCookie := validator.CSRFCookie(authCtx.Rule.CSRF, httpReq); csrfCookie != nil {
+		headers = append(headers, csrfCookie)
+	}
+	return headers
+}
+
+// unsetIdentityHeaders returns the identity headers exa doesn't set, a client
+// could otherwise send them on public or anonymous requests
+func (s *Service) unsetIdentityHeaders(identityHeaders []*corev3.HeaderValueOption) (headers []string) {
+	for _, header := range s.opts.IdentityHeaders() {
+		set := false
+		for _, h := range identityHeaders {
+			if strings.EqualFold(h.Header.Key, header) {
+				set = true
+				break
+			}
+		}
+		if !set {
+			headers = append(headers, header)
+		}
+	}
+	return
+}
+
 func (s *Service) denyRequestWithRedirect(redirectUrl string) (*authv3.CheckResponse, error) {
 	return &authv3.CheckResponse{
 		Status: &status.Status{Code: int32(rpc.UNAUTHENTICATED)},
@@ -95,10 +213,18 @@ func (s *Service) denyRequestWithHtml(httpBody string) (*authv3.CheckResponse, e
 	}, nil
 }
 
-func NewAuthzService(grpcServer *grpc.Server, opts *options.Options) {
+func NewAuthzService(grpcServer *grpc.Server, store *options.Store) {
 	svc := &Service{
 		UnimplementedAuthorizationServer: authv3.UnimplementedAuthorizationServer{},
-		opts:                             opts,
+		store:                            store,
+		identityBuckets:                  ratelimit.NewBuckets(),
+		failedAuthBuckets:                ratelimit.NewBuckets(),
 	}
+	store.OnClose(svc.identityBuckets.Close)
+	store.OnClose(svc.failedAuthBuckets.Close)
 	authv3.RegisterAuthorizationServer(grpcServer, svc)
+	registerDecisionCacheMetrics(store)
+	svc.registerRateLimitMetrics()
+	registerConfigReloadMetrics(store)
+	Reg.MustRegister(newJwksCollector(store))
 }
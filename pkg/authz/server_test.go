@@ -0,0 +1,31 @@
+package authz
+
+import (
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/Dimss/exa/pkg/validator"
+	"testing"
+)
+
+func TestDynamicMetadataSubject(t *testing.T) {
+	tests := []struct {
+		name      string
+		encrypted bool
+		want      string
+	}{
+		{name: "signed token", want: "jane"},
+		{name: "encrypted token", encrypted: true, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authCtx := &validator.AuthContext{
+				Rule:             &routes.Rule{Name: "default"},
+				Subject:          "jane",
+				SubjectEncrypted: tt.encrypted,
+			}
+			metadata := dynamicMetadata(authCtx)
+			if got := metadata.Fields["sub"].GetStringValue(); got != tt.want {
+				t.Errorf("sub = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
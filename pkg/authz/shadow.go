@@ -0,0 +1,56 @@
+package authz
+
+import (
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/Dimss/exa/pkg/validator"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	auditOnlyMode    = "audit_only"
+	shadowPolicyMode = "shadow_policy"
+	decisionAllow    = "allow"
+	decisionDeny     = "deny"
+	// decisionPreflight is a cors preflight answered by exa
+	decisionPreflight = "preflight"
+)
+
+func (s *Service) auditOnly(rule *routes.Rule) bool {
+	if rule.AuditOnly != nil {
+		return *rule.AuditOnly
+	}
+	return s.opts.AuditOnly
+}
+
+// auditOnlyAllow allows a denied request anonymously, the identity headers are still removed
+func (s *Service) auditOnlyAllow(authCtx *validator.AuthContext) (*authv3.CheckResponse, error) {
+	authCtx.Log.Info("audit only, request would have been denied",
+		zap.String("rule", authCtx.Rule.Name),
+		zap.String("reason", string(authCtx.Reason)))
+	DecisionShadowMetric.WithLabelValues(auditOnlyMode, decisionAllow, decisionDeny, string(authCtx.Reason)).Inc()
+	return s.allowRequest(authCtx, nil)
+}
+
+// reportShadowPolicy compares the decisions of the active and the shadow token policies,
+// the denials of the other checks (e.g. revocations) are the same for both policies
+func (s *Service) reportShadowPolicy(authCtx *validator.AuthContext) {
+	if !authCtx.ShadowEvaluated {
+		return
+	}
+	active, shadow := decisionAllow, decisionAllow
+	if authCtx.Reason.IsPolicy() {
+		active = decisionDeny
+	}
+	if authCtx.ShadowReason != validator.ReasonNone {
+		shadow = decisionDeny
+	}
+	DecisionShadowMetric.WithLabelValues(shadowPolicyMode, active, shadow, string(authCtx.ShadowReason)).Inc()
+	if active != shadow {
+		authCtx.Log.Info("shadow token policy disagrees with the active policy",
+			zap.String("active", active),
+			zap.String("shadow", shadow),
+			zap.String("reason", string(authCtx.Reason)),
+			zap.String("shadowReason", string(authCtx.ShadowReason)))
+	}
+}
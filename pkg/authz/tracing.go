@@ -0,0 +1,52 @@
+package authz
+
+import (
+	"context"
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/Dimss/exa/pkg/tracing"
+	"github.com/Dimss/exa/pkg/validator"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// startCheckSpan continues the trace of the request envoy is checking, the
+// W3C traceparent or B3 headers are forwarded by envoy in the check request
+func startCheckSpan(c context.Context, authCtx *validator.AuthContext) (context.Context, trace.Span) {
+	httpReq := authCtx.Request().Attributes.Request.Http
+	ctx, span := tracing.Tracer().Start(tracing.Extract(c, httpReq.Headers), "authz.Check",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.ServerAddress(httpReq.Host),
+			semconv.HTTPRequestMethodKey.String(httpReq.Method),
+			semconv.URLPath(routes.StripQuery(httpReq.Path)),
+			attribute.String("exa.rule", authCtx.Rule.Name),
+		))
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		authCtx.Log = authCtx.Log.With(zap.String("traceId", traceID))
+	}
+	return ctx, span
+}
+
+// endCheckSpan records the decision on the check span, denials aren't span errors
+func endCheckSpan(span trace.Span, authCtx *validator.AuthContext, resp *authv3.CheckResponse, auditOnly bool) {
+	if resp == nil {
+		return
+	}
+	status := http.StatusOK
+	if denied := resp.GetDeniedResponse(); denied != nil {
+		status = int(denied.GetStatus().GetCode())
+	}
+	span.SetAttributes(
+		attribute.String("exa.decision", decisionOf(authCtx, resp)),
+		attribute.String("exa.reason", string(authCtx.Reason)),
+		attribute.Bool("exa.audit_only", auditOnly),
+		semconv.HTTPResponseStatusCode(status),
+	)
+	if subject := authCtx.LoggableSubject(); subject != "" {
+		span.SetAttributes(attribute.String("enduser.id", subject))
+	}
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LRU is a size bounded least recently used cache, every entry has its own expiry
+type LRU[V any] struct {
+	mu        sync.Mutex
+	size      int
+	ll        *list.List
+	items     map[string]*list.Element
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+	// generation is bumped by every purge, an entry computed before a purge is stale
+	generation uint64
+}
+
+type entry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+type Stats struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+func NewLRU[V any](size int) *LRU[V] {
+	return &LRU[V]{
+		size:  size,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (c *LRU[V]) Get(key string) (value V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return value, false
+	}
+	e := elem.Value.(*entry[V])
+	if time.Now().After(e.expiresAt) {
+		c.removeElement(elem)
+		c.misses.Add(1)
+		return value, false
+	}
+	c.ll.MoveToFront(elem)
+	c.hits.Add(1)
+	return e.value, true
+}
+
+// Add stores the value until expiresAt, evicting the least recently used entry when full
+func (c *LRU[V]) Add(key string, value V, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(key, value, expiresAt)
+}
+
+// Generation returns the current generation, it changes on every purge
+func (c *LRU[V]) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// AddIfGeneration stores the value like Add unless the cache was purged since generation
+// was read, the value may be computed from state the purge invalidated
+func (c *LRU[V]) AddIfGeneration(key string, value V, expiresAt time.Time, generation uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return false
+	}
+	c.addLocked(key, value, expiresAt)
+	return true
+}
+
+func (c *LRU[V]) addLocked(key string, value V, expiresAt time.Time) {
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		e := elem.Value.(*entry[V])
+		e.value = value
+		e.expiresAt = expiresAt
+		return
+	}
+	c.items[key] = c.ll.PushFront(&entry[V]{key: key, value: value, expiresAt: expiresAt})
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Purge drops all the entries
+func (c *LRU[V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+	c.generation++
+}
+
+func (c *LRU[V]) Stats() Stats {
+	c.mu.Lock()
+	size := c.ll.Len()
+	c.mu.Unlock()
+	return Stats{
+		Size:      size,
+		Capacity:  c.size,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+func (c *LRU[V]) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*entry[V]).key)
+}
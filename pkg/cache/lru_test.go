@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	type add struct {
+		key string
+		ttl time.Duration
+	}
+	tests := []struct {
+		name          string
+		size          int
+		adds          []add
+		get           string
+		want          bool
+		wantEvictions uint64
+	}{
+		{name: "hit", size: 2, adds: []add{{"a", time.Minute}}, get: "a", want: true},
+		{name: "miss", size: 2, adds: []add{{"a", time.Minute}}, get: "b", want: false},
+		{name: "expired entry", size: 2, adds: []add{{"a", -time.Second}}, get: "a", want: false},
+		{name: "update refreshes the expiry", size: 2, adds: []add{{"a", -time.Second}, {"a", time.Minute}}, get: "a", want: true},
+		{name: "least recently used is evicted", size: 2, adds: []add{{"a", time.Minute}, {"b", time.Minute}, {"c", time.Minute}}, get: "a", want: false, wantEvictions: 1},
+		{name: "recently updated is kept", size: 2, adds: []add{{"a", time.Minute}, {"b", time.Minute}, {"a", time.Minute}, {"c", time.Minute}}, get: "a", want: true, wantEvictions: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewLRU[string](tt.size)
+			for _, a := range tt.adds {
+				c.Add(a.key, a.key, time.Now().Add(a.ttl))
+			}
+			value, ok := c.Get(tt.get)
+			if ok != tt.want {
+				t.Fatalf("Get(%q) ok = %t, want %t", tt.get, ok, tt.want)
+			}
+			if ok && value != tt.get {
+				t.Errorf("Get(%q) = %q", tt.get, value)
+			}
+			if got := c.Stats().Evictions; got != tt.wantEvictions {
+				t.Errorf("evictions = %d, want %d", got, tt.wantEvictions)
+			}
+		})
+	}
+}
+
+func TestLRUExpiredEntryIsRemoved(t *testing.T) {
+	c := NewLRU[string](2)
+	c.Add("a", "a", time.Now().Add(-time.Second))
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expired entry is returned")
+	}
+	stats := c.Stats()
+	if stats.Size != 0 || stats.Misses != 1 {
+		t.Errorf("stats = %+v, want an empty cache with one miss", stats)
+	}
+}
+
+func TestLRUAddIfGeneration(t *testing.T) {
+	tests := []struct {
+		name  string
+		purge bool
+		want  bool
+	}{
+		{name: "same generation", purge: false, want: true},
+		{name: "purged since", purge: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewLRU[string](2)
+			generation := c.Generation()
+			if tt.purge {
+				c.Purge()
+			}
+			if got := c.AddIfGeneration("a", "a", time.Now().Add(time.Minute), generation); got != tt.want {
+				t.Errorf("AddIfGeneration() = %t, want %t", got, tt.want)
+			}
+			if _, ok := c.Get("a"); ok != tt.want {
+				t.Errorf("cached = %t, want %t", ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const replaysGCInterval = time.Minute
+
+var (
+	ErrReplayed    = errors.New("already seen")
+	ErrReplaysFull = errors.New("too many unexpired entries")
+)
+
+// Replays records one-time identifiers, e.g. the jti of DPoP proofs, until their expiry.
+// A full set rejects the new identifiers, evicting one would allow its replay
+type Replays struct {
+	mu        sync.Mutex
+	size      int
+	seen      map[string]time.Time
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewReplays(size int) *Replays {
+	r := &Replays{size: size, seen: map[string]time.Time{}, done: make(chan struct{})}
+	go r.gcLoop()
+	return r
+}
+
+// Add records key until expiresAt, it fails when the key was already seen or the set is full
+func (r *Replays) Add(key string, expiresAt time.Time) error {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if exp, ok := r.seen[key]; ok && now.Before(exp) {
+		return ErrReplayed
+	}
+	if len(r.seen) >= r.size {
+		r.gcLocked(now)
+	}
+	if len(r.seen) >= r.size {
+		return ErrReplaysFull
+	}
+	r.seen[key] = expiresAt
+	return nil
+}
+
+func (r *Replays) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.seen)
+}
+
+// Close stops the gc
+func (r *Replays) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
+
+func (r *Replays) gcLoop() {
+	ticker := time.NewTicker(replaysGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			r.gcLocked(now)
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *Replays) gcLocked(now time.Time) {
+	for key, exp := range r.seen {
+		if now.After(exp) {
+			delete(r.seen, key)
+		}
+	}
+}
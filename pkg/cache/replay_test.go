@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplaysAdd(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		seen map[string]time.Time
+		key  string
+		want error
+	}{
+		{name: "new key", seen: map[string]time.Time{}, key: "a"},
+		{name: "replayed key", seen: map[string]time.Time{"a": now.Add(time.Minute)}, key: "a", want: ErrReplayed},
+		{name: "expired key", seen: map[string]time.Time{"a": now.Add(-time.Minute)}, key: "a"},
+		{name: "full of expired keys", seen: map[string]time.Time{"b": now.Add(-time.Minute), "c": now.Add(-time.Minute)}, key: "a"},
+		{name: "full", seen: map[string]time.Time{"b": now.Add(time.Minute), "c": now.Add(time.Minute)}, key: "a", want: ErrReplaysFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReplays(2)
+			defer r.Close()
+			r.seen = tt.seen
+			if err := r.Add(tt.key, now.Add(time.Minute)); !errors.Is(err, tt.want) {
+				t.Errorf("Add(%q) = %v, want %v", tt.key, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package decisionlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StdoutSink  = "stdout"
+	FileSink    = "file"
+	WebhookSink = "webhook"
+
+	minRedactKeyLength = 32
+)
+
+// DroppedRecords counts the records lost by the sinks, on a full queue or a write error
+var DroppedRecords atomic.Uint64
+
+type Config struct {
+	Sinks                []string
+	RedactFields         []string
+	RedactKey            []byte
+	File                 string
+	FileMaxSize          int64
+	FileMaxBackups       int
+	WebhookURL           string
+	WebhookClient        *http.Client
+	WebhookBatchSize     int
+	WebhookFlushInterval time.Duration
+}
+
+// Logger writes the decision records to every configured sink
+type Logger struct {
+	cfg          Config
+	sinks        []Sink
+	redactFields []string
+}
+
+func NewLogger(cfg Config) (*Logger, error) {
+	for _, field := range cfg.RedactFields {
+		if _, ok := redactableFields[field]; !ok {
+			return nil, fmt.Errorf("unknown redact field %s", field)
+		}
+	}
+	if len(cfg.RedactFields) > 0 && len(cfg.RedactKey) < minRedactKeyLength {
+		return nil, fmt.Errorf("redacting fields requires a redact key of at least %d bytes", minRedactKeyLength)
+	}
+	l := &Logger{cfg: cfg, redactFields: cfg.RedactFields}
+	// the sinks opened before an invalid one are closed
+	fail := func(err error) (*Logger, error) {
+		l.Close()
+		return nil, err
+	}
+	for _, sink := range cfg.Sinks {
+		switch sink {
+		case StdoutSink:
+			l.sinks = append(l.sinks, newQueuedSink(stdoutWriter{}))
+		case FileSink:
+			if cfg.File == "" {
+				return fail(fmt.Errorf("the file sink requires a file path"))
+			}
+			w, err := newFileWriter(cfg.File, cfg.FileMaxSize, cfg.FileMaxBackups)
+			if err != nil {
+				return fail(err)
+			}
+			l.sinks = append(l.sinks, newQueuedSink(w))
+		case WebhookSink:
+			if cfg.WebhookURL == "" {
+				return fail(fmt.Errorf("the webhook sink requires a url"))
+			}
+			if cfg.WebhookBatchSize <= 0 {
+				return fail(fmt.Errorf("the webhook batch size must be positive, got %d", cfg.WebhookBatchSize))
+			}
+			if cfg.WebhookFlushInterval <= 0 {
+				return fail(fmt.Errorf("the webhook flush interval must be positive, got %s", cfg.WebhookFlushInterval))
+			}
+			l.sinks = append(l.sinks, newWebhookSink(cfg.WebhookURL, cfg.WebhookClient, cfg.WebhookBatchSize, cfg.WebhookFlushInterval))
+		default:
+			return fail(fmt.Errorf("unknown decision log sink %s", sink))
+		}
+	}
+	return l, nil
+}
+
+// Config returns the config the logger was created with
+func (l *Logger) Config() Config {
+	return l.cfg
+}
+
+func (l *Logger) Log(r *Record) {
+	r.redact(l.redactFields, l.cfg.RedactKey)
+	line, err := json.Marshal(r)
+	if err != nil {
+		zap.S().Errorf("failed to marshal decision record: %s", err)
+		return
+	}
+	line = append(line, '\n')
+	for _, sink := range l.sinks {
+		if err := sink.Write(line); err != nil {
+			zap.S().Errorf("failed to write decision record: %s", err)
+		}
+	}
+}
+
+func (l *Logger) Close() {
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil {
+			zap.S().Errorf("failed to close decision log sink: %s", err)
+		}
+	}
+}
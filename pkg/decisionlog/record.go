@@ -0,0 +1,57 @@
+package decisionlog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Record is a single authorization decision, written as one NDJSON line
+type Record struct {
+	Time       time.Time   `json:"time"`
+	RequestID  string      `json:"requestId,omitempty"`
+	TraceID    string      `json:"traceId,omitempty"`
+	Host       string      `json:"host"`
+	Path       string      `json:"path"`
+	Method     string      `json:"method"`
+	SourceIP   string      `json:"sourceIp,omitempty"`
+	Subject    string      `json:"subject,omitempty"`
+	Rule       string      `json:"rule"`
+	Validators []Validator `json:"validators,omitempty"`
+	Decision   string      `json:"decision"`
+	Reason     string      `json:"reason,omitempty"`
+	Status     int         `json:"status"`
+	AuditOnly  bool        `json:"auditOnly,omitempty"`
+	LatencyMs  float64     `json:"latencyMs"`
+}
+
+// Validator is the outcome of a single validator of the chain
+type Validator struct {
+	Name   string `json:"name"`
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// redactableFields are the fields which can identify a user
+var redactableFields = map[string]func(r *Record) *string{
+	"requestId": func(r *Record) *string { return &r.RequestID },
+	"host":      func(r *Record) *string { return &r.Host },
+	"path":      func(r *Record) *string { return &r.Path },
+	"sourceIp":  func(r *Record) *string { return &r.SourceIP },
+	"subject":   func(r *Record) *string { return &r.Subject },
+}
+
+// redact replaces the fields with their HMAC-SHA256 under the redact key, redacted records
+// can still be correlated, the small value spaces (ips, emails) can't be brute forced without the key
+func (r *Record) redact(fields []string, key []byte) {
+	for _, field := range fields {
+		value := redactableFields[field](r)
+		if *value == "" {
+			continue
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(*value))
+		*value = "hmac:" + hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+}
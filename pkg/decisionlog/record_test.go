@@ -0,0 +1,63 @@
+package decisionlog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	key := []byte(strings.Repeat("k", minRedactKeyLength))
+	otherKey := []byte(strings.Repeat("o", minRedactKeyLength))
+
+	r := &Record{SourceIP: "10.0.0.1", Subject: "jane@example.com", Path: "/notebook"}
+	r.redact([]string{"sourceIp", "subject"}, key)
+	if !strings.HasPrefix(r.SourceIP, "hmac:") || strings.Contains(r.SourceIP, "10.0.0.1") {
+		t.Errorf("sourceIp = %q, want an hmac", r.SourceIP)
+	}
+	if r.Path != "/notebook" {
+		t.Errorf("path = %q, want it untouched", r.Path)
+	}
+
+	same := &Record{SourceIP: "10.0.0.1"}
+	same.redact([]string{"sourceIp"}, key)
+	if same.SourceIP != r.SourceIP {
+		t.Errorf("same value redacted to %q and %q, records can't be correlated", same.SourceIP, r.SourceIP)
+	}
+	other := &Record{SourceIP: "10.0.0.1"}
+	other.redact([]string{"sourceIp"}, otherKey)
+	if other.SourceIP == r.SourceIP {
+		t.Error("redaction doesn't depend on the key")
+	}
+
+	empty := &Record{}
+	empty.redact([]string{"subject"}, key)
+	if empty.Subject != "" {
+		t.Errorf("empty subject redacted to %q", empty.Subject)
+	}
+}
+
+func TestNewLoggerRedactKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "no redaction", cfg: Config{}},
+		{name: "redaction without key", cfg: Config{RedactFields: []string{"subject"}}, wantErr: true},
+		{name: "short key", cfg: Config{RedactFields: []string{"subject"}, RedactKey: []byte("short")}, wantErr: true},
+		{name: "key", cfg: Config{RedactFields: []string{"subject"}, RedactKey: []byte(strings.Repeat("k", 32))}},
+		{name: "unknown field", cfg: Config{RedactFields: []string{"claims"}, RedactKey: []byte(strings.Repeat("k", 32))}, wantErr: true},
+		{name: "unknown sink", cfg: Config{Sinks: []string{"kafka"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLogger(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLogger() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if l != nil {
+				l.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package decisionlog
+
+import (
+	"bytes"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sink writes NDJSON lines, Write must not block the check on slow sinks
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// queueSize is the number of records the stdout and file sinks buffer
+const queueSize = 1024
+
+// queue hands the lines to the writer goroutine of a sink, a full
+// queue drops the records rather than slowing down the checks
+type queue struct {
+	lines  chan []byte
+	done   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newQueue(size int) *queue {
+	return &queue{lines: make(chan []byte, size), done: make(chan struct{})}
+}
+
+func (q *queue) push(line []byte) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return fmt.Errorf("decision log sink is closed")
+	}
+	select {
+	case q.lines <- line:
+	default:
+		DroppedRecords.Add(1)
+	}
+	return nil
+}
+
+// close stops accepting lines and waits until the writer goroutine drained the queue
+func (q *queue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.lines)
+	q.mu.Unlock()
+	<-q.done
+}
+
+// lineWriter is a synchronous destination of a queued sink
+type lineWriter interface {
+	write(line []byte) error
+	close() error
+}
+
+// queuedSink writes the lines to a lineWriter from its own goroutine
+type queuedSink struct {
+	*queue
+	w lineWriter
+}
+
+func newQueuedSink(w lineWriter) *queuedSink {
+	s := &queuedSink{queue: newQueue(queueSize), w: w}
+	go s.run()
+	return s
+}
+
+func (s *queuedSink) Write(line []byte) error {
+	return s.push(line)
+}
+
+func (s *queuedSink) run() {
+	defer close(s.done)
+	for line := range s.lines {
+		if err := s.w.write(line); err != nil {
+			DroppedRecords.Add(1)
+			zap.S().Errorf("failed to write decision record: %s", err)
+		}
+	}
+}
+
+// Close flushes the pending records
+func (s *queuedSink) Close() error {
+	s.close()
+	return s.w.close()
+}
+
+type stdoutWriter struct{}
+
+func (stdoutWriter) write(line []byte) error {
+	_, err := os.Stdout.Write(line)
+	return err
+}
+
+func (stdoutWriter) close() error {
+	return nil
+}
+
+// fileWriter rotates the file when it exceeds maxSize, the rotated
+// files are <path>.1 (newest) to <path>.<maxBackups> (oldest)
+type fileWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newFileWriter(path string, maxSize int64, maxBackups int) (*fileWriter, error) {
+	w := &fileWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *fileWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+func (w *fileWriter) write(line []byte) error {
+	if w.maxSize > 0 && w.size+int64(len(line)) > w.maxSize && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *fileWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if w.maxBackups > 0 {
+		for i := w.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *fileWriter) close() error {
+	return w.file.Close()
+}
+
+// webhookSink posts the lines in batches
+type webhookSink struct {
+	*queue
+	url           string
+	client        *http.Client
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// newWebhookSink starts the sink, the batch size and the flush interval must be positive
+func newWebhookSink(url string, client *http.Client, batchSize int, flushInterval time.Duration) *webhookSink {
+	s := &webhookSink{
+		queue:         newQueue(batchSize * 10),
+		url:           url,
+		client:        client,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) Write(line []byte) error {
+	return s.push(line)
+}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	var batch bytes.Buffer
+	lines := 0
+	flush := func() {
+		if lines == 0 {
+			return
+		}
+		if err := s.post(batch.Bytes()); err != nil {
+			DroppedRecords.Add(uint64(lines))
+			zap.S().Errorf("failed to post %d decision log records: %s", lines, err)
+		}
+		batch.Reset()
+		lines = 0
+	}
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				flush()
+				return
+			}
+			batch.Write(line)
+			if lines++; lines >= s.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (s *webhookSink) post(body []byte) error {
+	resp, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Close flushes the pending records
+func (s *webhookSink) Close() error {
+	s.close()
+	return nil
+}
@@ -0,0 +1,117 @@
+package decisionlog
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	w, err := newFileWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newQueuedSink(w)
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if err := s.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		path:        "third\n",
+		path + ".1": "second\n",
+		path + ".2": "first\n",
+	} {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+	if err := s.Write([]byte("late\n")); err == nil {
+		t.Error("Write() on a closed sink succeeded")
+	}
+}
+
+// blockingWriter blocks until release is closed, like a stalled disk
+type blockingWriter struct {
+	release chan struct{}
+	lines   []string
+}
+
+func (w *blockingWriter) write(line []byte) error {
+	<-w.release
+	w.lines = append(w.lines, string(line))
+	return nil
+}
+
+func (w *blockingWriter) close() error {
+	return nil
+}
+
+func TestQueuedSinkDoesNotBlock(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	s := newQueuedSink(w)
+	dropped := DroppedRecords.Load()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < queueSize+10; i++ {
+			s.Write([]byte("line\n"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write() blocked on a stalled writer")
+	}
+	if got := DroppedRecords.Load() - dropped; got < 9 {
+		t.Errorf("dropped = %d, want at least 9", got)
+	}
+	close(w.release)
+	s.Close()
+	if len(w.lines) == 0 || strings.TrimSpace(w.lines[0]) != "line" {
+		t.Errorf("queued lines not flushed on close: %d lines", len(w.lines))
+	}
+}
+
+func TestNewLoggerWebhook(t *testing.T) {
+	tests := []struct {
+		name          string
+		batchSize     int
+		flushInterval time.Duration
+		wantErr       bool
+	}{
+		{name: "valid", batchSize: 100, flushInterval: time.Second},
+		{name: "zero flush interval", batchSize: 100, flushInterval: 0, wantErr: true},
+		{name: "negative flush interval", batchSize: 100, flushInterval: -time.Second, wantErr: true},
+		{name: "zero batch size", batchSize: 0, flushInterval: time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLogger(Config{
+				Sinks:                []string{WebhookSink},
+				WebhookURL:           "http://127.0.0.1:1/decisions",
+				WebhookClient:        http.DefaultClient,
+				WebhookBatchSize:     tt.batchSize,
+				WebhookFlushInterval: tt.flushInterval,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLogger() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if l != nil {
+				l.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package fswatch
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// debounce groups the burst of events produced by a single
+// update, e.g. kubelet swapping the ..data symlink of a mounted secret
+const debounce = time.Millisecond * 500
+
+// Watch calls onChange whenever one of the paths changes.
+// Files are watched through their parent directory, so atomic
+// renames and kubernetes secret/configmap updates are detected too.
+// The returned function stops the watch.
+func Watch(paths []string, onChange func()) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := map[string]struct{}{}
+	for _, p := range paths {
+		dir := p
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			dir = filepath.Dir(p)
+		}
+		dirs[dir] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	go func() {
+		var timer *time.Timer
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(debounce, onChange)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				zap.S().Error(err)
+			}
+		}
+	}()
+
+	return func() { watcher.Close() }, nil
+}
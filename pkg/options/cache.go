@@ -0,0 +1,35 @@
+package options
+
+import (
+	"github.com/Dimss/exa/pkg/cache"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// CachedToken is a verified token kept in the decision cache
+type CachedToken struct {
+	Claims jwt.MapClaims
+	Header map[string]interface{}
+	Issuer *Issuer
+}
+
+// initDecisionCache creates the cache, the cache of the previous options is kept when its
+// size didn't change, it is purged once the reload is applied by the options store
+func (opts *Options) initDecisionCache(v *viper.Viper, prev *Options) {
+	size := v.GetInt("decision-cache-size")
+	if size <= 0 {
+		zap.S().Info("decision cache is disabled")
+		return
+	}
+	opts.DecisionCacheTTL = v.GetDuration("decision-cache-ttl")
+	if prev != nil && prev.DecisionCache != nil && prev.DecisionCache.Stats().Capacity == size {
+		opts.DecisionCache = prev.DecisionCache
+		opts.unsubscribeDecisionCache = prev.unsubscribeDecisionCache
+		return
+	}
+	opts.DecisionCache = cache.NewLRU[*CachedToken](size)
+	// a revoked token must not be served from the cache, the listener is
+	// unregistered once the options release the cache
+	opts.unsubscribeDecisionCache = opts.Revocations.OnChange(opts.DecisionCache.Purge)
+}
@@ -0,0 +1,51 @@
+package options
+
+import (
+	"github.com/Dimss/exa/pkg/revocation"
+	"github.com/spf13/viper"
+	"testing"
+	"time"
+)
+
+func TestDecisionCacheRevocationListener(t *testing.T) {
+	tests := []struct {
+		name     string
+		prevSize int
+		nextSize int
+		// wantPrevPurged reports whether a revocation after the reload still purges the previous cache
+		wantPrevPurged bool
+	}{
+		{name: "same size keeps the cache", prevSize: 10, nextSize: 10, wantPrevPurged: true},
+		{name: "resize unregisters the previous cache", prevSize: 10, nextSize: 20, wantPrevPurged: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocations, err := revocation.NewStore("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer revocations.Close()
+
+			v := viper.New()
+			v.Set("decision-cache-size", tt.prevSize)
+			prev := &Options{Revocations: revocations}
+			prev.initDecisionCache(v, nil)
+			v.Set("decision-cache-size", tt.nextSize)
+			next := &Options{Revocations: revocations}
+			next.initDecisionCache(v, prev)
+			prev.Release(next)
+
+			prev.DecisionCache.Add("token", &CachedToken{}, time.Now().Add(time.Minute))
+			next.DecisionCache.Add("token", &CachedToken{}, time.Now().Add(time.Minute))
+			if err := revocations.RevokeJTI("jti", time.Now().Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := next.DecisionCache.Get("token"); ok {
+				t.Error("active cache is not purged on revocation")
+			}
+			if _, ok := prev.DecisionCache.Get("token"); ok == tt.wantPrevPurged {
+				t.Errorf("previous cache purged = %t, want %t", !ok, tt.wantPrevPurged)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package options
+
+import (
+	"github.com/Dimss/exa/pkg/cache"
+	"github.com/spf13/viper"
+	"time"
+)
+
+// maxDPoPReplays bounds the memory of the seen proofs, the proofs are rejected once it is full
+const maxDPoPReplays = 100000
+
+// DPoP configures the validation of sender-constrained tokens (RFC 9449)
+type DPoP struct {
+	// Required rejects bearer tokens which aren't bound to a DPoP key or a client certificate
+	Required      bool
+	Algorithms    []string
+	ProofLifetime time.Duration
+	Leeway        time.Duration
+	// Replays holds the jti of the seen proofs, it is per authz instance,
+	// so replays across replicas are bounded only by the proof lifetime
+	Replays *cache.Replays
+}
+
+func newDPoPFromFlags(v *viper.Viper) DPoP {
+	return DPoP{
+		Required:      v.GetBool("dpop-required"),
+		Algorithms:    v.GetStringSlice("dpop-algorithms"),
+		ProofLifetime: v.GetDuration("dpop-proof-lifetime"),
+		Leeway:        v.GetDuration("token-leeway"),
+	}
+}
+
+// initDPoPReplays creates the replay cache, the cache of the previous options is kept,
+// a proof seen before the reload must stay rejected
+func (opts *Options) initDPoPReplays(prev *Options) {
+	if prev != nil {
+		opts.DPoP.Replays = prev.DPoP.Replays
+		return
+	}
+	opts.DPoP.Replays = cache.NewReplays(maxDPoPReplays)
+}
@@ -0,0 +1,318 @@
+package options
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Dimss/exa/pkg/tlsutil"
+	"github.com/Dimss/exa/pkg/tracing"
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wellKnownOpenIDConfiguration = "/.well-known/openid-configuration"
+	defaultIssuerRefreshInterval = time.Hour
+	discoveryRetryInterval       = time.Second * 10
+)
+
+// Issuer is an OIDC token issuer, the signing keys are discovered
+// from the issuer's openid-configuration and bound to its iss claim
+type Issuer struct {
+	URL             string               `mapstructure:"url"`
+	Audiences       []string             `mapstructure:"audiences"`
+	ClaimMappings   map[string]string    `mapstructure:"claim-mappings"`
+	RefreshInterval time.Duration        `mapstructure:"refresh-interval"`
+	TLS             tlsutil.ClientConfig `mapstructure:"tls"`
+	TokenPolicy     `mapstructure:",squash"`
+
+	mu         sync.RWMutex
+	jwks       *keyfunc.JWKS
+	jwksURI    string
+	algorithms []string
+	stats      JwksStats
+	done       chan struct{}
+	closed     bool
+}
+
+type openIDConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	JwksURI                          string   `json:"jwks_uri"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// Keyfunc resolves the token signing key from the issuer's discovered JWKS
+func (iss *Issuer) Keyfunc(token *jwt.Token) (interface{}, error) {
+	iss.mu.RLock()
+	jwks := iss.jwks
+	iss.mu.RUnlock()
+	if jwks == nil {
+		return nil, fmt.Errorf("issuer %s is not ready, discovery pending", iss.URL)
+	}
+	return jwks.Keyfunc(token)
+}
+
+// Ready reports whether the issuer keys has been discovered
+func (iss *Issuer) Ready() bool {
+	iss.mu.RLock()
+	defer iss.mu.RUnlock()
+	return iss.jwks != nil
+}
+
+// KIDs returns the kids of the issuer JWKS, empty until the discovery succeeds
+func (iss *Issuer) KIDs() []string {
+	iss.mu.RLock()
+	defer iss.mu.RUnlock()
+	if iss.jwks == nil {
+		return nil
+	}
+	return iss.jwks.KIDs()
+}
+
+func (iss *Issuer) Stats() *JwksStats {
+	return &iss.stats
+}
+
+// JwksURI returns the jwks_uri discovered for the issuer
+func (iss *Issuer) JwksURI() string {
+	iss.mu.RLock()
+	defer iss.mu.RUnlock()
+	return iss.jwksURI
+}
+
+func (iss *Issuer) setDefaults(opts *Options) {
+	iss.URL = strings.TrimSuffix(iss.URL, "/")
+	if iss.RefreshInterval == 0 {
+		iss.RefreshInterval = defaultIssuerRefreshInterval
+	}
+	if len(iss.ClaimMappings) == 0 {
+		iss.ClaimMappings = map[string]string{opts.UserIdHeader: "email"}
+	}
+	iss.TLS = iss.TLS.WithDefaults(opts.TLS)
+	iss.TokenPolicy = iss.TokenPolicy.WithDefaults(opts.TokenPolicy)
+}
+
+// sameConfig reports whether both issuers are configured alike, the
+// discovered keys of an issuer are kept when a reload doesn't change it
+func (iss *Issuer) sameConfig(other *Issuer) bool {
+	return iss.URL == other.URL &&
+		reflect.DeepEqual(iss.Audiences, other.Audiences) &&
+		reflect.DeepEqual(iss.ClaimMappings, other.ClaimMappings) &&
+		iss.RefreshInterval == other.RefreshInterval &&
+		reflect.DeepEqual(iss.TLS, other.TLS) &&
+		reflect.DeepEqual(iss.TokenPolicy, other.TokenPolicy)
+}
+
+// Close stops the discovery and the background refreshes of the issuer JWKS
+func (iss *Issuer) Close() {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	if iss.closed {
+		return
+	}
+	iss.closed = true
+	close(iss.done)
+	if iss.jwks != nil {
+		iss.jwks.EndBackground()
+	}
+}
+
+// discoverLoop retries the discovery until it succeeds or the issuer is closed,
+// the IdP is not necessarily up when exa starts
+func (iss *Issuer) discoverLoop() {
+	for {
+		err := iss.discover()
+		if err == nil {
+			return
+		}
+		zap.S().Errorf("oidc discovery for %s failed, retrying in %s: %s", iss.URL, discoveryRetryInterval, err)
+		select {
+		case <-iss.done:
+			return
+		case <-time.After(discoveryRetryInterval):
+		}
+	}
+}
+
+func (iss *Issuer) discover() error {
+	client, err := iss.TLS.HTTPClient()
+	if err != nil {
+		return err
+	}
+	tracing.WrapClient("jwks.fetch", client)
+
+	cfg, err := iss.fetchOpenIDConfiguration(client)
+	if err != nil {
+		return err
+	}
+
+	algorithms, err := iss.validateAlgorithms(cfg.IDTokenSigningAlgValuesSupported)
+	if err != nil {
+		return err
+	}
+
+	jwks, err := keyfunc.Get(cfg.JwksURI, iss.stats.instrument(keyfunc.Options{
+		Ctx: context.Background(),
+		RefreshErrorHandler: func(err error) {
+			zap.S().Errorf("failed to refresh jwks for issuer %s: %s", iss.URL, err)
+		},
+		RefreshInterval:   iss.RefreshInterval,
+		RefreshRateLimit:  time.Minute * 5,
+		RefreshTimeout:    time.Second * 10,
+		RefreshUnknownKID: true,
+		Client:            client,
+	}))
+	if err != nil {
+		iss.stats.failed(err)
+		return err
+	}
+
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	// the issuer was dropped by a reload during the discovery
+	if iss.closed {
+		jwks.EndBackground()
+		return nil
+	}
+	iss.jwks = jwks
+	iss.jwksURI = cfg.JwksURI
+	iss.algorithms = algorithms
+	zap.S().Infof("issuer %s discovered, jwks: %s, algorithms: %v", iss.URL, cfg.JwksURI, algorithms)
+	return nil
+}
+
+func (iss *Issuer) fetchOpenIDConfiguration(client *http.Client) (*openIDConfiguration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, iss.URL+wellKnownOpenIDConfiguration, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected openid-configuration status code: %d", resp.StatusCode)
+	}
+
+	cfg := &openIDConfiguration{}
+	if err := json.NewDecoder(resp.Body).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode openid-configuration: %w", err)
+	}
+	// OpenID Connect Discovery 1.0, section 4.3
+	if strings.TrimSuffix(cfg.Issuer, "/") != iss.URL {
+		return nil, fmt.Errorf("openid-configuration issuer %s doesn't match %s", cfg.Issuer, iss.URL)
+	}
+	if cfg.JwksURI == "" {
+		return nil, fmt.Errorf("openid-configuration doesn't contain jwks_uri")
+	}
+	return cfg, nil
+}
+
+// validateAlgorithms restricts the allowed algorithms to the ones supported by the issuer,
+// when none are configured all the supported algorithms except "none" are allowed
+func (iss *Issuer) validateAlgorithms(supported []string) ([]string, error) {
+	if len(supported) == 0 {
+		// id_token_signing_alg_values_supported is required, but RS256 is the spec default
+		supported = []string{"RS256"}
+	}
+	allowed := iss.Algorithms
+	if len(allowed) == 0 {
+		allowed = supported
+	}
+	var algorithms []string
+	for _, alg := range allowed {
+		if alg == "none" {
+			continue
+		}
+		if !contains(supported, alg) {
+			zap.S().Warnf("signing algorithm %s is not supported by issuer %s, supported: %v", alg, iss.URL, supported)
+			continue
+		}
+		algorithms = append(algorithms, alg)
+	}
+	if len(algorithms) == 0 {
+		return nil, fmt.Errorf("none of the allowed signing algorithms %v is supported by the issuer, supported: %v", allowed, supported)
+	}
+	return algorithms, nil
+}
+
+// Policy returns the token policy of the issuer,
+// with the algorithms validated against the discovered ones
+func (iss *Issuer) Policy() TokenPolicy {
+	iss.mu.RLock()
+	defer iss.mu.RUnlock()
+	policy := iss.TokenPolicy
+	policy.Algorithms = iss.algorithms
+	return policy
+}
+
+// initIssuers starts the discovery of the issuers, the issuers of the
+// previous options are kept when unchanged, with their discovered keys
+func (opts *Options) initIssuers(v *viper.Viper, prev *Options) error {
+	var issuers []*Issuer
+	for _, u := range v.GetStringSlice("oidc-issuers") {
+		issuers = append(issuers, &Issuer{URL: u})
+	}
+	var configured []*Issuer
+	if err := v.UnmarshalKey("issuers", &configured); err != nil {
+		return fmt.Errorf("failed to parse issuers: %w", err)
+	}
+	issuers = append(issuers, configured...)
+
+	for _, iss := range issuers {
+		iss.setDefaults(opts)
+		if prevIss := prev.sameIssuer(iss); prevIss != nil {
+			opts.Issuers = append(opts.Issuers, prevIss)
+			continue
+		}
+		zap.S().Infof("adding oidc issuer: %s", iss.URL)
+		iss.done = make(chan struct{})
+		opts.Issuers = append(opts.Issuers, iss)
+		go iss.discoverLoop()
+	}
+	return nil
+}
+
+// sameIssuer returns the issuer configured alike, nil if there is none
+func (opts *Options) sameIssuer(iss *Issuer) *Issuer {
+	if opts == nil {
+		return nil
+	}
+	for _, i := range opts.Issuers {
+		if i.sameConfig(iss) {
+			return i
+		}
+	}
+	return nil
+}
+
+// IssuerFor returns the configured issuer for the iss claim, nil if there is none
+func (opts *Options) IssuerFor(iss string) *Issuer {
+	iss = strings.TrimSuffix(iss, "/")
+	for _, i := range opts.Issuers {
+		if i.URL == iss {
+			return i
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
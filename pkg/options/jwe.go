@@ -0,0 +1,153 @@
+package options
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Dimss/exa/pkg/fswatch"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// allowedKeyAlgorithms excludes RSA1_5, it is prone to padding oracle attacks
+var allowedKeyAlgorithms = map[jose.KeyAlgorithm]struct{}{
+	jose.RSA_OAEP:       {},
+	jose.RSA_OAEP_256:   {},
+	jose.ECDH_ES:        {},
+	jose.ECDH_ES_A128KW: {},
+	jose.ECDH_ES_A192KW: {},
+	jose.ECDH_ES_A256KW: {},
+}
+
+type decryptionKey struct {
+	kid string
+	key interface{}
+}
+
+// DecryptionKeys are the private keys of encrypted (JWE) tokens, several keys
+// can be active at once, so the IdP encryption key can be rotated without downtime
+type DecryptionKeys struct {
+	files     []string
+	mu        sync.RWMutex
+	keys      []decryptionKey
+	stopWatch func()
+}
+
+func newDecryptionKeys(files []string) (*DecryptionKeys, error) {
+	dk := &DecryptionKeys{files: files}
+	if err := dk.load(); err != nil {
+		return nil, err
+	}
+	var err error
+	if dk.stopWatch, err = fswatch.Watch(files, dk.reload); err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
+
+// Close stops the reloads of the key files
+func (dk *DecryptionKeys) Close() {
+	dk.stopWatch()
+}
+
+// Decrypt decrypts a compact JWE and returns the nested token, the key is
+// selected by the kid header, without kid every active key is tried
+func (dk *DecryptionKeys) Decrypt(token string) (string, error) {
+	jwe, err := jose.ParseEncrypted(token)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := allowedKeyAlgorithms[jose.KeyAlgorithm(jwe.Header.Algorithm)]; !ok {
+		return "", fmt.Errorf("key management algorithm %s is not allowed", jwe.Header.Algorithm)
+	}
+
+	dk.mu.RLock()
+	keys := dk.keys
+	dk.mu.RUnlock()
+
+	for _, k := range keys {
+		if jwe.Header.KeyID != "" && jwe.Header.KeyID != k.kid {
+			continue
+		}
+		if plaintext, err := jwe.Decrypt(k.key); err == nil {
+			return string(plaintext), nil
+		}
+	}
+	// never wrap the decryption errors, they must not leak anything about the plaintext
+	return "", errors.New("no decryption key could decrypt the token")
+}
+
+func (dk *DecryptionKeys) KIDs() (kids []string) {
+	dk.mu.RLock()
+	defer dk.mu.RUnlock()
+	for _, k := range dk.keys {
+		kids = append(kids, k.kid)
+	}
+	return
+}
+
+func (dk *DecryptionKeys) reload() {
+	if err := dk.load(); err != nil {
+		zap.S().Errorf("failed to reload jwe decryption keys, keeping previous keys: %s", err)
+		return
+	}
+	zap.S().Infof("reloaded jwe decryption keys, kids: %v", dk.KIDs())
+}
+
+// load reads the PEM private keys, the kid of each key is the file name without its extension
+func (dk *DecryptionKeys) load() error {
+	var keys []decryptionKey
+	for _, file := range dk.files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		key, err := parsePemPrivateKey(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		name := filepath.Base(file)
+		keys = append(keys, decryptionKey{kid: strings.TrimSuffix(name, filepath.Ext(name)), key: key})
+	}
+	dk.mu.Lock()
+	defer dk.mu.Unlock()
+	dk.keys = keys
+	return nil
+}
+
+func parsePemPrivateKey(raw []byte) (interface{}, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported pem block type %s", block.Type)
+	}
+}
+
+func (opts *Options) initDecryptionKeys(v *viper.Viper) error {
+	files := v.GetStringSlice("jwe-key-files")
+	if len(files) == 0 {
+		return nil
+	}
+	dk, err := newDecryptionKeys(files)
+	if err != nil {
+		return fmt.Errorf("failed to load jwe decryption keys: %w", err)
+	}
+	zap.S().Infof("jwe decryption enabled, kids: %v", dk.KIDs())
+	opts.DecryptionKeys = dk
+	return nil
+}
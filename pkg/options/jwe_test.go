@@ -0,0 +1,86 @@
+package options
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"gopkg.in/square/go-jose.v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeRSAKey(t *testing.T, path string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encryptJWE(t *testing.T, key *rsa.PrivateKey, alg jose.KeyAlgorithm, kid, plaintext string) string {
+	t.Helper()
+	recipient := jose.Recipient{Algorithm: alg, Key: &key.PublicKey, KeyID: kid}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, recipient, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwe, err := encrypter.Encrypt([]byte(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwe.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestDecryptionKeysDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	current := writeRSAKey(t, filepath.Join(dir, "current.pem"))
+	previous := writeRSAKey(t, filepath.Join(dir, "previous.pem"))
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk, err := newDecryptionKeys([]string{filepath.Join(dir, "current.pem"), filepath.Join(dir, "previous.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dk.Close()
+
+	tests := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		alg     jose.KeyAlgorithm
+		kid     string
+		wantErr bool
+	}{
+		{name: "current key by kid", key: current, alg: jose.RSA_OAEP_256, kid: "current"},
+		{name: "previous key by kid", key: previous, alg: jose.RSA_OAEP, kid: "previous"},
+		{name: "without kid every key is tried", key: previous, alg: jose.RSA_OAEP_256},
+		{name: "kid of another key", key: previous, alg: jose.RSA_OAEP_256, kid: "current", wantErr: true},
+		{name: "unknown kid", key: current, alg: jose.RSA_OAEP_256, kid: "retired", wantErr: true},
+		{name: "unknown key", key: other, alg: jose.RSA_OAEP_256, wantErr: true},
+		{name: "rsa1_5 is not allowed", key: current, alg: jose.RSA1_5, kid: "current", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := encryptJWE(t, tt.key, tt.alg, tt.kid, "nested.jwt.token")
+			got, err := dk.Decrypt(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decrypt() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != "nested.jwt.token" {
+				t.Errorf("Decrypt() = %q, want the nested token", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package options
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/MicahParks/keyfunc"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JwksStats counts the fetches of a remote JWKS, the initial fetch included
+type JwksStats struct {
+	refreshes atomic.Uint64
+	failures  atomic.Uint64
+
+	mu          sync.Mutex
+	lastRefresh time.Time
+	lastError   error
+}
+
+func (s *JwksStats) Refreshes() uint64 {
+	return s.refreshes.Load()
+}
+
+func (s *JwksStats) Failures() uint64 {
+	return s.failures.Load()
+}
+
+// LastRefresh returns the time and the error of the last fetch, the error is nil on success
+func (s *JwksStats) LastRefresh() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRefresh, s.lastError
+}
+
+func (s *JwksStats) succeeded() {
+	s.refreshes.Add(1)
+	s.setLastRefresh(nil)
+}
+
+func (s *JwksStats) failed(err error) {
+	s.failures.Add(1)
+	s.setLastRefresh(err)
+}
+
+func (s *JwksStats) setLastRefresh(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRefresh = time.Now()
+	s.lastError = err
+}
+
+// instrument counts the fetches of the keyfunc options, a fetch is successful once
+// the jwks server responded 200, the failures are the errors of the refresh error handler
+func (s *JwksStats) instrument(options keyfunc.Options) keyfunc.Options {
+	errorHandler := options.RefreshErrorHandler
+	options.RefreshErrorHandler = func(err error) {
+		s.failed(err)
+		if errorHandler != nil {
+			errorHandler(err)
+		}
+	}
+	options.ResponseExtractor = func(ctx context.Context, resp *http.Response) (json.RawMessage, error) {
+		raw, err := keyfunc.ResponseExtractorStatusOK(ctx, resp)
+		if err == nil {
+			s.succeeded()
+		}
+		return raw, err
+	}
+	return options
+}
+
+// RefreshStats is implemented by the key sources fetched from a jwks server
+type RefreshStats interface {
+	Stats() *JwksStats
+}
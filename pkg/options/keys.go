@@ -0,0 +1,333 @@
+package options
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/Dimss/exa/pkg/fswatch"
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JwksFileKeySource   = "jwks-file"
+	PemDirKeySource     = "pem-dir"
+	HmacFileKeySource   = "hmac-file"
+	minHmacSecretLength = 32
+)
+
+// KeySource is a set of token verification keys which isn't bound to an issuer
+type KeySource interface {
+	Name() string
+	Keyfunc(token *jwt.Token) (interface{}, error)
+	KIDs() []string
+}
+
+// remoteJwks is a JWKS fetched from a jwks server, the fetch is retried in the
+// background when the server is unreachable on startup (e.g. the sidecar isn't up yet)
+type remoteJwks struct {
+	src     JwksSource
+	options keyfunc.Options
+	stats   *JwksStats
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	jwks   *keyfunc.JWKS
+	closed bool
+}
+
+func newRemoteJwks(src JwksSource, options keyfunc.Options) *remoteJwks {
+	return &remoteJwks{src: src, options: options, stats: &JwksStats{}, done: make(chan struct{})}
+}
+
+func (r *remoteJwks) fetch() error {
+	jwks, err := keyfunc.Get(r.src.URL, r.stats.instrument(r.options))
+	if err != nil {
+		r.stats.failed(err)
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the source was released while fetching
+	if r.closed {
+		jwks.EndBackground()
+		return nil
+	}
+	r.jwks = jwks
+	return nil
+}
+
+// fetchLoop retries the fetch until it succeeds or the source is closed
+func (r *remoteJwks) fetchLoop() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-time.After(discoveryRetryInterval):
+		}
+		err := r.fetch()
+		if err == nil {
+			zap.S().Infof("fetched jwks from %s", r.src.URL)
+			return
+		}
+		zap.S().Errorf("failed to fetch jwks from %s, retrying in %s: %s", r.src.URL, discoveryRetryInterval, err)
+	}
+}
+
+func (r *remoteJwks) Name() string {
+	return r.src.URL
+}
+
+func (r *remoteJwks) Keyfunc(token *jwt.Token) (interface{}, error) {
+	r.mu.RLock()
+	jwks := r.jwks
+	r.mu.RUnlock()
+	if jwks == nil {
+		return nil, fmt.Errorf("jwks of %s is not fetched yet", r.src.URL)
+	}
+	return jwks.Keyfunc(token)
+}
+
+func (r *remoteJwks) KIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.jwks == nil {
+		return nil
+	}
+	return r.jwks.KIDs()
+}
+
+// Ready reports whether the JWKS has been fetched
+func (r *remoteJwks) Ready() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.jwks != nil
+}
+
+func (r *remoteJwks) Stats() *JwksStats {
+	return r.stats
+}
+
+// Close stops the fetch retries and the background refreshes of the JWKS
+func (r *remoteJwks) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.done)
+	if r.jwks != nil {
+		r.jwks.EndBackground()
+	}
+}
+
+// KeySourceReady reports whether the keys of the key source are loaded,
+// only the jwks servers are fetched in the background
+func KeySourceReady(src KeySource) bool {
+	if r, ok := src.(interface{ Ready() bool }); ok {
+		return r.Ready()
+	}
+	return true
+}
+
+// fileKeySource holds keys loaded from local files (e.g. mounted kubernetes secrets)
+// and reloads them whenever the files change
+type fileKeySource struct {
+	kind      string
+	path      string
+	mu        sync.RWMutex
+	keys      map[string]interface{}
+	stopWatch func()
+}
+
+func newFileKeySource(kind, path string) (*fileKeySource, error) {
+	src := &fileKeySource{kind: kind, path: path}
+	if err := src.load(); err != nil {
+		return nil, err
+	}
+	var err error
+	if src.stopWatch, err = fswatch.Watch([]string{path}, src.reload); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// Close stops the reloads of the key files
+func (s *fileKeySource) Close() {
+	s.stopWatch()
+}
+
+func (s *fileKeySource) Name() string {
+	return s.kind + ":" + s.path
+}
+
+// Keyfunc selects the key by the token kid, tokens without
+// kid are accepted only when the source holds a single key
+func (s *fileKeySource) Keyfunc(token *jwt.Token) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if kid, ok := token.Header["kid"].(string); ok {
+		if key, ok := s.keys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w: kid %s not found in %s", keyfunc.ErrKID, kid, s.Name())
+	}
+	if len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: token without kid and %s holds %d keys", keyfunc.ErrKID, s.Name(), len(s.keys))
+}
+
+func (s *fileKeySource) KIDs() (kids []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for kid := range s.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	return
+}
+
+func (s *fileKeySource) reload() {
+	if err := s.load(); err != nil {
+		zap.S().Errorf("failed to reload %s, keeping previous keys: %s", s.Name(), err)
+		return
+	}
+	zap.S().Infof("reloaded %s, kids: %v", s.Name(), s.KIDs())
+}
+
+func (s *fileKeySource) load() error {
+	var (
+		keys map[string]interface{}
+		err  error
+	)
+	switch s.kind {
+	case JwksFileKeySource:
+		keys, err = loadJwksFile(s.path)
+	case PemDirKeySource:
+		keys, err = loadPemDir(s.path)
+	case HmacFileKeySource:
+		keys, err = loadHmacFile(s.path)
+	default:
+		err = fmt.Errorf("unknown key source type %s", s.kind)
+	}
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys found in %s", s.path)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	return nil
+}
+
+func loadJwksFile(path string) (map[string]interface{}, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	jwks, err := keyfunc.NewJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	return jwks.ReadOnlyKeys(), nil
+}
+
+// loadPemDir loads every PEM public key or certificate in the directory,
+// the kid of each key is the file name without its extension
+func loadPemDir(dir string) (map[string]interface{}, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]interface{}{}
+	for _, entry := range entries {
+		// skip directories and the ..data like entries of mounted secrets
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePemPublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys[strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))] = key
+	}
+	return keys, nil
+}
+
+func parsePemPublicKey(raw []byte) (interface{}, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported pem block type %s", block.Type)
+	}
+}
+
+// loadHmacFile loads a shared secret, the kid is the file name
+func loadHmacFile(path string) (map[string]interface{}, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := []byte(strings.TrimRight(string(raw), "\r\n"))
+	if len(secret) < minHmacSecretLength {
+		return nil, fmt.Errorf("hmac secret must be at least %d bytes", minHmacSecretLength)
+	}
+	return map[string]interface{}{filepath.Base(path): secret}, nil
+}
+
+// initFileKeySources loads the local key files, the broken files are
+// skipped on startup, on reloads they fail the reload
+func (opts *Options) initFileKeySources(v *viper.Viper, strict bool) error {
+	sources := map[string][]string{
+		JwksFileKeySource: v.GetStringSlice("jwks-files"),
+		PemDirKeySource:   v.GetStringSlice("public-key-dirs"),
+		HmacFileKeySource: v.GetStringSlice("hmac-secret-files"),
+	}
+	for _, kind := range []string{JwksFileKeySource, PemDirKeySource, HmacFileKeySource} {
+		for _, path := range sources[kind] {
+			src, err := newFileKeySource(kind, path)
+			if err != nil {
+				if strict {
+					return fmt.Errorf("failed to load %s %s: %w", kind, path, err)
+				}
+				zap.S().Errorf("failed to load %s %s: %s", kind, path, err)
+				continue
+			}
+			zap.S().Infof("adding %s, kids: %v", src.Name(), src.KIDs())
+			opts.KeySources = append(opts.KeySources, src)
+		}
+	}
+	return nil
+}
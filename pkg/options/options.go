@@ -1,12 +1,22 @@
 package options
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"fmt"
+	"github.com/Dimss/exa/pkg/cache"
+	"github.com/Dimss/exa/pkg/decisionlog"
+	"github.com/Dimss/exa/pkg/ratelimit"
+	"github.com/Dimss/exa/pkg/revocation"
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/Dimss/exa/pkg/tlsutil"
+	"github.com/Dimss/exa/pkg/tracing"
 	"github.com/MicahParks/keyfunc"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
-	"net/http"
+	"os"
+	"reflect"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,31 +31,225 @@ type Options struct {
 	UserIdHeader         string
 	InsecureSkipVerify   bool
 	JwksServerURLs       []string
+	JwksSources          []JwksSource
+	TLS                  tlsutil.ClientConfig
+	TokenPolicy          TokenPolicy
 	Oauth2TokenIssuer    string
 	Oauth2ClaimsValidate []string
 	DisableValidators    []string
 	RedirectUrl          string
-	JwksServers          []*keyfunc.JWKS
+	KeySources           []KeySource
+	Issuers              []*Issuer
+	Revocations          *revocation.Store
+	TokenSources         []routes.TokenSource
+	DPoP                 DPoP
+	DecryptionKeys       *DecryptionKeys
+	DecisionCache        *cache.LRU[*CachedToken]
+	DecisionCacheTTL     time.Duration
+	Routes               *routes.Table
+	Network              *routes.Network
+	XFFTrustedHops       int
+	IdentityRateLimit    ratelimit.Limit
+	FailedAuthRateLimit  ratelimit.Limit
+	RateLimitDescriptors *ratelimit.ConfigTable
+	AuditOnly            bool
+	ShadowTokenPolicy    *TokenPolicy
+	DecisionLog          *decisionlog.Logger
+	MetricsPathTemplates routes.PathTemplates
+	MetricsHosts         routes.HostLabels
+	// Settings are the viper settings the options were built from
+	Settings map[string]interface{}
+	// checks counts the checks using the options, see Store.Acquire
+	checks atomic.Int64
+	// unsubscribeDecisionCache stops the purge of the decision cache on revocation changes
+	unsubscribeDecisionCache func()
 }
 
-func NewOptionsFromFlags() *Options {
+// JwksSource is a single JWKS endpoint with its own TLS settings,
+// unset TLS settings are inherited from the global tls flags
+type JwksSource struct {
+	URL string               `mapstructure:"url"`
+	TLS tlsutil.ClientConfig `mapstructure:"tls"`
+}
+
+// newOptions builds the options from the flags, the env and the config file read into v. The state
+// worth keeping is taken from the previous options on reloads: the revocations, the
+// decision cache and the JWKS of the unchanged jwks sources and issuers
+func newOptions(v *viper.Viper, prev *Options) (*Options, error) {
 	opts := &Options{
-		AuthCookie:           viper.GetString("auth-cookie"),
-		AuthTokenSrcHeader:   viper.GetString("token-src-header"),
-		UserIdHeader:         viper.GetString("user-id-header"),
-		InsecureSkipVerify:   viper.GetBool("insecure-skip-verify"),
-		JwksServerURLs:       viper.GetStringSlice("jwks-servers"),
-		Oauth2ClaimsValidate: viper.GetStringSlice("oauth2-claims-validate"),
-		Oauth2TokenIssuer:    viper.GetString("oauth2-token-issuer"),
-		RedirectUrl:          viper.GetString("redirect-url"),
-		DisableValidators:    viper.GetStringSlice("disable-validators"),
+		Settings:             v.AllSettings(),
+		AuthCookie:           v.GetString("auth-cookie"),
+		AuthTokenSrcHeader:   v.GetString("token-src-header"),
+		UserIdHeader:         v.GetString("user-id-header"),
+		InsecureSkipVerify:   v.GetBool("insecure-skip-verify"),
+		JwksServerURLs:       v.GetStringSlice("jwks-servers"),
+		Oauth2ClaimsValidate: v.GetStringSlice("oauth2-claims-validate"),
+		Oauth2TokenIssuer:    v.GetString("oauth2-token-issuer"),
+		RedirectUrl:          v.GetString("redirect-url"),
+		DisableValidators:    v.GetStringSlice("disable-validators"),
+		TokenPolicy:          newTokenPolicyFromFlags(v),
+		DPoP:                 newDPoPFromFlags(v),
+		XFFTrustedHops:       v.GetInt("xff-trusted-hops"),
+		AuditOnly:            v.GetBool("audit-only"),
+		IdentityRateLimit: ratelimit.Limit{
+			Rate:  v.GetFloat64("identity-rate-limit"),
+			Burst: v.GetInt("identity-rate-burst"),
+		},
+		FailedAuthRateLimit: ratelimit.Limit{
+			Rate:  v.GetFloat64("failed-auth-rate-limit"),
+			Burst: v.GetInt("failed-auth-rate-burst"),
+		},
+		TLS: tlsutil.ClientConfig{
+			CAFiles:            v.GetStringSlice("tls-ca-files"),
+			CertFile:           v.GetString("tls-client-cert"),
+			KeyFile:            v.GetString("tls-client-key"),
+			ServerName:         v.GetString("tls-server-name"),
+			ProxyURL:           v.GetString("proxy-url"),
+			InsecureSkipVerify: v.GetBool("insecure-skip-verify"),
+		},
 	}
 
+	for _, u := range opts.JwksServerURLs {
+		opts.JwksSources = append(opts.JwksSources, JwksSource{URL: u})
+	}
+	var jwksSources []JwksSource
+	if err := v.UnmarshalKey("jwks-sources", &jwksSources); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks-sources: %w", err)
+	}
+	opts.JwksSources = append(opts.JwksSources, jwksSources...)
+	for i := range opts.JwksSources {
+		opts.JwksSources[i].TLS = opts.JwksSources[i].TLS.WithDefaults(opts.TLS)
+	}
+
+	pathTemplates, err := routes.CompilePathTemplates(v.GetStringSlice("metrics-path-templates"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics path templates: %w", err)
+	}
+	opts.MetricsPathTemplates = pathTemplates
+	metricsHosts, err := routes.CompileHostLabels(v.GetStringSlice("metrics-hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics hosts: %w", err)
+	}
+	opts.MetricsHosts = metricsHosts
+
+	// the partially built options are closed on error, their watches and refreshes stop
+	fail := func(err error) (*Options, error) {
+		opts.Release(prev)
+		return nil, err
+	}
+	if err := opts.initTokenSources(v); err != nil {
+		return fail(err)
+	}
+	if err := opts.initRoutes(v); err != nil {
+		return fail(err)
+	}
+	if err := opts.initNetwork(v); err != nil {
+		return fail(err)
+	}
+	if err := opts.initRateLimitDescriptors(v); err != nil {
+		return fail(err)
+	}
+	if err := opts.initShadowTokenPolicy(v); err != nil {
+		return fail(err)
+	}
+	if err := opts.initRevocations(v, prev); err != nil {
+		return fail(err)
+	}
+	opts.initDecisionCache(v, prev)
+	opts.initDPoPReplays(prev)
+
 	if opts.OAuth2ValidatorEnabled() {
-		opts.initJwksKeyfuncs()
+		if err := opts.initJwksKeyfuncs(prev); err != nil {
+			return fail(err)
+		}
+		if err := opts.initFileKeySources(v, prev != nil); err != nil {
+			return fail(err)
+		}
+		if err := opts.initDecryptionKeys(v); err != nil {
+			return fail(err)
+		}
+		if err := opts.initIssuers(v, prev); err != nil {
+			return fail(err)
+		}
+	}
+	opts.Revocations.SetLifetime(opts.maxTokenAge())
+	// the decision log is the last, its sinks are opened once the options are valid
+	if err := opts.initDecisionLog(v, prev); err != nil {
+		return fail(err)
+	}
+
+	return opts, nil
+}
+
+// Done marks the end of a check which acquired the options
+func (opts *Options) Done() {
+	opts.checks.Add(-1)
+}
+
+// idle waits until no check uses the options or the timeout expires
+func (opts *Options) idle(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for opts.checks.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(idlePollInterval)
 	}
+	return true
+}
 
-	return opts
+// Release stops the watches and the background refreshes of the options
+// which aren't carried over to next, next is nil on shutdown
+func (opts *Options) Release(next *Options) {
+	for _, src := range opts.KeySources {
+		if c, ok := src.(interface{ Close() }); ok && (next == nil || !next.hasKeySource(src)) {
+			c.Close()
+		}
+	}
+	for _, iss := range opts.Issuers {
+		if next == nil || !next.hasIssuer(iss) {
+			iss.Close()
+		}
+	}
+	if opts.Routes != nil && (next == nil || next.Routes != opts.Routes) {
+		opts.Routes.Close()
+	}
+	if opts.RateLimitDescriptors != nil && (next == nil || next.RateLimitDescriptors != opts.RateLimitDescriptors) {
+		opts.RateLimitDescriptors.Close()
+	}
+	if opts.DecryptionKeys != nil && (next == nil || next.DecryptionKeys != opts.DecryptionKeys) {
+		opts.DecryptionKeys.Close()
+	}
+	if opts.DecisionLog != nil && (next == nil || next.DecisionLog != opts.DecisionLog) {
+		opts.DecisionLog.Close()
+	}
+	if opts.DecisionCache != nil && (next == nil || next.DecisionCache != opts.DecisionCache) {
+		opts.unsubscribeDecisionCache()
+	}
+	if opts.Revocations != nil && (next == nil || next.Revocations != opts.Revocations) {
+		opts.Revocations.Close()
+	}
+	if opts.DPoP.Replays != nil && (next == nil || next.DPoP.Replays != opts.DPoP.Replays) {
+		opts.DPoP.Replays.Close()
+	}
+}
+
+func (opts *Options) hasKeySource(src KeySource) bool {
+	for _, s := range opts.KeySources {
+		if s == src {
+			return true
+		}
+	}
+	return false
+}
+
+func (opts *Options) hasIssuer(iss *Issuer) bool {
+	for _, i := range opts.Issuers {
+		if i == iss {
+			return true
+		}
+	}
+	return false
 }
 
 func (opts *Options) validatorDisabled(validatorType string) bool {
@@ -65,35 +269,233 @@ func (opts *Options) OAuth2ValidatorEnabled() bool {
 	return !opts.validatorDisabled(OAuth2Type)
 }
 
-func (opts *Options) initJwksKeyfuncs() {
+// Ready reports whether the tokens can be verified, a key source is loaded or an
+// issuer discovered. No keys are needed without oauth2 validator
+func (opts *Options) Ready() bool {
+	if !opts.OAuth2ValidatorEnabled() {
+		return true
+	}
+	for _, src := range opts.KeySources {
+		if KeySourceReady(src) {
+			return true
+		}
+	}
+	for _, iss := range opts.Issuers {
+		if iss.Ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// initJwksKeyfuncs fetches the jwks servers, the unreachable servers are retried in the
+// background on startup, on reloads they fail the reload, the unchanged servers aren't fetched again
+func (opts *Options) initJwksKeyfuncs(prev *Options) error {
+	for _, src := range opts.JwksSources {
+		if jwks := prev.remoteJwks(src); jwks != nil {
+			opts.KeySources = append(opts.KeySources, jwks)
+			continue
+		}
+		zap.S().Infof("adding jwks server: %s", src.URL)
+		client, err := src.TLS.HTTPClient()
+		if err != nil {
+			if prev != nil {
+				return fmt.Errorf("failed to configure http client for %s: %w", src.URL, err)
+			}
+			zap.S().Errorf("failed to configure http client for %s: %s", src.URL, err)
+			continue
+		}
+		tracing.WrapClient("jwks.fetch", client)
+		// Create the keyfunc options. Use an error handler that logs. Refresh the JWKS when a JWT signed by an unknown KID
+		// is found or at the specified interval. Rate limit these refreshes. Timeout the initial JWKS refresh request after
+		// 10 seconds. This timeout is also used to create the initial context.Context for keyfunc.Get.
+		options := keyfunc.Options{
+			Ctx: context.Background(),
+			RefreshErrorHandler: func(err error) {
+				zap.S().Error(err)
+			},
+			RefreshInterval:   time.Hour,
+			RefreshRateLimit:  time.Minute * 5,
+			RefreshTimeout:    time.Second * 10,
+			RefreshUnknownKID: true,
+			Client:            client,
+		}
+		// Create the JWKS from the resource at the given URL.
+		jwks := newRemoteJwks(src, options)
+		if err := jwks.fetch(); err != nil {
+			if prev != nil {
+				jwks.Close()
+				return fmt.Errorf("failed to fetch jwks from %s: %w", src.URL, err)
+			}
+			zap.S().Errorf("failed to fetch jwks from %s, retrying in %s: %s", src.URL, discoveryRetryInterval, err)
+			go jwks.fetchLoop()
+		}
+		opts.KeySources = append(opts.KeySources, jwks)
+	}
+	return nil
+}
 
-	transCfg := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // ToDo(dimssss):  this shouldn't be here
+// remoteJwks returns the fetched JWKS of the jwks source, nil if there is none
+func (opts *Options) remoteJwks(src JwksSource) *remoteJwks {
+	if opts == nil {
+		return nil
+	}
+	for _, keySource := range opts.KeySources {
+		if jwks, ok := keySource.(*remoteJwks); ok && reflect.DeepEqual(jwks.src, src) {
+			return jwks
+		}
 	}
+	return nil
+}
 
-	client := &http.Client{Transport: transCfg}
-	// Create the keyfunc options. Use an error handler that logs. Refresh the JWKS when a JWT signed by an unknown KID
-	// is found or at the specified interval. Rate limit these refreshes. Timeout the initial JWKS refresh request after
-	// 10 seconds. This timeout is also used to create the initial context.Context for keyfunc.Get.
-	options := keyfunc.Options{
-		Ctx: context.Background(),
-		RefreshErrorHandler: func(err error) {
-			zap.S().Error(err)
-		},
-		RefreshInterval:   time.Hour,
-		RefreshRateLimit:  time.Minute * 5,
-		RefreshTimeout:    time.Second * 10,
-		RefreshUnknownKID: true,
-		Client:            client,
+// initRoutes loads the route rules file, or the rules set in the config file itself
+func (opts *Options) initRoutes(v *viper.Viper) error {
+	if path := v.GetString("route-rules-file"); path != "" || !v.IsSet("rules") {
+		routesTable, err := routes.NewTable(path)
+		if err != nil {
+			return fmt.Errorf("invalid route rules: %w", err)
+		}
+		opts.Routes = routesTable
+		return nil
+	}
+	var rules []*routes.Rule
+	if err := v.UnmarshalKey("rules", &rules); err != nil {
+		return fmt.Errorf("invalid route rules: %w", err)
 	}
+	compiled, err := routes.CompileRules(rules)
+	if err != nil {
+		return fmt.Errorf("invalid route rules: %w", err)
+	}
+	opts.Routes = routes.NewRulesTable(compiled)
+	return nil
+}
 
-	for _, u := range opts.JwksServerURLs {
-		zap.S().Infof("adding jwks server: %s", u)
-		// Create the JWKS from the resource at the given URL.
-		jwks, err := keyfunc.Get(u, options)
+func (opts *Options) initNetwork(v *viper.Viper) error {
+	network := &routes.Network{
+		Allow: v.GetStringSlice("allow-cidrs"),
+		Deny:  v.GetStringSlice("deny-cidrs"),
+	}
+	if err := network.Compile(); err != nil {
+		return fmt.Errorf("invalid network lists: %w", err)
+	}
+	opts.Network = network
+	return nil
+}
+
+func (opts *Options) initRateLimitDescriptors(v *viper.Viper) error {
+	path := v.GetString("rls-config-file")
+	if path == "" {
+		return nil
+	}
+	descriptors, err := ratelimit.NewConfigTable(path)
+	if err != nil {
+		return fmt.Errorf("invalid rate limit descriptors: %w", err)
+	}
+	opts.RateLimitDescriptors = descriptors
+	return nil
+}
+
+// initShadowTokenPolicy reads the candidate token policy, its unset fields are taken from the active policy
+func (opts *Options) initShadowTokenPolicy(v *viper.Viper) error {
+	if !v.IsSet("shadow-token-policy") {
+		return nil
+	}
+	policy := &TokenPolicy{}
+	if err := v.UnmarshalKey("shadow-token-policy", policy); err != nil {
+		return fmt.Errorf("invalid shadow token policy: %w", err)
+	}
+	opts.ShadowTokenPolicy = policy
+	zap.S().Infof("shadow token policy enabled: %+v", *policy)
+	return nil
+}
+
+// initRevocations loads the revocations store, the store of the previous options
+// is kept on reloads, it follows the changes of its file by itself
+func (opts *Options) initRevocations(v *viper.Viper, prev *Options) error {
+	path := v.GetString("revocation-file")
+	if prev != nil {
+		if prev.Revocations.Path() != path {
+			zap.S().Warnf("revocation-file changes are applied on restart, keeping %s", prev.Revocations.Path())
+		}
+		opts.Revocations = prev.Revocations
+		return nil
+	}
+	revocations, err := revocation.NewStore(path)
+	if err != nil {
+		return fmt.Errorf("failed to load revocations: %w", err)
+	}
+	opts.Revocations = revocations
+	return nil
+}
+
+// maxTokenAge returns the longest max age of the token policies, the revocations
+// without a known token exp are kept at least as long
+func (opts *Options) maxTokenAge() time.Duration {
+	maxAge := opts.TokenPolicy.MaxAge
+	for _, iss := range opts.Issuers {
+		maxAge = max(maxAge, iss.Policy().MaxAge)
+	}
+	return maxAge
+}
+
+// initDecisionLog opens the decision log sinks, the logger of the previous
+// options is kept when neither its config nor the tls settings changed
+func (opts *Options) initDecisionLog(v *viper.Viper, prev *Options) error {
+	sinks := v.GetStringSlice("decision-log-sinks")
+	if len(sinks) == 0 {
+		return nil
+	}
+	var redactKey []byte
+	if keyFile := v.GetString("decision-log-redact-key-file"); keyFile != "" {
+		key, err := os.ReadFile(keyFile)
 		if err != nil {
-			zap.S().Error(err)
+			return fmt.Errorf("failed to read the decision log redact key: %w", err)
+		}
+		redactKey = bytes.TrimSpace(key)
+	}
+	cfg := decisionlog.Config{
+		Sinks:                sinks,
+		RedactFields:         v.GetStringSlice("decision-log-redact-fields"),
+		RedactKey:            redactKey,
+		File:                 v.GetString("decision-log-file"),
+		FileMaxSize:          v.GetInt64("decision-log-file-max-size-mb") * 1024 * 1024,
+		FileMaxBackups:       v.GetInt("decision-log-file-max-backups"),
+		WebhookURL:           v.GetString("decision-log-webhook-url"),
+		WebhookBatchSize:     v.GetInt("decision-log-webhook-batch-size"),
+		WebhookFlushInterval: v.GetDuration("decision-log-webhook-flush-interval"),
+	}
+	if prev != nil && prev.DecisionLog != nil && reflect.DeepEqual(prev.TLS, opts.TLS) {
+		prevCfg := prev.DecisionLog.Config()
+		prevCfg.WebhookClient = nil
+		if reflect.DeepEqual(prevCfg, cfg) {
+			opts.DecisionLog = prev.DecisionLog
+			return nil
+		}
+	}
+	webhookClient, err := opts.TLS.HTTPClient()
+	if err != nil {
+		return fmt.Errorf("failed to create the decision log webhook client: %w", err)
+	}
+	cfg.WebhookClient = webhookClient
+	logger, err := decisionlog.NewLogger(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid decision log: %w", err)
+	}
+	zap.S().Infof("decision log enabled, sinks: %v", sinks)
+	opts.DecisionLog = logger
+	return nil
+}
+
+// IdentityHeaders returns the headers exa sets from the token claims, they are
+// removed from anonymous requests so clients can't spoof an identity
+func (opts *Options) IdentityHeaders() []string {
+	headers := []string{opts.UserIdHeader}
+	for _, iss := range opts.Issuers {
+		for header := range iss.ClaimMappings {
+			if !contains(headers, header) {
+				headers = append(headers, header)
+			}
 		}
-		opts.JwksServers = append(opts.JwksServers, jwks)
 	}
+	return headers
 }
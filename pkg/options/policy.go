@@ -0,0 +1,45 @@
+package options
+
+import (
+	"github.com/spf13/viper"
+	"time"
+)
+
+// TokenPolicy is the set of checks a token must pass on top of its signature
+type TokenPolicy struct {
+	Algorithms     []string      `mapstructure:"algorithms"`
+	Leeway         time.Duration `mapstructure:"leeway"`
+	MaxAge         time.Duration `mapstructure:"max-age"`
+	RequiredClaims []string      `mapstructure:"required-claims"`
+	Types          []string      `mapstructure:"types"`
+}
+
+func newTokenPolicyFromFlags(v *viper.Viper) TokenPolicy {
+	return TokenPolicy{
+		Algorithms:     v.GetStringSlice("token-algorithms"),
+		Leeway:         v.GetDuration("token-leeway"),
+		MaxAge:         v.GetDuration("token-max-age"),
+		RequiredClaims: v.GetStringSlice("token-required-claims"),
+		Types:          v.GetStringSlice("token-types"),
+	}
+}
+
+// WithDefaults returns a copy of the policy where every unset field is taken from defaults
+func (p TokenPolicy) WithDefaults(defaults TokenPolicy) TokenPolicy {
+	if len(p.Algorithms) == 0 {
+		p.Algorithms = defaults.Algorithms
+	}
+	if p.Leeway == 0 {
+		p.Leeway = defaults.Leeway
+	}
+	if p.MaxAge == 0 {
+		p.MaxAge = defaults.MaxAge
+	}
+	if len(p.RequiredClaims) == 0 {
+		p.RequiredClaims = defaults.RequiredClaims
+	}
+	if len(p.Types) == 0 {
+		p.Types = defaults.Types
+	}
+	return p
+}
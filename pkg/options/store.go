@@ -0,0 +1,184 @@
+package options
+
+import (
+	"fmt"
+	"github.com/Dimss/exa/pkg/fswatch"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	idlePollInterval = time.Millisecond * 100
+	// releaseTimeout bounds the wait for the checks of the previous options, a check
+	// stuck longer than the timeout must not keep the previous sinks and watches forever
+	releaseTimeout = time.Minute
+)
+
+// Store holds the active options, a reload builds and validates new options from the config
+// file and swaps them atomically, the checks in flight keep the snapshot they started with.
+// A broken reload keeps the previous options. The listen addresses, the tracing and the
+// revocation file are read on startup only.
+// Every build reads the config file into its own viper, the global viper is never written
+// while serving
+type Store struct {
+	current    atomic.Pointer[Options]
+	configFile string
+	// newConfig returns a viper with the flags and the env bound, without the config file
+	newConfig func() *viper.Viper
+
+	// mu serializes the reloads
+	mu        sync.Mutex
+	stopWatch func()
+	// closers stop the state kept by the services across the reloads
+	closers []func()
+
+	statusMu sync.Mutex
+	status   ReloadStatus
+}
+
+// ReloadStatus is the result of the config reloads
+type ReloadStatus struct {
+	Reloads    uint64    `json:"reloads"`
+	Failures   uint64    `json:"failures"`
+	LastReload time.Time `json:"lastReload,omitempty"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+// NewStore builds the options from newConfig and the config file, the config file
+// is watched for changes when set
+func NewStore(configFile string, newConfig func() *viper.Viper) (*Store, error) {
+	s := &Store{configFile: configFile, newConfig: newConfig}
+	v, err := s.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := newOptions(v, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.current.Store(opts)
+	if s.configFile == "" {
+		return s, nil
+	}
+	stopWatch, err := fswatch.Watch([]string{s.configFile}, func() { s.Reload() })
+	if err != nil {
+		return nil, err
+	}
+	s.stopWatch = stopWatch
+	return s, nil
+}
+
+// Load returns the active options
+func (s *Store) Load() *Options {
+	return s.current.Load()
+}
+
+// Acquire returns the active options for a check, the options are released after a
+// reload only once the checks which acquired them call Done
+func (s *Store) Acquire() *Options {
+	for {
+		opts := s.current.Load()
+		opts.checks.Add(1)
+		// a reload swapped the options in between, they may be released already
+		if s.current.Load() == opts {
+			return opts
+		}
+		opts.Done()
+	}
+}
+
+// Reload re-reads the config file and swaps the options once they are valid
+func (s *Store) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.readConfig()
+	if err != nil {
+		return s.failed(err)
+	}
+	prev := s.Load()
+	next, err := newOptions(v, prev)
+	if err != nil {
+		return s.failed(err)
+	}
+	s.current.Store(next)
+	go release(prev, next)
+	// the cached decisions were made with the previous policies
+	if next.DecisionCache != nil {
+		next.DecisionCache.Purge()
+	}
+	s.setStatus(nil)
+	zap.S().Infof("configuration reloaded from %s", s.configFile)
+	return nil
+}
+
+// readConfig reads the config file into a new viper, there is nothing to read without config file
+func (s *Store) readConfig() (*viper.Viper, error) {
+	v := s.newConfig()
+	if s.configFile == "" {
+		return v, nil
+	}
+	v.SetConfigFile(s.configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", s.configFile, err)
+	}
+	return v, nil
+}
+
+// release releases the previous options once their checks are done,
+// e.g. the decision log of the previous options is closed after their last record
+func release(prev, next *Options) {
+	if !prev.idle(releaseTimeout) {
+		zap.S().Warnf("checks of the previous configuration still running after %s, releasing it", releaseTimeout)
+	}
+	prev.Release(next)
+}
+
+func (s *Store) failed(err error) error {
+	s.setStatus(err)
+	zap.S().Errorf("failed to reload the configuration, keeping the previous configuration: %s", err)
+	return err
+}
+
+func (s *Store) setStatus(err error) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.status.LastReload = time.Now()
+	if err != nil {
+		s.status.Failures++
+		s.status.LastError = err.Error()
+		return
+	}
+	s.status.Reloads++
+	s.status.LastError = ""
+}
+
+func (s *Store) Status() ReloadStatus {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	return s.status
+}
+
+// OnClose registers a function called on Close, once the active options are released
+func (s *Store) OnClose(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closers = append(s.closers, fn)
+}
+
+// Close stops the config file watch and releases the active options
+func (s *Store) Close() {
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	s.Load().Release(nil)
+	s.mu.Lock()
+	closers := s.closers
+	s.mu.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
+}
@@ -0,0 +1,129 @@
+package options
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreAcquire(t *testing.T) {
+	s := &Store{}
+	prev := &Options{}
+	s.current.Store(prev)
+
+	opts := s.Acquire()
+	if opts != prev {
+		t.Fatalf("Acquire() = %p, want the active options %p", opts, prev)
+	}
+	if got := prev.checks.Load(); got != 1 {
+		t.Fatalf("checks = %d, want 1", got)
+	}
+	next := &Options{}
+	s.current.Store(next)
+
+	released := make(chan struct{})
+	go func() {
+		release(prev, next)
+		close(released)
+	}()
+	select {
+	case <-released:
+		t.Fatal("previous options released while a check still uses them")
+	case <-time.After(idlePollInterval * 3):
+	}
+	opts.Done()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("previous options not released once the check is done")
+	}
+	if got := s.Acquire(); got != next {
+		t.Errorf("Acquire() after reload = %p, want %p", got, next)
+	}
+}
+
+func TestStoreReloadInvalidDecisionLog(t *testing.T) {
+	tests := []struct {
+		name          string
+		batchSize     int
+		flushInterval time.Duration
+		wantErr       bool
+	}{
+		{name: "valid webhook", batchSize: 10, flushInterval: time.Second},
+		{name: "zero flush interval", batchSize: 10, flushInterval: 0, wantErr: true},
+		{name: "zero batch size", batchSize: 0, flushInterval: time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, "", "token-sources: [header:authorization]\n")
+			s, err := NewStore(path, viper.New)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			prev := s.Load()
+
+			writeConfig(t, path, fmt.Sprintf(`token-sources: [header:authorization]
+decision-log-sinks: [webhook]
+decision-log-webhook-url: http://127.0.0.1:1/decisions
+decision-log-webhook-batch-size: %d
+decision-log-webhook-flush-interval: %s
+`, tt.batchSize, tt.flushInterval))
+			err = s.Reload()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Reload() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr && s.Load() != prev {
+				t.Error("a broken reload replaced the options")
+			}
+		})
+	}
+}
+
+func TestStoreReloadKeepsGlobalConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{name: "valid config", config: "token-sources: [header:x-token]\n", want: "header:x-token"},
+		{name: "broken config", config: "token-sources: [", want: "header:authorization"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+			viper.Set("token-sources", []string{"header:global"})
+			path := writeConfig(t, "", "token-sources: [header:authorization]\n")
+			s, err := NewStore(path, viper.New)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			writeConfig(t, path, tt.config)
+			s.Reload()
+			if got := s.Load().TokenSources[0].String(); got != tt.want {
+				t.Errorf("token source = %s, want %s", got, tt.want)
+			}
+			// the reloads never write the global viper, it may be read concurrently
+			if got := viper.GetStringSlice("token-sources"); len(got) != 1 || got[0] != "header:global" {
+				t.Errorf("global token-sources = %v, want [header:global]", got)
+			}
+		})
+	}
+}
+
+// writeConfig writes the yaml config file to path, to a new file when path is empty
+func writeConfig(t *testing.T, path, config string) string {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "config.yaml")
+	}
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,22 @@
+package options
+
+import (
+	"fmt"
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/spf13/viper"
+)
+
+// initTokenSources parses the global token sources, the route rules may override them
+func (opts *Options) initTokenSources(v *viper.Viper) error {
+	specs := v.GetStringSlice("token-sources")
+	if len(specs) == 0 {
+		// the legacy sources: the auth cookie, then the token header
+		specs = []string{routes.CookieTokenSource + ":" + opts.AuthCookie, routes.HeaderTokenSource + ":" + opts.AuthTokenSrcHeader}
+	}
+	sources, err := routes.ParseTokenSources(specs)
+	if err != nil {
+		return fmt.Errorf("invalid token-sources: %w", err)
+	}
+	opts.TokenSources = sources
+	return nil
+}
@@ -0,0 +1,163 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBuckets bounds the memory of the buckets, e.g. under a spoofed source addresses flood
+	maxBuckets = 100000
+	gcInterval = time.Minute
+)
+
+// Limit is a token bucket refilled at Rate tokens per second up to Burst tokens
+type Limit struct {
+	Rate  float64 `mapstructure:"rate" json:"rate"`
+	Burst int     `mapstructure:"burst" json:"burst"`
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+// burst defaults to one second of traffic
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	// full is when the bucket is refilled, it can be dropped afterwards
+	full time.Time
+}
+
+// Buckets holds a token bucket per key, the limit is given on each call,
+// so the limits of hot reloaded rules apply to the existing buckets.
+// The buckets are kept from the most to the least recently used
+type Buckets struct {
+	mu        sync.Mutex
+	ll        *list.List
+	buckets   map[string]*list.Element
+	stopGC    func()
+	closeOnce sync.Once
+}
+
+func NewBuckets() *Buckets {
+	b := &Buckets{ll: list.New(), buckets: map[string]*list.Element{}}
+	b.stopGC = every(gcInterval, b.gc)
+	return b
+}
+
+// Close stops the gc of the buckets
+func (b *Buckets) Close() {
+	b.closeOnce.Do(b.stopGC)
+}
+
+// Take takes a token from the key bucket, when the bucket is empty it
+// returns false and the time until the next token
+func (b *Buckets) Take(key string, limit Limit) (bool, time.Duration) {
+	return b.take(key, limit, 1)
+}
+
+// Peek reports whether the key bucket has a token, without taking it
+func (b *Buckets) Peek(key string, limit Limit) (bool, time.Duration) {
+	return b.take(key, limit, 0)
+}
+
+func (b *Buckets) take(key string, limit Limit, n float64) (bool, time.Duration) {
+	if !limit.Enabled() {
+		return true, 0
+	}
+	now := time.Now()
+	burst := limit.burst()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var bk *bucket
+	if elem, ok := b.buckets[key]; ok {
+		b.ll.MoveToFront(elem)
+		bk = elem.Value.(*bucket)
+	} else {
+		if n == 0 {
+			return true, 0
+		}
+		if b.ll.Len() >= maxBuckets {
+			b.evictLocked(now)
+		}
+		bk = &bucket{key: key, tokens: burst, last: now}
+		b.buckets[key] = b.ll.PushFront(bk)
+	}
+	bk.tokens = math.Min(burst, bk.tokens+now.Sub(bk.last).Seconds()*limit.Rate)
+	bk.last = now
+
+	if bk.tokens < math.Max(n, 1) {
+		return false, time.Duration((math.Max(n, 1) - bk.tokens) / limit.Rate * float64(time.Second))
+	}
+	bk.tokens -= n
+	bk.full = now.Add(time.Duration((burst - bk.tokens) / limit.Rate * float64(time.Second)))
+	return true, 0
+}
+
+func (b *Buckets) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ll.Len()
+}
+
+func (b *Buckets) gc(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gcLocked(now)
+}
+
+func (b *Buckets) gcLocked(now time.Time) {
+	for elem := b.ll.Back(); elem != nil; {
+		prev := elem.Prev()
+		if now.After(elem.Value.(*bucket).full) {
+			b.removeLocked(elem)
+		}
+		elem = prev
+	}
+}
+
+// evictLocked drops the least recently used buckets which are refilled, or the least
+// recently used one when it is still refilling, every bucket is dropped at most once
+func (b *Buckets) evictLocked(now time.Time) {
+	for elem := b.ll.Back(); elem != nil && now.After(elem.Value.(*bucket).full); elem = b.ll.Back() {
+		b.removeLocked(elem)
+	}
+	if b.ll.Len() >= maxBuckets {
+		b.removeLocked(b.ll.Back())
+	}
+}
+
+func (b *Buckets) removeLocked(elem *list.Element) {
+	b.ll.Remove(elem)
+	delete(b.buckets, elem.Value.(*bucket).key)
+}
+
+// every calls fn with the current time at every interval until the returned function is called
+func every(interval time.Duration, fn func(now time.Time)) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				fn(now)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBucketsTake(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit Limit
+		// takes are made back to back, want is the result of each take
+		takes     int
+		want      []bool
+		wantRetry time.Duration
+	}{
+		{name: "disabled limit", limit: Limit{}, takes: 3, want: []bool{true, true, true}},
+		{name: "burst", limit: Limit{Rate: 1, Burst: 2}, takes: 3, want: []bool{true, true, false}, wantRetry: time.Second},
+		{name: "burst defaults to one second of traffic", limit: Limit{Rate: 2}, takes: 3, want: []bool{true, true, false}, wantRetry: time.Second / 2},
+		{name: "fractional rate", limit: Limit{Rate: 0.5}, takes: 2, want: []bool{true, false}, wantRetry: time.Second * 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBuckets()
+			defer b.Close()
+			var retry time.Duration
+			for i := 0; i < tt.takes; i++ {
+				var ok bool
+				ok, retry = b.Take("key", tt.limit)
+				if ok != tt.want[i] {
+					t.Fatalf("take %d = %t, want %t", i, ok, tt.want[i])
+				}
+			}
+			// the tokens refilled between the takes shorten the retry a bit
+			if retry > tt.wantRetry || retry < tt.wantRetry-time.Millisecond*50 {
+				t.Errorf("retry after = %s, want %s", retry, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestBucketsRefill(t *testing.T) {
+	b := NewBuckets()
+	defer b.Close()
+	limit := Limit{Rate: 100, Burst: 1}
+	if ok, _ := b.Take("key", limit); !ok {
+		t.Fatal("first take failed")
+	}
+	if ok, _ := b.Take("key", limit); ok {
+		t.Fatal("empty bucket gave a token")
+	}
+	time.Sleep(time.Millisecond * 20)
+	if ok, _ := b.Take("key", limit); !ok {
+		t.Error("bucket not refilled")
+	}
+}
+
+func TestBucketsPeek(t *testing.T) {
+	tests := []struct {
+		name string
+		// taken is the number of tokens taken before the peek
+		taken   int
+		want    bool
+		wantLen int
+	}{
+		{name: "unknown key creates no bucket", taken: 0, want: true, wantLen: 0},
+		{name: "bucket with tokens", taken: 1, want: true, wantLen: 1},
+		{name: "empty bucket", taken: 2, want: false, wantLen: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBuckets()
+			defer b.Close()
+			limit := Limit{Rate: 0.01, Burst: 2}
+			for i := 0; i < tt.taken; i++ {
+				b.Take("key", limit)
+			}
+			ok, _ := b.Peek("key", limit)
+			if ok != tt.want {
+				t.Errorf("Peek() = %t, want %t", ok, tt.want)
+			}
+			// a peek never takes a token
+			if again, _ := b.Peek("key", limit); again != ok {
+				t.Errorf("second Peek() = %t, want %t", again, ok)
+			}
+			if got := b.Len(); got != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestBucketsMaxBuckets(t *testing.T) {
+	limit := Limit{Rate: 1, Burst: 1}
+	tests := []struct {
+		name string
+		// age of the existing buckets, they are refilled and collected when older than a second
+		age     time.Duration
+		wantLen int
+	}{
+		{name: "refilled buckets are collected", age: time.Minute, wantLen: 1},
+		{name: "the oldest refilling bucket is evicted", age: 0, wantLen: maxBuckets},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBuckets()
+			defer b.Close()
+			for i := 0; i < maxBuckets; i++ {
+				if ok, _ := b.Take(strconv.Itoa(i), limit); !ok {
+					t.Fatalf("bucket %d is empty", i)
+				}
+			}
+			b.mu.Lock()
+			for elem := b.ll.Front(); elem != nil; elem = elem.Next() {
+				bk := elem.Value.(*bucket)
+				bk.last = bk.last.Add(-tt.age)
+				bk.full = bk.full.Add(-tt.age)
+			}
+			b.mu.Unlock()
+
+			if ok, _ := b.Take("new", limit); !ok {
+				t.Fatal("new bucket is empty")
+			}
+			if got := b.Len(); got != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", got, tt.wantLen)
+			}
+			// an evicted bucket is full again
+			if ok, _ := b.Peek("0", limit); !ok {
+				t.Error("oldest bucket is not evicted")
+			}
+		})
+	}
+}
+
+func TestBucketsEvictLeastRecentlyUsed(t *testing.T) {
+	limit := Limit{Rate: 0.01, Burst: 1}
+	b := NewBuckets()
+	defer b.Close()
+	for i := 0; i < maxBuckets; i++ {
+		b.Take(strconv.Itoa(i), limit)
+	}
+	// a used bucket is moved away from the eviction, even when it is empty
+	b.Take("0", limit)
+	b.Take("new", limit)
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "0", want: false},
+		{key: "1", want: true},
+	}
+	for _, tt := range tests {
+		// the buckets are empty, an evicted bucket is full again
+		if ok, _ := b.Peek(tt.key, limit); ok != tt.want {
+			t.Errorf("Peek(%q) = %t, want %t", tt.key, ok, tt.want)
+		}
+	}
+}
+
+func TestCountersMaxWindows(t *testing.T) {
+	quota := &Quota{Unit: "hour", RequestsPerUnit: 10}
+	c := NewCounters()
+	defer c.Close()
+	for i := 0; i < maxBuckets; i++ {
+		c.Hit(strconv.Itoa(i), quota, 1)
+	}
+	c.Hit("new", quota, 1)
+	if got := c.Len(); got != maxBuckets {
+		t.Errorf("Len() = %d, want %d", got, maxBuckets)
+	}
+}
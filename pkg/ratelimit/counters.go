@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type window struct {
+	key   string
+	end   time.Time
+	count uint32
+}
+
+// Counters are in-memory fixed window counters, they are per authz instance,
+// so with n replicas a client gets up to n times the quota.
+// The windows are kept from the most to the least recently opened
+type Counters struct {
+	mu        sync.Mutex
+	ll        *list.List
+	windows   map[string]*list.Element
+	stopGC    func()
+	closeOnce sync.Once
+}
+
+func NewCounters() *Counters {
+	c := &Counters{ll: list.New(), windows: map[string]*list.Element{}}
+	c.stopGC = every(gcInterval, c.gc)
+	return c
+}
+
+// Close stops the gc of the counters
+func (c *Counters) Close() {
+	c.closeOnce.Do(c.stopGC)
+}
+
+// Hit adds hits to the key counter of the current quota window,
+// it returns the window count and when the window resets
+func (c *Counters) Hit(key string, quota *Quota, hits uint32) (uint32, time.Time) {
+	now := time.Now()
+	size := quota.Window()
+	end := now.Truncate(size).Add(size)
+	key = quota.Unit + "|" + key
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var w *window
+	if elem, ok := c.windows[key]; ok {
+		w = elem.Value.(*window)
+		if !now.Before(w.end) {
+			w.end, w.count = end, 0
+			c.ll.MoveToFront(elem)
+		}
+	} else {
+		if c.ll.Len() >= maxBuckets {
+			c.evictLocked(now)
+		}
+		w = &window{key: key, end: end}
+		c.windows[key] = c.ll.PushFront(w)
+	}
+	w.count += hits
+	return w.count, w.end
+}
+
+func (c *Counters) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *Counters) gc(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gcLocked(now)
+}
+
+func (c *Counters) gcLocked(now time.Time) {
+	for elem := c.ll.Back(); elem != nil; {
+		prev := elem.Prev()
+		if !now.Before(elem.Value.(*window).end) {
+			c.removeLocked(elem)
+		}
+		elem = prev
+	}
+}
+
+// evictLocked drops the least recently opened windows which ended, or the least recently
+// opened one when it is still open, every window is dropped at most once
+func (c *Counters) evictLocked(now time.Time) {
+	for elem := c.ll.Back(); elem != nil && !now.Before(elem.Value.(*window).end); elem = c.ll.Back() {
+		c.removeLocked(elem)
+	}
+	if c.ll.Len() >= maxBuckets {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+func (c *Counters) removeLocked(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.windows, elem.Value.(*window).key)
+}
@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"fmt"
+	"github.com/Dimss/exa/pkg/fswatch"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var units = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// Quota allows RequestsPerUnit requests in each fixed unit window
+type Quota struct {
+	Unit            string `mapstructure:"unit"`
+	RequestsPerUnit uint32 `mapstructure:"requests-per-unit"`
+	// Unlimited stops the lookup of a descriptor, e.g. to exempt a value of a limited key
+	Unlimited bool `mapstructure:"unlimited"`
+}
+
+func (q *Quota) Window() time.Duration {
+	return units[q.Unit]
+}
+
+// Descriptor is a node of the descriptors tree of a domain, the request descriptor
+// entries are matched level by level, a descriptor without value matches every value
+// and counts each value apart, e.g. the sub exa sets in the dynamic metadata
+type Descriptor struct {
+	Key         string        `mapstructure:"key"`
+	Value       string        `mapstructure:"value"`
+	RateLimit   *Quota        `mapstructure:"rate-limit"`
+	Descriptors []*Descriptor `mapstructure:"descriptors"`
+}
+
+func (d *Descriptor) compile() error {
+	if d.Key == "" {
+		return fmt.Errorf("descriptor key is required")
+	}
+	if q := d.RateLimit; q != nil && !q.Unlimited {
+		q.Unit = strings.ToLower(q.Unit)
+		if _, ok := units[q.Unit]; !ok {
+			return fmt.Errorf("descriptor %s: unknown unit %s", d.Key, q.Unit)
+		}
+	}
+	for _, child := range d.Descriptors {
+		if err := child.compile(); err != nil {
+			return fmt.Errorf("descriptor %s: %w", d.Key, err)
+		}
+	}
+	return nil
+}
+
+type Domain struct {
+	Domain      string        `mapstructure:"domain"`
+	Descriptors []*Descriptor `mapstructure:"descriptors"`
+}
+
+// Entry is a key/value pair of a request descriptor
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Config is the compiled descriptors of every domain
+type Config map[string][]*Descriptor
+
+// Lookup returns the quota of the request descriptor, it is set only when
+// every entry is matched and the last matched descriptor has a rate limit
+func (c Config) Lookup(domain string, entries []Entry) *Quota {
+	descriptors := c[domain]
+	var matched *Descriptor
+	for _, entry := range entries {
+		matched = nil
+		for _, d := range descriptors {
+			if d.Key != entry.Key {
+				continue
+			}
+			// exact values win over the catch all descriptor
+			if d.Value == entry.Value {
+				matched = d
+				break
+			}
+			if d.Value == "" && matched == nil {
+				matched = d
+			}
+		}
+		if matched == nil {
+			return nil
+		}
+		descriptors = matched.Descriptors
+	}
+	if matched == nil || matched.RateLimit == nil || matched.RateLimit.Unlimited {
+		return nil
+	}
+	return matched.RateLimit
+}
+
+// LoadConfigFile reads the yaml or json descriptors file with a top level domains list
+func LoadConfigFile(path string) (Config, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var domains []*Domain
+	if err := v.UnmarshalKey("domains", &domains); err != nil {
+		return nil, err
+	}
+	config := Config{}
+	for _, domain := range domains {
+		if domain.Domain == "" {
+			return nil, fmt.Errorf("domain name is required")
+		}
+		if _, ok := config[domain.Domain]; ok {
+			return nil, fmt.Errorf("domain %s is duplicated", domain.Domain)
+		}
+		for _, d := range domain.Descriptors {
+			if err := d.compile(); err != nil {
+				return nil, fmt.Errorf("domain %s: %w", domain.Domain, err)
+			}
+		}
+		config[domain.Domain] = domain.Descriptors
+	}
+	return config, nil
+}
+
+// ConfigTable holds the active descriptors, the file is reloaded on change
+// and swapped atomically, a broken file keeps the previous descriptors
+type ConfigTable struct {
+	path      string
+	config    atomic.Pointer[Config]
+	stopWatch func()
+}
+
+func NewConfigTable(path string) (*ConfigTable, error) {
+	t := &ConfigTable{path: path}
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t.config.Store(&config)
+	if t.stopWatch, err = fswatch.Watch([]string{path}, t.reload); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Close stops the reloads of the file
+func (t *ConfigTable) Close() {
+	t.stopWatch()
+}
+
+func (t *ConfigTable) reload() {
+	config, err := LoadConfigFile(t.path)
+	if err != nil {
+		zap.S().Errorf("failed to reload rate limit descriptors, keeping previous descriptors: %s", err)
+		return
+	}
+	t.config.Store(&config)
+	zap.S().Infof("reloaded rate limit descriptors of %d domains from %s", len(config), t.path)
+}
+
+func (t *ConfigTable) Config() Config {
+	return *t.config.Load()
+}
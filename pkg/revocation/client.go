@@ -0,0 +1,85 @@
+package revocation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to the revocations admin API of a running authz server
+type Client struct {
+	URL  string
+	HTTP *http.Client
+	// Token is the bearer token of the admin API
+	Token string
+}
+
+func NewClient(adminURL string) *Client {
+	return &Client{
+		URL:  strings.TrimSuffix(adminURL, "/"),
+		HTTP: &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+func (c *Client) List() (*Revocations, error) {
+	revocations := &Revocations{}
+	if err := c.do(http.MethodGet, PathPrefix, nil, revocations); err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+func (c *Client) RevokeJTI(jti string, expiresAt time.Time) error {
+	return c.do(http.MethodPut, jtisPath+url.PathEscape(jti), JTIRequest{ExpiresAt: expiresAt}, nil)
+}
+
+func (c *Client) DeleteJTI(jti string) error {
+	return c.do(http.MethodDelete, jtisPath+url.PathEscape(jti), nil, nil)
+}
+
+func (c *Client) RevokeSubject(sub string, before, expiresAt time.Time) error {
+	return c.do(http.MethodPut, subjectsPath+url.PathEscape(sub), SubjectRequest{Before: before, ExpiresAt: expiresAt}, nil)
+}
+
+func (c *Client) DeleteSubject(sub string) error {
+	return c.do(http.MethodDelete, subjectsPath+url.PathEscape(sub), nil, nil)
+}
+
+func (c *Client) do(method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, c.URL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
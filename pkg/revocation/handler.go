@@ -0,0 +1,132 @@
+package revocation
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	PathPrefix   = "/revocations"
+	jtisPath     = PathPrefix + "/jtis/"
+	subjectsPath = PathPrefix + "/subjects/"
+	// DefaultLifetime is the shortest lifetime of a revocation without a known token exp
+	DefaultLifetime = time.Hour * 24
+)
+
+// Revocations is the payload of the revocations admin API
+type Revocations struct {
+	JTIs     map[string]time.Time     `json:"jtis"`
+	Subjects map[string]SubjectCutoff `json:"subjects"`
+}
+
+// JTIRequest revokes a token, ExpiresAt should be the token exp,
+// the store lifetime is used when it is unknown
+type JTIRequest struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SubjectRequest revokes the subject tokens issued before Before,
+// ExpiresAt should be past the exp of the longest living token, Before
+// plus the store lifetime is used when it is unknown
+type SubjectRequest struct {
+	Before    time.Time `json:"before"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Handler serves the revocations admin API:
+//
+//	GET    /revocations
+//	PUT    /revocations/jtis/<jti>
+//	DELETE /revocations/jtis/<jti>
+//	PUT    /revocations/subjects/<sub>
+//	DELETE /revocations/subjects/<sub>
+func (s *Store) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathPrefix, s.listHandler)
+	mux.HandleFunc(jtisPath, s.jtiHandler)
+	mux.HandleFunc(subjectsPath, s.subjectHandler)
+	return mux
+}
+
+func (s *Store) listHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jtis, subjects := s.List()
+	writeJSON(w, http.StatusOK, Revocations{JTIs: jtis, Subjects: subjects})
+}
+
+func (s *Store) jtiHandler(w http.ResponseWriter, r *http.Request) {
+	jti := strings.TrimPrefix(r.URL.Path, jtisPath)
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		req := JTIRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.ExpiresAt.IsZero() {
+			req.ExpiresAt = s.Expiry(time.Now())
+		}
+		err = s.RevokeJTI(jti, req.ExpiresAt)
+	case http.MethodDelete:
+		err = s.DeleteJTI(jti)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Store) subjectHandler(w http.ResponseWriter, r *http.Request) {
+	sub := strings.TrimPrefix(r.URL.Path, subjectsPath)
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		req := SubjectRequest{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Before.IsZero() {
+			req.Before = time.Now()
+		}
+		if req.ExpiresAt.IsZero() {
+			req.ExpiresAt = s.Expiry(req.Before)
+		}
+		err = s.RevokeSubject(sub, req.Before, req.ExpiresAt)
+	case http.MethodDelete:
+		err = s.DeleteSubject(sub)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
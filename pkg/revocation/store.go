@@ -0,0 +1,379 @@
+package revocation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Dimss/exa/pkg/fswatch"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const gcInterval = time.Minute
+
+// SubjectCutoff invalidates every token of the subject issued before Before
+type SubjectCutoff struct {
+	Before    time.Time `json:"before"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type state struct {
+	JTIs     map[string]time.Time     `json:"jtis"`
+	Subjects map[string]SubjectCutoff `json:"subjects"`
+}
+
+// Store is a file backed denylist of token ids (jti) and per subject (sub) cutoffs,
+// every entry is dropped once the tokens it revokes are expired anyway.
+// The file is watched, so replicas sharing it pick up each other's revocations,
+// every change re-reads the file first, concurrent writes may still lose one of them
+type Store struct {
+	mu        sync.RWMutex
+	path      string
+	state     state
+	raw       []byte
+	lifetime  time.Duration
+	listeners map[int]func()
+	nextID    int
+	stopWatch func()
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewStore loads the store from path and watches it, an empty path keeps the store in memory only
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:      path,
+		lifetime:  DefaultLifetime,
+		listeners: map[int]func(){},
+		done:      make(chan struct{}),
+		state: state{
+			JTIs:     map[string]time.Time{},
+			Subjects: map[string]SubjectCutoff{},
+		},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		stop, err := fswatch.Watch([]string{path}, s.reload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+		s.stopWatch = stop
+	}
+	go s.gc()
+	return s, nil
+}
+
+// Close stops the file watch and the gc
+func (s *Store) Close() {
+	s.closeOnce.Do(func() {
+		if s.stopWatch != nil {
+			s.stopWatch()
+		}
+		close(s.done)
+	})
+}
+
+// Path returns the file the revocations are persisted in, empty when they are kept in memory only
+func (s *Store) Path() string {
+	return s.path
+}
+
+// SetLifetime sets how long the revocations without a known token exp are kept,
+// it should cover the max token age, it is never shorter than DefaultLifetime
+func (s *Store) SetLifetime(lifetime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lifetime = max(lifetime, DefaultLifetime)
+}
+
+// Expiry returns when a revocation made at from without a known token exp is dropped
+func (s *Store) Expiry(from time.Time) time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return from.Add(s.lifetime)
+}
+
+// OnChange registers a callback invoked after every revocation change,
+// the returned function unregisters it
+func (s *Store) OnChange(listener func()) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.listeners[id] = listener
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.listeners, id)
+	}
+}
+
+// snapshotListeners returns the registered callbacks, they are called without the lock.
+// must be called with the lock held
+func (s *Store) snapshotListeners() []func() {
+	listeners := make([]func(), 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// RevokeJTI revokes a single token until its expiry
+func (s *Store) RevokeJTI(jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return errors.New("jti is required")
+	}
+	return s.update(func(st *state) {
+		st.JTIs[jti] = expiresAt
+	})
+}
+
+// RevokeSubject revokes every token of sub issued before the cutoff
+func (s *Store) RevokeSubject(sub string, before, expiresAt time.Time) error {
+	if sub == "" {
+		return errors.New("sub is required")
+	}
+	return s.update(func(st *state) {
+		st.Subjects[sub] = SubjectCutoff{Before: before, ExpiresAt: expiresAt}
+	})
+}
+
+func (s *Store) DeleteJTI(jti string) error {
+	return s.update(func(st *state) {
+		delete(st.JTIs, jti)
+	})
+}
+
+func (s *Store) DeleteSubject(sub string) error {
+	return s.update(func(st *state) {
+		delete(st.Subjects, sub)
+	})
+}
+
+// JTIRevoked reports whether the token id is in the denylist, the revocation
+// is kept until exp when the token outlives the expiry it was revoked with
+func (s *Store) JTIRevoked(jti string, exp *time.Time) bool {
+	if jti == "" {
+		return false
+	}
+	s.mu.RLock()
+	expiresAt, ok := s.state.JTIs[jti]
+	s.mu.RUnlock()
+	if ok && exp != nil && exp.After(expiresAt) {
+		s.extendJTI(jti, *exp)
+	}
+	return ok
+}
+
+func (s *Store) extendJTI(jti string, exp time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		zap.S().Errorf("failed to read revocations: %s", err)
+	}
+	expiresAt, ok := s.state.JTIs[jti]
+	if !ok || !exp.After(expiresAt) {
+		return
+	}
+	s.state.JTIs[jti] = exp
+	if err := s.save(); err != nil {
+		zap.S().Errorf("failed to save revocations: %s", err)
+	}
+}
+
+// SubjectRevoked reports whether a token of sub issued at iat is past the subject cutoff,
+// tokens without iat can't be proven to be newer than the cutoff. The cutoff is kept until
+// exp when a revoked token outlives it
+func (s *Store) SubjectRevoked(sub string, iat, exp *time.Time) bool {
+	if sub == "" {
+		return false
+	}
+	s.mu.RLock()
+	cutoff, ok := s.state.Subjects[sub]
+	s.mu.RUnlock()
+	if !ok || (iat != nil && !iat.Before(cutoff.Before)) {
+		return false
+	}
+	if exp != nil && exp.After(cutoff.ExpiresAt) {
+		s.extendSubject(sub, *exp)
+	}
+	return true
+}
+
+func (s *Store) extendSubject(sub string, exp time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		zap.S().Errorf("failed to read revocations: %s", err)
+	}
+	cutoff, ok := s.state.Subjects[sub]
+	if !ok || !exp.After(cutoff.ExpiresAt) {
+		return
+	}
+	cutoff.ExpiresAt = exp
+	s.state.Subjects[sub] = cutoff
+	if err := s.save(); err != nil {
+		zap.S().Errorf("failed to save revocations: %s", err)
+	}
+}
+
+// List returns a copy of the current revocations
+func (s *Store) List() (jtis map[string]time.Time, subjects map[string]SubjectCutoff) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jtis = make(map[string]time.Time, len(s.state.JTIs))
+	for k, v := range s.state.JTIs {
+		jtis[k] = v
+	}
+	subjects = make(map[string]SubjectCutoff, len(s.state.Subjects))
+	for k, v := range s.state.Subjects {
+		subjects[k] = v
+	}
+	return
+}
+
+func (s *Store) update(fn func(st *state)) error {
+	s.mu.Lock()
+	if err := s.load(); err != nil {
+		zap.S().Errorf("failed to read revocations, updating the loaded ones: %s", err)
+	}
+	fn(&s.state)
+	err := s.save()
+	listeners := s.snapshotListeners()
+	s.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener()
+	}
+	return err
+}
+
+// load replaces the state with the file content when it changed since the last load or save,
+// a missing file keeps the state. must be called with the lock held
+func (s *Store) load() error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(raw, s.raw) {
+		return nil
+	}
+	st := state{}
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return err
+	}
+	if st.JTIs == nil {
+		st.JTIs = map[string]time.Time{}
+	}
+	if st.Subjects == nil {
+		st.Subjects = map[string]SubjectCutoff{}
+	}
+	s.state = st
+	s.raw = raw
+	return nil
+}
+
+// reload loads the file after a change, a broken file keeps the previous revocations
+func (s *Store) reload() {
+	s.mu.Lock()
+	prev := s.raw
+	err := s.load()
+	changed := !bytes.Equal(prev, s.raw)
+	listeners := s.snapshotListeners()
+	s.mu.Unlock()
+
+	if err != nil {
+		zap.S().Errorf("failed to reload revocations from %s, keeping the previous ones: %s", s.path, err)
+		return
+	}
+	if !changed {
+		return
+	}
+	zap.S().Infof("reloaded revocations from %s", s.path)
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+// save writes the state to a temp file and renames it, so a crash never leaves a partial file.
+// must be called with the lock held
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".revocations-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.raw = raw
+	return nil
+}
+
+// gc drops the expired entries until the store is closed
+func (s *Store) gc() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.collect(time.Now())
+	}
+}
+
+// collect drops the revocations expired at now
+func (s *Store) collect(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		zap.S().Errorf("failed to read revocations: %s", err)
+	}
+	removed := 0
+	for jti, expiresAt := range s.state.JTIs {
+		if now.After(expiresAt) {
+			delete(s.state.JTIs, jti)
+			removed++
+		}
+	}
+	for sub, cutoff := range s.state.Subjects {
+		if now.After(cutoff.ExpiresAt) {
+			delete(s.state.Subjects, sub)
+			removed++
+		}
+	}
+	if removed > 0 {
+		if err := s.save(); err != nil {
+			zap.S().Errorf("failed to save revocations: %s", err)
+		}
+		zap.S().Infof("dropped %d expired revocations", removed)
+	}
+}
@@ -0,0 +1,245 @@
+package revocation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStoreLifetime(t *testing.T) {
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{name: "unset", lifetime: 0, want: DefaultLifetime},
+		{name: "shorter than the default", lifetime: time.Hour, want: DefaultLifetime},
+		{name: "max token age", lifetime: time.Hour * 24 * 30, want: time.Hour * 24 * 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStore("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetLifetime(tt.lifetime)
+			now := time.Now()
+			if got := s.Expiry(now).Sub(now); got != tt.want {
+				t.Errorf("Expiry() = now+%s, want now+%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreJTIRevoked(t *testing.T) {
+	revokedUntil := time.Now().Add(time.Hour)
+	later := revokedUntil.Add(time.Hour * 24 * 7)
+	earlier := revokedUntil.Add(-time.Minute)
+	tests := []struct {
+		name       string
+		jti        string
+		exp        *time.Time
+		want       bool
+		wantExpiry time.Time
+	}{
+		{name: "revoked without exp", jti: "a", want: true, wantExpiry: revokedUntil},
+		{name: "exp extends the revocation", jti: "a", exp: &later, want: true, wantExpiry: later},
+		{name: "earlier exp keeps the revocation", jti: "a", exp: &earlier, want: true, wantExpiry: revokedUntil},
+		{name: "not revoked", jti: "b", exp: &later, want: false},
+		{name: "empty jti", jti: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStore("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RevokeJTI("a", revokedUntil); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.JTIRevoked(tt.jti, tt.exp); got != tt.want {
+				t.Fatalf("JTIRevoked(%q) = %t, want %t", tt.jti, got, tt.want)
+			}
+			jtis, _ := s.List()
+			if got := jtis[tt.jti]; tt.want && !got.Equal(tt.wantExpiry) {
+				t.Errorf("revocation expires at %s, want %s", got, tt.wantExpiry)
+			}
+		})
+	}
+}
+
+func TestStoreSubjectRevoked(t *testing.T) {
+	before := time.Now()
+	revokedUntil := before.Add(time.Hour)
+	later := revokedUntil.Add(time.Hour * 24 * 7)
+	earlier := before.Add(-time.Minute)
+	tests := []struct {
+		name string
+		sub  string
+		iat  *time.Time
+		exp  *time.Time
+		want bool
+		// wantAfterGC is whether the token is still revoked once gc ran past the revocation
+		wantAfterGC bool
+	}{
+		{name: "revoked without exp", sub: "alice", iat: &earlier, want: true},
+		{name: "exp extends the cutoff past gc", sub: "alice", iat: &earlier, exp: &later, want: true, wantAfterGC: true},
+		{name: "without iat", sub: "alice", exp: &later, want: true, wantAfterGC: true},
+		{name: "issued after the cutoff", sub: "alice", iat: &revokedUntil, exp: &later, want: false},
+		{name: "not revoked", sub: "bob", iat: &earlier, exp: &later, want: false},
+		{name: "empty sub", sub: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStore("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RevokeSubject("alice", before, revokedUntil); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.SubjectRevoked(tt.sub, tt.iat, tt.exp); got != tt.want {
+				t.Fatalf("SubjectRevoked(%q) = %t, want %t", tt.sub, got, tt.want)
+			}
+			s.collect(revokedUntil.Add(time.Minute))
+			if got := s.SubjectRevoked(tt.sub, tt.iat, tt.exp); got != tt.wantAfterGC {
+				t.Errorf("SubjectRevoked(%q) after gc = %t, want %t", tt.sub, got, tt.wantAfterGC)
+			}
+		})
+	}
+}
+
+func TestHandlerDefaultExpiry(t *testing.T) {
+	lifetime := time.Hour * 24 * 30
+	before := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		path string
+		body string
+		// want returns the expected expiry from the store content, now is the time of the request
+		want func(now time.Time) time.Time
+		got  func(s *Store) time.Time
+	}{
+		{
+			name: "jti without expiry",
+			path: jtisPath + "a",
+			want: func(now time.Time) time.Time { return now.Add(lifetime) },
+			got:  func(s *Store) time.Time { jtis, _ := s.List(); return jtis["a"] },
+		},
+		{
+			name: "jti with expiry",
+			path: jtisPath + "a",
+			body: `{"expiresAt":"2024-06-01T00:00:00Z"}`,
+			want: func(time.Time) time.Time { return expiresAt },
+			got:  func(s *Store) time.Time { jtis, _ := s.List(); return jtis["a"] },
+		},
+		{
+			name: "subject without expiry",
+			path: subjectsPath + "alice",
+			body: `{"before":"2024-01-01T00:00:00Z"}`,
+			want: func(time.Time) time.Time { return before.Add(lifetime) },
+			got:  func(s *Store) time.Time { _, subjects := s.List(); return subjects["alice"].ExpiresAt },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStore("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetLifetime(lifetime)
+			req := httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			now := time.Now()
+			s.Handler().ServeHTTP(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+			}
+			got, want := tt.got(s), tt.want(now)
+			if d := got.Sub(want); d < 0 || d > time.Second {
+				t.Errorf("revocation expires at %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestStoreFile(t *testing.T) {
+	exp := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name string
+		// write changes the file like another replica would
+		write       string
+		wantJTIs    []string
+		wantChanges int32
+	}{
+		{name: "revocation of another replica", write: `{"jtis":{"b":"` + exp + `"}}`, wantJTIs: []string{"b"}, wantChanges: 1},
+		{name: "broken file keeps the revocations", write: `{"jtis":`, wantJTIs: []string{"a"}, wantChanges: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "revocations.json")
+			s, err := NewStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if err := s.RevokeJTI("a", time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			var changes atomic.Int32
+			s.OnChange(func() { changes.Add(1) })
+			// the own write of the store is not a change
+			time.Sleep(time.Second)
+
+			if err := os.WriteFile(path, []byte(tt.write), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Second)
+			if got := changes.Load(); got != tt.wantChanges {
+				t.Errorf("changes = %d, want %d", got, tt.wantChanges)
+			}
+			jtis, _ := s.List()
+			if len(jtis) != len(tt.wantJTIs) {
+				t.Fatalf("jtis = %v, want %v", jtis, tt.wantJTIs)
+			}
+			for _, jti := range tt.wantJTIs {
+				if !s.JTIRevoked(jti, nil) {
+					t.Errorf("%s is not revoked", jti)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreUpdateMergesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	exp := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	// written by another replica, before the watch of this one fires
+	if err := os.WriteFile(path, []byte(`{"jtis":{"b":"`+exp+`"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeJTI("a", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	for _, jti := range []string{"a", "b"} {
+		if !reloaded.JTIRevoked(jti, nil) {
+			t.Errorf("%s is not revoked", jti)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CORS is the cross-origin policy of a route. Origins are exact
+// (scheme://host[:port]), * or scheme://*.<domain> wildcards,
+// empty methods allow every method and * in headers allows every request header.
+type CORS struct {
+	AllowOrigins     []string      `mapstructure:"allow-origins"`
+	AllowMethods     []string      `mapstructure:"allow-methods"`
+	AllowHeaders     []string      `mapstructure:"allow-headers"`
+	ExposeHeaders    []string      `mapstructure:"expose-headers"`
+	AllowCredentials bool          `mapstructure:"allow-credentials"`
+	MaxAge           time.Duration `mapstructure:"max-age"`
+}
+
+func (c *CORS) compile() error {
+	if len(c.AllowOrigins) == 0 {
+		return fmt.Errorf("cors: allow-origins is required")
+	}
+	if err := compileOrigins(c.AllowOrigins); err != nil {
+		return fmt.Errorf("cors: %w", err)
+	}
+	if c.AnyOrigin() && c.AllowCredentials {
+		return fmt.Errorf("cors: the * origin can't be used with allow-credentials")
+	}
+	for i, method := range c.AllowMethods {
+		c.AllowMethods[i] = strings.ToUpper(method)
+	}
+	for i, header := range c.AllowHeaders {
+		c.AllowHeaders[i] = strings.ToLower(header)
+	}
+	return nil
+}
+
+// AnyOrigin reports whether the policy allows every origin without credentials,
+// so the allow origin response header can be * and cached across origins
+func (c *CORS) AnyOrigin() bool {
+	return contains(c.AllowOrigins, "*")
+}
+
+func (c *CORS) OriginAllowed(origin string) bool {
+	return originAllowed(c.AllowOrigins, origin)
+}
+
+func (c *CORS) MethodAllowed(method string) bool {
+	return len(c.AllowMethods) == 0 || contains(c.AllowMethods, strings.ToUpper(method))
+}
+
+// HeadersAllowed checks the comma separated Access-Control-Request-Headers of a preflight
+func (c *CORS) HeadersAllowed(requestHeaders string) bool {
+	if contains(c.AllowHeaders, "*") {
+		return true
+	}
+	for _, header := range strings.Split(requestHeaders, ",") {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if header != "" && !contains(c.AllowHeaders, header) {
+			return false
+		}
+	}
+	return true
+}
+
+// compileOrigins normalizes the origins in place and validates the wildcards
+func compileOrigins(origins []string) error {
+	for i, origin := range origins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		if origin != "*" && strings.Contains(origin, "*") && !strings.Contains(origin, "://*.") {
+			return fmt.Errorf("invalid origin %s, only scheme://*.<domain> wildcards are supported", origin)
+		}
+		origins[i] = origin
+	}
+	return nil
+}
+
+func originAllowed(origins []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	// opaque origins (sandboxed iframes, file://) are never allowed
+	if origin == "" || origin == "null" {
+		return false
+	}
+	for _, o := range origins {
+		if o == "*" || o == origin {
+			return true
+		}
+		if i := strings.Index(o, "://*."); i >= 0 && strings.HasPrefix(origin, o[:i+3]) {
+			host := origin[i+3:]
+			if !strings.ContainsAny(host, "/?#@") && strings.HasSuffix(host, o[i+4:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package routes
+
+import "testing"
+
+func TestCORSCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		cors    CORS
+		wantErr bool
+	}{
+		{name: "exact origin", cors: CORS{AllowOrigins: []string{"https://app.example.com"}}},
+		{name: "wildcard subdomain", cors: CORS{AllowOrigins: []string{"https://*.example.com"}, AllowCredentials: true}},
+		{name: "any origin", cors: CORS{AllowOrigins: []string{"*"}}},
+		{name: "no origins", cors: CORS{}, wantErr: true},
+		{name: "any origin with credentials", cors: CORS{AllowOrigins: []string{"*"}, AllowCredentials: true}, wantErr: true},
+		{name: "unsupported wildcard", cors: CORS{AllowOrigins: []string{"https://app.*.com"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cors.compile(); (err != nil) != tt.wantErr {
+				t.Errorf("compile() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCORSOriginAllowed(t *testing.T) {
+	cors := &CORS{AllowOrigins: []string{"https://App.example.com/", "https://*.apps.example.com"}}
+	if err := cors.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "https://app.example.com", want: true},
+		{origin: "HTTPS://APP.EXAMPLE.COM", want: true},
+		{origin: "http://app.example.com", want: false},
+		{origin: "https://app.example.com:8443", want: false},
+		{origin: "https://nb.apps.example.com", want: true},
+		{origin: "https://a.b.apps.example.com", want: true},
+		{origin: "https://apps.example.com", want: false},
+		{origin: "https://evilapps.example.com", want: false},
+		{origin: "https://nb.apps.example.com.evil.com", want: false},
+		{origin: "https://evil.com/.apps.example.com", want: false},
+		{origin: "https://user@nb.apps.example.com", want: false},
+		{origin: "null", want: false},
+		{origin: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if got := cors.OriginAllowed(tt.origin); got != tt.want {
+				t.Errorf("OriginAllowed(%q) = %t, want %t", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSMethodsAndHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		cors        CORS
+		method      string
+		headers     string
+		wantMethod  bool
+		wantHeaders bool
+	}{
+		{name: "any method", cors: CORS{}, method: "PATCH", wantMethod: true, wantHeaders: true},
+		{name: "listed method", cors: CORS{AllowMethods: []string{"get", "post"}}, method: "post", wantMethod: true, wantHeaders: true},
+		{name: "unlisted method", cors: CORS{AllowMethods: []string{"GET"}}, method: "DELETE", wantMethod: false, wantHeaders: true},
+		{name: "listed headers", cors: CORS{AllowHeaders: []string{"Content-Type", "X-Request-Id"}}, method: "GET", headers: "content-type, x-request-id", wantMethod: true, wantHeaders: true},
+		{name: "unlisted header", cors: CORS{AllowHeaders: []string{"Content-Type"}}, method: "GET", headers: "content-type, authorization", wantMethod: true, wantHeaders: false},
+		{name: "any header", cors: CORS{AllowHeaders: []string{"*"}}, method: "GET", headers: "authorization", wantMethod: true, wantHeaders: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cors.AllowOrigins = []string{"https://app.example.com"}
+			if err := tt.cors.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.cors.MethodAllowed(tt.method); got != tt.wantMethod {
+				t.Errorf("MethodAllowed(%q) = %t, want %t", tt.method, got, tt.wantMethod)
+			}
+			if got := tt.cors.HeadersAllowed(tt.headers); got != tt.wantHeaders {
+				t.Errorf("HeadersAllowed(%q) = %t, want %t", tt.headers, got, tt.wantHeaders)
+			}
+		})
+	}
+}
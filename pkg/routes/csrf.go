@@ -0,0 +1,51 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultCSRFCookieName = "exa-csrf"
+	defaultCSRFHeaderName = "x-csrf-token"
+)
+
+// CSRF protects cookie authenticated unsafe requests. The Origin (or Referer)
+// must be the request host or one of the allowed origins, with DoubleSubmit
+// the CSRF cookie set on safe requests must also be echoed in the CSRF header.
+type CSRF struct {
+	AllowOrigins []string `mapstructure:"allow-origins"`
+	DoubleSubmit bool     `mapstructure:"double-submit"`
+	CookieName   string   `mapstructure:"cookie-name"`
+	HeaderName   string   `mapstructure:"header-name"`
+}
+
+func (c *CSRF) compile() error {
+	if err := compileOrigins(c.AllowOrigins); err != nil {
+		return fmt.Errorf("csrf: %w", err)
+	}
+	if contains(c.AllowOrigins, "*") {
+		return fmt.Errorf("csrf: the * origin disables the protection")
+	}
+	if c.CookieName == "" {
+		c.CookieName = defaultCSRFCookieName
+	}
+	if c.HeaderName == "" {
+		c.HeaderName = defaultCSRFHeaderName
+	}
+	c.HeaderName = strings.ToLower(c.HeaderName)
+	return nil
+}
+
+func (c *CSRF) OriginAllowed(origin string) bool {
+	return originAllowed(c.AllowOrigins, origin)
+}
+
+// SafeMethod reports whether the method is read only per RFC 9110, section 9.2.1
+func SafeMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
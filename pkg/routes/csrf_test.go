@@ -0,0 +1,41 @@
+package routes
+
+import "testing"
+
+func TestCSRFCompile(t *testing.T) {
+	tests := []struct {
+		name       string
+		csrf       CSRF
+		wantCookie string
+		wantHeader string
+		wantErr    bool
+	}{
+		{name: "defaults", wantCookie: defaultCSRFCookieName, wantHeader: defaultCSRFHeaderName},
+		{name: "custom names", csrf: CSRF{CookieName: "xsrf", HeaderName: "X-XSRF-Token"}, wantCookie: "xsrf", wantHeader: "x-xsrf-token"},
+		{name: "any origin", csrf: CSRF{AllowOrigins: []string{"*"}}, wantErr: true},
+		{name: "unsupported wildcard", csrf: CSRF{AllowOrigins: []string{"https://a*.example.com"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.csrf.compile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compile() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.csrf.CookieName != tt.wantCookie || tt.csrf.HeaderName != tt.wantHeader {
+				t.Errorf("names = %s, %s, want %s, %s", tt.csrf.CookieName, tt.csrf.HeaderName, tt.wantCookie, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestSafeMethod(t *testing.T) {
+	tests := map[string]bool{"GET": true, "head": true, "OPTIONS": true, "TRACE": true, "POST": false, "PUT": false, "PATCH": false, "DELETE": false}
+	for method, want := range tests {
+		if got := SafeMethod(method); got != want {
+			t.Errorf("SafeMethod(%q) = %t, want %t", method, got, want)
+		}
+	}
+}
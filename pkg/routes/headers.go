@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// ResponseHeader is a header exa asks envoy to add to the upstream response,
+// the value is a text/template rendered with HeaderData
+type ResponseHeader struct {
+	Name string `mapstructure:"name"`
+	// Value is e.g. "max-age=31536000; includeSubDomains" or "default-src 'self' {{ .Host }}"
+	Value string `mapstructure:"value"`
+	// Overwrite replaces the header set by the upstream, by default the upstream header is kept
+	Overwrite bool `mapstructure:"overwrite"`
+
+	tmpl *template.Template
+}
+
+// HeaderData is the template data of the response headers
+type HeaderData struct {
+	// Identity holds the identity headers of the request, it is empty on anonymous requests
+	Identity  map[string]string
+	Host      string
+	Method    string
+	Path      string
+	Scheme    string
+	RequestID string
+}
+
+func (h *ResponseHeader) compile() error {
+	if h.Name == "" {
+		return fmt.Errorf("response header name is required")
+	}
+	h.Name = http.CanonicalHeaderKey(h.Name)
+	tmpl, err := template.New(h.Name).Option("missingkey=zero").Parse(h.Value)
+	if err != nil {
+		return fmt.Errorf("response header %s: %w", h.Name, err)
+	}
+	h.tmpl = tmpl
+	return nil
+}
+
+// Render executes the value template, values with line breaks are rejected,
+// identity attributes come from the token and could otherwise inject headers
+func (h *ResponseHeader) Render(data HeaderData) (string, error) {
+	var value bytes.Buffer
+	if err := h.tmpl.Execute(&value, data); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(value.String(), "\r\n") {
+		return "", fmt.Errorf("response header %s value contains a line break", h.Name)
+	}
+	return value.String(), nil
+}
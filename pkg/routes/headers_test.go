@@ -0,0 +1,66 @@
+package routes
+
+import "testing"
+
+func TestResponseHeaderRender(t *testing.T) {
+	data := HeaderData{
+		Identity:  map[string]string{"kubeflow-userid": "jane@example.com", "x-evil": "a\r\nSet-Cookie: x=y"},
+		Host:      "kubeflow.example.com",
+		Method:    "GET",
+		Path:      "/pipelines",
+		Scheme:    "https",
+		RequestID: "req-1",
+	}
+	tests := []struct {
+		name    string
+		header  ResponseHeader
+		want    string
+		wantErr bool
+	}{
+		{name: "static value", header: ResponseHeader{Name: "strict-transport-security", Value: "max-age=31536000; includeSubDomains"}, want: "max-age=31536000; includeSubDomains"},
+		{name: "request attributes", header: ResponseHeader{Name: "content-security-policy", Value: "default-src 'self' {{ .Scheme }}://{{ .Host }}"}, want: "default-src 'self' https://kubeflow.example.com"},
+		{name: "identity", header: ResponseHeader{Name: "x-user", Value: `{{ index .Identity "kubeflow-userid" }}`}, want: "jane@example.com"},
+		{name: "missing identity", header: ResponseHeader{Name: "x-user", Value: `{{ index .Identity "x-missing" }}`}, want: ""},
+		{name: "request id", header: ResponseHeader{Name: "x-request-id", Value: "{{ .RequestID }}"}, want: "req-1"},
+		{name: "line break in an identity", header: ResponseHeader{Name: "x-user", Value: `{{ index .Identity "x-evil" }}`}, wantErr: true},
+		{name: "line break in the template", header: ResponseHeader{Name: "x-user", Value: "a\nb"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.header.compile(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.header.Render(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Render() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseHeaderCompile(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   ResponseHeader
+		wantName string
+		wantErr  bool
+	}{
+		{name: "canonical name", header: ResponseHeader{Name: "x-frame-options", Value: "DENY"}, wantName: "X-Frame-Options"},
+		{name: "missing name", header: ResponseHeader{Value: "DENY"}, wantErr: true},
+		{name: "invalid template", header: ResponseHeader{Name: "x-user", Value: "{{ .Host"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.header.compile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compile() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && tt.header.Name != tt.wantName {
+				t.Errorf("Name = %q, want %q", tt.header.Name, tt.wantName)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Match selects requests by host, method and path. Hosts are exact
+// or *.<domain> wildcards, the path is a regex anchored at both ends.
+// Empty fields match everything.
+type Match struct {
+	Hosts   []string `mapstructure:"hosts"`
+	Methods []string `mapstructure:"methods"`
+	Path    string   `mapstructure:"path"`
+
+	pathRegex *regexp.Regexp
+}
+
+// Compile validates the match and compiles the path regex, it must be called before Matches
+func (m *Match) Compile() error {
+	for i, method := range m.Methods {
+		m.Methods[i] = strings.ToUpper(method)
+	}
+	for i, host := range m.Hosts {
+		if err := validHost(host); err != nil {
+			return err
+		}
+		m.Hosts[i] = strings.ToLower(host)
+	}
+	if m.Path == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + m.Path + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid path %s: %w", m.Path, err)
+	}
+	m.pathRegex = re
+	return nil
+}
+
+// Matches reports whether the request matches, the path may include the query string.
+// The path is normalized first (see NormalizePath), a path which can't be normalized
+// matches no path regex, the request gets the default rule then
+func (m *Match) Matches(host, method, path string) bool {
+	if len(m.Methods) > 0 && !contains(m.Methods, strings.ToUpper(method)) {
+		return false
+	}
+	if len(m.Hosts) > 0 && !m.hostMatches(host) {
+		return false
+	}
+	if m.pathRegex != nil {
+		normalized, ok := NormalizePath(path)
+		if !ok || !m.pathRegex.MatchString(normalized) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Match) hostMatches(host string) bool {
+	host = canonicalHost(host)
+	for _, h := range m.Hosts {
+		if hostMatches(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func validHost(host string) error {
+	if strings.Contains(host, "*") && !strings.HasPrefix(host, "*.") {
+		return fmt.Errorf("invalid host %s, only *.<domain> wildcards are supported", host)
+	}
+	return nil
+}
+
+// canonicalHost returns the lower cased host without port
+func canonicalHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// hostMatches reports whether the canonical host matches an exact or *.<domain> pattern
+func hostMatches(pattern, host string) bool {
+	return pattern == host || strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])
+}
+
+// StripQuery returns the path without the query string and fragment
+func StripQuery(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+// NormalizePath returns the path the upstream resolves, ex: /dex/%2e%2e//notebook is
+// /notebook. The query is stripped, the escaped unreserved characters are decoded, the
+// dot segments and duplicate slashes are removed and a trailing slash is kept. Paths
+// with escaped slashes, backslashes or invalid escapes are rejected since the upstreams
+// disagree on what they resolve to.
+func NormalizePath(p string) (string, bool) {
+	p = StripQuery(p)
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '\\' {
+			return "", false
+		}
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(p) {
+			return "", false
+		}
+		v, err := strconv.ParseUint(p[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		switch d := byte(v); {
+		case d == '/' || d == '\\':
+			return "", false
+		case unreserved(d):
+			b.WriteByte(d)
+		default:
+			b.WriteString(strings.ToUpper(p[i : i+3]))
+		}
+		i += 2
+	}
+	normalized := path.Clean("/" + b.String())
+	if strings.HasSuffix(b.String(), "/") && normalized != "/" {
+		normalized += "/"
+	}
+	return normalized, true
+}
+
+// unreserved reports whether the character is an RFC 3986 unreserved character
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
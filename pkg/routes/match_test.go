@@ -0,0 +1,105 @@
+package routes
+
+import "testing"
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path   string
+		want   string
+		wantOK bool
+	}{
+		{path: "/notebook/x", want: "/notebook/x", wantOK: true},
+		{path: "", want: "/", wantOK: true},
+		{path: "/", want: "/", wantOK: true},
+		{path: "/dex/", want: "/dex/", wantOK: true},
+		{path: "/dex?next=/notebook", want: "/dex", wantOK: true},
+		{path: "/dex/../notebook/x", want: "/notebook/x", wantOK: true},
+		{path: "/dex/./keys", want: "/dex/keys", wantOK: true},
+		{path: "//dex/..", want: "/", wantOK: true},
+		{path: "//dex//keys", want: "/dex/keys", wantOK: true},
+		{path: "/dex/%2e%2e/notebook/x", want: "/notebook/x", wantOK: true},
+		{path: "/dex/%2E%2E/notebook/x", want: "/notebook/x", wantOK: true},
+		{path: "/dex/.%2e/notebook/x", want: "/notebook/x", wantOK: true},
+		{path: "/%64ex/keys", want: "/dex/keys", wantOK: true},
+		{path: "/a%20b", want: "/a%20b", wantOK: true},
+		{path: "/a%3fb", want: "/a%3Fb", wantOK: true},
+		{path: "/dex/..%2fnotebook", wantOK: false},
+		{path: "/dex/..%2Fnotebook", wantOK: false},
+		{path: "/dex/..%5cnotebook", wantOK: false},
+		{path: "/dex\\..\\notebook", wantOK: false},
+		{path: "/dex/%zz", wantOK: false},
+		{path: "/dex/%2", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := NormalizePath(tt.path)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("NormalizePath(%q) = %q, %t, want %q, %t", tt.path, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRulesMatch(t *testing.T) {
+	rules, err := CompileRules(append(DefaultRules(),
+		&Rule{Name: "api", Match: Match{Hosts: []string{"*.example.com"}, Methods: []string{"get"}, Path: "/api/.*"}, Auth: AuthOptional},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		host   string
+		method string
+		path   string
+		want   string
+	}{
+		{name: "public dex", path: "/dex/keys", want: "dex"},
+		{name: "public dex root", path: "/dex", want: "dex"},
+		{name: "public dex with query", path: "/dex/auth?client_id=x", want: "dex"},
+		{name: "dot segments out of dex", path: "/dex/../notebook/x", want: "default"},
+		{name: "encoded dot segments out of dex", path: "/dex/%2e%2e/notebook/x", want: "default"},
+		{name: "double slash dot segments", path: "//dex/..", want: "default"},
+		{name: "encoded slash", path: "/dex/..%2fnotebook", want: "default"},
+		{name: "dot segments into dex", path: "/notebook/../dex/keys", want: "dex"},
+		{name: "sso login", path: "/dex-login", want: "dex-login"},
+		{name: "protected", path: "/notebook/x", want: "default"},
+		{name: "wildcard host", host: "app.example.com:443", method: "GET", path: "/api/v1", want: "api"},
+		{name: "wildcard host case", host: "APP.Example.com", method: "get", path: "/api/v1", want: "api"},
+		{name: "other host", host: "example.org", method: "GET", path: "/api/v1", want: "default"},
+		{name: "apex is not a wildcard match", host: "example.com", method: "GET", path: "/api/v1", want: "default"},
+		{name: "other method", host: "app.example.com", method: "POST", path: "/api/v1", want: "default"},
+		{name: "anchored path", host: "app.example.com", method: "GET", path: "/v2/api/v1", want: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			if got := rules.Match(tt.host, method, tt.path).Name; got != tt.want {
+				t.Errorf("Match(%q, %q, %q) = %s, want %s", tt.host, method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		match   Match
+		wantErr bool
+	}{
+		{name: "empty", match: Match{}},
+		{name: "wildcard host", match: Match{Hosts: []string{"*.example.com"}}},
+		{name: "inner wildcard host", match: Match{Hosts: []string{"app.*.com"}}, wantErr: true},
+		{name: "invalid path regex", match: Match{Path: "/api/("}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.match.Compile(); (err != nil) != tt.wantErr {
+				t.Errorf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
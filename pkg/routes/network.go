@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Network filters requests by the client address, deny wins over allow and
+// an empty allow list allows every address. Inside the trusted networks the
+// rule auth mode is replaced with TrustedAuth, e.g. public on the VPN range,
+// TrustedAuth is required with trusted networks.
+type Network struct {
+	Allow       []string `mapstructure:"allow"`
+	Deny        []string `mapstructure:"deny"`
+	Trusted     []string `mapstructure:"trusted"`
+	TrustedAuth AuthMode `mapstructure:"trusted-auth"`
+
+	allow, deny, trusted CIDRs
+}
+
+func (n *Network) Compile() (err error) {
+	if n.allow, err = ParseCIDRs(n.Allow); err != nil {
+		return fmt.Errorf("network allow: %w", err)
+	}
+	if n.deny, err = ParseCIDRs(n.Deny); err != nil {
+		return fmt.Errorf("network deny: %w", err)
+	}
+	if n.trusted, err = ParseCIDRs(n.Trusted); err != nil {
+		return fmt.Errorf("network trusted: %w", err)
+	}
+	switch n.TrustedAuth {
+	case AuthPublic, AuthOptional, AuthRequired:
+	case "":
+		if len(n.trusted) > 0 {
+			return fmt.Errorf("network: trusted networks require trusted-auth")
+		}
+	default:
+		return fmt.Errorf("network: unknown trusted auth mode %s", n.TrustedAuth)
+	}
+	return nil
+}
+
+// Allowed reports whether the client may reach the route, an unknown
+// address is allowed only when there is neither an allow nor a deny list
+func (n *Network) Allowed(ip netip.Addr) bool {
+	if n == nil {
+		return true
+	}
+	if !ip.IsValid() {
+		return len(n.allow) == 0 && len(n.deny) == 0
+	}
+	if n.deny.Contains(ip) {
+		return false
+	}
+	return len(n.allow) == 0 || n.allow.Contains(ip)
+}
+
+func (n *Network) IsTrusted(ip netip.Addr) bool {
+	return n != nil && n.trusted.Contains(ip)
+}
+
+// CIDRs is a list of networks, a single address is a /32 or /128 network
+type CIDRs []netip.Prefix
+
+func ParseCIDRs(list []string) (CIDRs, error) {
+	var cidrs CIDRs
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			cidrs = append(cidrs, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, prefix.Masked())
+	}
+	return cidrs, nil
+}
+
+func (c CIDRs) Contains(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range c {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestNetworkAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		network *Network
+		ip      string
+		want    bool
+	}{
+		{name: "no network", network: nil, ip: "1.1.1.1", want: true},
+		{name: "empty lists", network: &Network{}, ip: "1.1.1.1", want: true},
+		{name: "denied", network: &Network{Deny: []string{"1.1.1.0/24"}}, ip: "1.1.1.1", want: false},
+		{name: "not denied", network: &Network{Deny: []string{"1.1.1.0/24"}}, ip: "2.2.2.2", want: true},
+		{name: "allowed", network: &Network{Allow: []string{"10.0.0.0/8"}}, ip: "10.1.2.3", want: true},
+		{name: "not allowed", network: &Network{Allow: []string{"10.0.0.0/8"}}, ip: "1.1.1.1", want: false},
+		{name: "deny wins over allow", network: &Network{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}}, ip: "10.0.0.1", want: false},
+		{name: "single ipv6 address", network: &Network{Deny: []string{"2001:db8::1"}}, ip: "2001:db8::1", want: false},
+		{name: "mapped ipv4 address", network: &Network{Deny: []string{"1.1.1.1"}}, ip: "::ffff:1.1.1.1", want: false},
+		{name: "unknown address without lists", network: &Network{}, ip: "", want: true},
+		{name: "unknown address with a deny list", network: &Network{Deny: []string{"1.1.1.0/24"}}, ip: "", want: false},
+		{name: "unknown address with an allow list", network: &Network{Allow: []string{"10.0.0.0/8"}}, ip: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.network != nil {
+				if err := tt.network.Compile(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var ip netip.Addr
+			if tt.ip != "" {
+				ip = netip.MustParseAddr(tt.ip)
+			}
+			if got := tt.network.Allowed(ip); got != tt.want {
+				t.Errorf("Allowed(%s) = %t, want %t", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		network Network
+		wantErr bool
+	}{
+		{name: "lists", network: Network{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}}},
+		{name: "invalid cidr", network: Network{Allow: []string{"10.0.0.0/33"}}, wantErr: true},
+		{name: "invalid address", network: Network{Deny: []string{"not-an-ip"}}, wantErr: true},
+		{name: "trusted with auth", network: Network{Trusted: []string{"10.8.0.0/16"}, TrustedAuth: AuthOptional}},
+		{name: "trusted without auth", network: Network{Trusted: []string{"10.8.0.0/16"}}, wantErr: true},
+		{name: "unknown trusted auth", network: Network{Trusted: []string{"10.8.0.0/16"}, TrustedAuth: "none"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.network.Compile(); (err != nil) != tt.wantErr {
+				t.Errorf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNetworkTrusted(t *testing.T) {
+	n := &Network{Trusted: []string{"10.8.0.0/16"}, TrustedAuth: AuthOptional}
+	if err := n.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !n.IsTrusted(netip.MustParseAddr("10.8.1.1")) {
+		t.Error("10.8.1.1 not trusted")
+	}
+	if n.IsTrusted(netip.MustParseAddr("10.9.1.1")) {
+		t.Error("10.9.1.1 trusted")
+	}
+	if n.IsTrusted(netip.Addr{}) {
+		t.Error("unknown address trusted")
+	}
+}
@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/Dimss/exa/pkg/fswatch"
+	"github.com/Dimss/exa/pkg/ratelimit"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"net/netip"
+	"sync/atomic"
+)
+
+type AuthMode string
+
+const (
+	// AuthPublic skips the authentication
+	AuthPublic AuthMode = "public"
+	// AuthOptional authenticates when there is a token, the request is allowed anonymously otherwise
+	AuthOptional AuthMode = "optional"
+	// AuthRequired denies requests without a valid token
+	AuthRequired AuthMode = "required"
+)
+
+// Rule sets the policy of the matching requests
+type Rule struct {
+	Name    string `mapstructure:"name"`
+	Match   `mapstructure:",squash"`
+	Auth    AuthMode `mapstructure:"auth"`
+	CORS    *CORS    `mapstructure:"cors"`
+	CSRF    *CSRF    `mapstructure:"csrf"`
+	Network *Network `mapstructure:"network"`
+	// AuditOnly overrides the global audit only mode on the route
+	AuditOnly *bool `mapstructure:"audit-only"`
+	// RateLimit overrides the identity rate limit on the route
+	RateLimit *ratelimit.Limit `mapstructure:"rate-limit"`
+	// ResponseHeaders are added to the responses of allowed requests, e.g. HSTS or CSP
+	ResponseHeaders []*ResponseHeader `mapstructure:"response-headers"`
+	// TokenSources override the global token sources on the route, see ParseTokenSource
+	TokenSources []string `mapstructure:"token-sources"`
+
+	tokenSources []TokenSource
+	hits         atomic.Uint64
+}
+
+// AuthFor returns the auth mode of a client, it is relaxed inside the trusted networks
+func (r *Rule) AuthFor(ip netip.Addr) AuthMode {
+	if r.Network.IsTrusted(ip) {
+		return r.Network.TrustedAuth
+	}
+	return r.Auth
+}
+
+// TokenSourcesOr returns the token sources of the rule, or defaults when it has none
+func (r *Rule) TokenSourcesOr(defaults []TokenSource) []TokenSource {
+	if len(r.tokenSources) > 0 {
+		return r.tokenSources
+	}
+	return defaults
+}
+
+// Hit counts a request matched by the rule
+func (r *Rule) Hit() {
+	r.hits.Add(1)
+}
+
+func (r *Rule) Hits() uint64 {
+	return r.hits.Load()
+}
+
+func (r *Rule) compile() error {
+	if err := r.Match.Compile(); err != nil {
+		return fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+	switch r.Auth {
+	case AuthPublic, AuthOptional, AuthRequired:
+	case "":
+		r.Auth = AuthRequired
+	default:
+		return fmt.Errorf("rule %s: unknown auth mode %s", r.Name, r.Auth)
+	}
+	if r.CORS != nil {
+		if err := r.CORS.compile(); err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	if r.CSRF != nil {
+		if err := r.CSRF.compile(); err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	if r.Network != nil {
+		if err := r.Network.Compile(); err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	for _, h := range r.ResponseHeaders {
+		if err := h.compile(); err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	sources, err := ParseTokenSources(r.TokenSources)
+	if err != nil {
+		return fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+	r.tokenSources = sources
+	return nil
+}
+
+// defaultRule applies to requests no rule matches
+var defaultRule = &Rule{Name: "default", Auth: AuthRequired}
+
+// DefaultRules are used when no route rules file is set, the sso login
+// endpoints must be public or the redirect to them would loop
+func DefaultRules() []*Rule {
+	return []*Rule{
+		{Name: "centralsso-login", Match: Match{Path: "/centralsso/dex-login"}, Auth: AuthPublic},
+		{Name: "dex-login", Match: Match{Path: "/dex-login"}, Auth: AuthPublic},
+		{Name: "dex", Match: Match{Path: "/dex(/.*)?"}, Auth: AuthPublic},
+	}
+}
+
+// Rules is an ordered list of compiled rules, the first matching rule wins
+type Rules []*Rule
+
+func CompileRules(rules []*Rule) (Rules, error) {
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func (rules Rules) Match(host, method, path string) *Rule {
+	for _, r := range rules {
+		if r.Matches(host, method, path) {
+			return r
+		}
+	}
+	return defaultRule
+}
+
+// LoadRulesFile reads the rules from a yaml or json file with a top level rules list
+func LoadRulesFile(path string) (Rules, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var rules []*Rule
+	if err := v.UnmarshalKey("rules", &rules); err != nil {
+		return nil, err
+	}
+	return CompileRules(rules)
+}
+
+// Table holds the active rules, the rules file is reloaded on change
+// and swapped atomically, a broken file keeps the previous rules
+type Table struct {
+	path      string
+	rules     atomic.Pointer[Rules]
+	stopWatch func()
+}
+
+func NewTable(path string) (*Table, error) {
+	t := &Table{path: path}
+	if path == "" {
+		rules, err := CompileRules(DefaultRules())
+		if err != nil {
+			return nil, err
+		}
+		t.rules.Store(&rules)
+		return t, nil
+	}
+	rules, err := LoadRulesFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t.rules.Store(&rules)
+	if t.stopWatch, err = fswatch.Watch([]string{path}, t.reload); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Close stops the reloads of the rules file
+func (t *Table) Close() {
+	if t.stopWatch != nil {
+		t.stopWatch()
+	}
+}
+
+// NewRulesTable holds compiled rules which aren't loaded from a file, e.g. the rules of the config file
+func NewRulesTable(rules Rules) *Table {
+	t := &Table{}
+	t.rules.Store(&rules)
+	return t
+}
+
+func (t *Table) reload() {
+	rules, err := LoadRulesFile(t.path)
+	if err != nil {
+		zap.S().Errorf("failed to reload route rules, keeping previous rules: %s", err)
+		return
+	}
+	t.rules.Store(&rules)
+	zap.S().Infof("reloaded %d route rules from %s", len(rules), t.path)
+}
+
+// Match returns the first rule matching the request, or the default required-auth rule
+func (t *Table) Match(host, method, path string) *Rule {
+	rule := t.Rules().Match(host, method, path)
+	rule.Hit()
+	return rule
+}
+
+func (t *Table) Rules() Rules {
+	return *t.rules.Load()
+}
@@ -0,0 +1,93 @@
+package routes
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// OtherPath is the label of the paths no template matches
+	OtherPath = "other"
+	// OtherHost is the label of the hosts no metrics host matches
+	OtherHost = "other"
+)
+
+var templateParam = regexp.MustCompile(`\{[^/{}]+\}`)
+
+type pathTemplate struct {
+	template string
+	re       *regexp.Regexp
+}
+
+// PathTemplates normalize the request paths into a bounded set of metric labels,
+// {name} matches a single path segment and a trailing * matches the rest of the path,
+// e.g. /notebook/{ns}/{name}/*
+type PathTemplates []pathTemplate
+
+func CompilePathTemplates(templates []string) (PathTemplates, error) {
+	var compiled PathTemplates
+	for _, t := range templates {
+		if !strings.HasPrefix(t, "/") {
+			return nil, fmt.Errorf("path template %s must start with /", t)
+		}
+		pattern, wildcard := strings.CutSuffix(t, "*")
+		if strings.Contains(pattern, "*") {
+			return nil, fmt.Errorf("path template %s: * is only allowed at the end", t)
+		}
+		var expr strings.Builder
+		last := 0
+		for _, loc := range templateParam.FindAllStringIndex(pattern, -1) {
+			expr.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+			expr.WriteString("[^/]+")
+			last = loc[1]
+		}
+		expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+		if wildcard {
+			expr.WriteString(".*")
+		}
+		re, err := regexp.Compile("^" + expr.String() + "$")
+		if err != nil {
+			return nil, fmt.Errorf("path template %s: %w", t, err)
+		}
+		compiled = append(compiled, pathTemplate{template: t, re: re})
+	}
+	return compiled, nil
+}
+
+// Normalize returns the first template matching the path, or OtherPath
+func (t PathTemplates) Normalize(path string) string {
+	path = StripQuery(path)
+	for _, tmpl := range t {
+		if tmpl.re.MatchString(path) {
+			return tmpl.template
+		}
+	}
+	return OtherPath
+}
+
+// HostLabels normalize the request hosts into a bounded set of metric labels, a host is
+// labeled with the first exact or *.<domain> entry it matches, e.g. *.example.com
+type HostLabels []string
+
+func CompileHostLabels(hosts []string) (HostLabels, error) {
+	var labels HostLabels
+	for _, host := range hosts {
+		if err := validHost(host); err != nil {
+			return nil, err
+		}
+		labels = append(labels, strings.ToLower(host))
+	}
+	return labels, nil
+}
+
+// Normalize returns the first entry matching the host, or OtherHost
+func (h HostLabels) Normalize(host string) string {
+	host = canonicalHost(host)
+	for _, label := range h {
+		if hostMatches(label, host) {
+			return label
+		}
+	}
+	return OtherHost
+}
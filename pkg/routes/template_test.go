@@ -0,0 +1,58 @@
+package routes
+
+import "testing"
+
+func TestPathTemplatesNormalize(t *testing.T) {
+	templates, err := CompilePathTemplates([]string{"/notebook/{ns}/{name}/*", "/api/v1/users/{id}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"/notebook/team-a/nb1/lab/tree": "/notebook/{ns}/{name}/*",
+		"/notebook/team-a/nb1/":         "/notebook/{ns}/{name}/*",
+		"/api/v1/users/42":              "/api/v1/users/{id}",
+		"/api/v1/users/42?fields=name":  "/api/v1/users/{id}",
+		"/api/v1/users/42/roles":        OtherPath,
+		"/api/v1/users/":                OtherPath,
+		"/random/path":                  OtherPath,
+	}
+	for path, want := range tests {
+		if got := templates.Normalize(path); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestCompilePathTemplates(t *testing.T) {
+	for _, invalid := range [][]string{{"notebook/{ns}"}, {"/notebook/*/x"}} {
+		if _, err := CompilePathTemplates(invalid); err == nil {
+			t.Errorf("CompilePathTemplates(%v) succeeded", invalid)
+		}
+	}
+}
+
+func TestHostLabelsNormalize(t *testing.T) {
+	hosts, err := CompileHostLabels([]string{"kubeflow.example.com", "*.apps.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"kubeflow.example.com":       "kubeflow.example.com",
+		"Kubeflow.Example.com:443":   "kubeflow.example.com",
+		"nb.apps.example.com":        "*.apps.example.com",
+		"apps.example.com":           OtherHost,
+		"attacker-12345.example.com": OtherHost,
+		"":                           OtherHost,
+	}
+	for host, want := range tests {
+		if got := hosts.Normalize(host); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", host, got, want)
+		}
+	}
+	if got := HostLabels(nil).Normalize("kubeflow.example.com"); got != OtherHost {
+		t.Errorf("Normalize() without hosts = %q, want %q", got, OtherHost)
+	}
+	if _, err := CompileHostLabels([]string{"app.*.com"}); err == nil {
+		t.Error("CompileHostLabels() accepted an inner wildcard")
+	}
+}
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	HeaderTokenSource            = "header"
+	CookieTokenSource            = "cookie"
+	QueryTokenSource             = "query"
+	WebsocketProtocolTokenSource = "websocket-protocol"
+
+	// the kubernetes convention for passing a bearer token to websockets
+	defaultWebsocketProtocolPrefix = "base64url.bearer.authorization.k8s.io."
+)
+
+// TokenSource is a location of the token in the request, parsed from
+//
+//	header:<name>[:<scheme>]    ex: header:authorization:Bearer
+//	cookie:<name>               chunked <name>_0, <name>_1, ... cookies are joined
+//	query:<param>               websocket upgrade requests only
+//	websocket-protocol[:<prefix>] base64url token in Sec-WebSocket-Protocol
+type TokenSource struct {
+	Kind   string
+	Name   string
+	Scheme string
+}
+
+func (ts TokenSource) String() string {
+	s := ts.Kind
+	if ts.Name != "" {
+		s += ":" + ts.Name
+	}
+	if ts.Scheme != "" {
+		s += ":" + ts.Scheme
+	}
+	return s
+}
+
+func ParseTokenSource(spec string) (TokenSource, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	ts := TokenSource{Kind: parts[0]}
+	if len(parts) > 1 {
+		ts.Name = parts[1]
+	}
+	switch ts.Kind {
+	case HeaderTokenSource:
+		ts.Name = strings.ToLower(ts.Name)
+		if len(parts) > 2 {
+			ts.Scheme = parts[2]
+		}
+	case CookieTokenSource, QueryTokenSource:
+		if len(parts) > 2 {
+			return ts, fmt.Errorf("invalid token source %s", spec)
+		}
+	case WebsocketProtocolTokenSource:
+		ts.Name = strings.Join(parts[1:], ":")
+		if ts.Name == "" {
+			ts.Name = defaultWebsocketProtocolPrefix
+		}
+		return ts, nil
+	default:
+		return ts, fmt.Errorf("unknown token source type %s", ts.Kind)
+	}
+	if ts.Name == "" {
+		return ts, fmt.Errorf("token source %s requires a name", spec)
+	}
+	return ts, nil
+}
+
+func ParseTokenSources(specs []string) ([]TokenSource, error) {
+	var sources []TokenSource
+	for _, spec := range specs {
+		ts, err := ParseTokenSource(spec)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, ts)
+	}
+	return sources, nil
+}
@@ -0,0 +1,74 @@
+package routes
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTokenSource(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    TokenSource
+		wantErr bool
+	}{
+		{spec: "header:Authorization", want: TokenSource{Kind: HeaderTokenSource, Name: "authorization"}},
+		{spec: "header:authorization:Bearer", want: TokenSource{Kind: HeaderTokenSource, Name: "authorization", Scheme: "Bearer"}},
+		{spec: "cookie:authservice_session", want: TokenSource{Kind: CookieTokenSource, Name: "authservice_session"}},
+		{spec: "query:access_token", want: TokenSource{Kind: QueryTokenSource, Name: "access_token"}},
+		{spec: "websocket-protocol", want: TokenSource{Kind: WebsocketProtocolTokenSource, Name: defaultWebsocketProtocolPrefix}},
+		{spec: "websocket-protocol:bearer.", want: TokenSource{Kind: WebsocketProtocolTokenSource, Name: "bearer."}},
+		{spec: "websocket-protocol:a:b", want: TokenSource{Kind: WebsocketProtocolTokenSource, Name: "a:b"}},
+		{spec: "header", wantErr: true},
+		{spec: "cookie:", wantErr: true},
+		{spec: "cookie:a:b", wantErr: true},
+		{spec: "query:a:b", wantErr: true},
+		{spec: "body:token", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseTokenSource(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTokenSource(%q) error = %v, wantErr %t", tt.spec, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseTokenSource(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleTokenSources(t *testing.T) {
+	defaults := []TokenSource{{Kind: CookieTokenSource, Name: "session"}}
+	tests := []struct {
+		name    string
+		sources []string
+		want    []TokenSource
+		wantErr bool
+	}{
+		{name: "global sources", want: defaults},
+		{
+			name:    "route sources",
+			sources: []string{"header:authorization:Bearer", "query:token"},
+			want: []TokenSource{
+				{Kind: HeaderTokenSource, Name: "authorization", Scheme: "Bearer"},
+				{Kind: QueryTokenSource, Name: "token"},
+			},
+		},
+		{name: "invalid source", sources: []string{"body:token"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &Rule{Name: tt.name, Match: Match{Path: "/api/.*"}, TokenSources: tt.sources}
+			_, err := CompileRules([]*Rule{rule})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompileRules() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := rule.TokenSourcesOr(defaults); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TokenSourcesOr() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
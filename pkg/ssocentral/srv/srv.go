@@ -4,10 +4,15 @@ import (
 	"context"
 	"fmt"
 	"github.com/Dimss/exa/pkg/ssocentral/ui"
+	"github.com/Dimss/exa/pkg/tlsutil"
+	"github.com/Dimss/exa/pkg/tracing"
 	limit "github.com/aviddiviner/gin-limit"
 	"github.com/coreos/go-oidc"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 	"io/fs"
@@ -19,6 +24,8 @@ import (
 var (
 	bg    = ""
 	title = ""
+	// oidcClient is used for the discovery, jwks and token exchange requests
+	oidcClient *http.Client
 )
 
 func Run(addr, bgColor, t string) {
@@ -37,9 +44,9 @@ func Run(addr, bgColor, t string) {
 
 	r.GET("/index.html", centralHandler)
 
-	r.GET("/dex-login", dexLogin)
+	r.GET("/dex-login", traced("sso.login", dexLogin))
 
-	r.GET("/dex-callback", dexCallback)
+	r.GET("/dex-callback", traced("sso.callback", dexCallback))
 
 	if err := r.Run(addr); err != nil {
 		log.Fatal(err)
@@ -55,9 +62,48 @@ func dexIssuerUrl() string {
 
 }
 
-func oidcSetup() (*oidc.IDTokenVerifier, oauth2.Config) {
-	ctx := context.Background()
-	provider, err := oidc.NewProvider(ctx, dexIssuerUrl())
+// traced runs the handler in a server span continuing the trace of the request
+func traced(name string, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, span := tracing.Tracer().Start(tracing.ExtractHTTP(c.Request.Context(), c.Request.Header), name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(c.FullPath()),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		handler(c)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(c.Writer.Status()))
+	}
+}
+
+// InitOIDCClient builds the http client of the oidc provider requests,
+// it must be called before Run, a broken tls or proxy setting fails the startup
+func InitOIDCClient() error {
+	cfg := tlsutil.ClientConfig{
+		CAFiles:            viper.GetStringSlice("tls-ca-files"),
+		CertFile:           viper.GetString("tls-client-cert"),
+		KeyFile:            viper.GetString("tls-client-key"),
+		ServerName:         viper.GetString("tls-server-name"),
+		ProxyURL:           viper.GetString("proxy-url"),
+		InsecureSkipVerify: viper.GetBool("insecure-skip-verify"),
+	}
+	client, err := cfg.HTTPClient()
+	if err != nil {
+		return fmt.Errorf("failed to configure the oidc http client: %w", err)
+	}
+	oidcClient = tracing.WrapClient("oidc.request", client)
+	return nil
+}
+
+// oidcContext returns a context carrying the oidc http client
+func oidcContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, oidcClient)
+}
+
+func oidcSetup(ctx context.Context) (*oidc.IDTokenVerifier, oauth2.Config) {
+	provider, err := oidc.NewProvider(oidcContext(ctx), dexIssuerUrl())
 
 	if err != nil {
 		fmt.Println(err)
@@ -84,7 +130,7 @@ func oidcSetup() (*oidc.IDTokenVerifier, oauth2.Config) {
 }
 
 func dexLogin(c *gin.Context) {
-	_, oauth2Config := oidcSetup()
+	_, oauth2Config := oidcSetup(c.Request.Context())
 	c.Redirect(http.StatusFound, oauth2Config.AuthCodeURL("foo-bar"))
 }
 
@@ -93,9 +139,9 @@ func dexCallback(c *gin.Context) {
 		err   error
 		token *oauth2.Token
 	)
-	verifier, oauth2Config := oidcSetup()
+	verifier, oauth2Config := oidcSetup(c.Request.Context())
 	code := c.Request.FormValue("code")
-	token, err = oauth2Config.Exchange(context.Background(), code)
+	token, err = exchange(c.Request.Context(), oauth2Config, code)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -121,14 +167,14 @@ func dexCallback(c *gin.Context) {
 	c.Request.Header.Add("raw-id-token", rawIDToken)
 	c.Request.Header.Add("access-token", accessToken)
 
-	provider, err := oidc.NewProvider(context.Background(), dexIssuerUrl())
+	provider, err := oidc.NewProvider(oidcContext(c.Request.Context()), dexIssuerUrl())
 
 	if err != nil {
 		fmt.Println(err)
 	}
 
 	idTokenVerifier := provider.Verifier(&oidc.Config{ClientID: "example-app"})
-	verifiedIdToken, err := idTokenVerifier.Verify(context.Background(), rawIDToken)
+	verifiedIdToken, err := idTokenVerifier.Verify(oidcContext(c.Request.Context()), rawIDToken)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -144,6 +190,18 @@ func dexCallback(c *gin.Context) {
 	c.Redirect(http.StatusFound, viper.GetString("base-url"))
 }
 
+// exchange redeems the authorization code for the tokens in a span
+func exchange(ctx context.Context, oauth2Config oauth2.Config, code string) (*oauth2.Token, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "sso.token_exchange")
+	defer span.End()
+	token, err := oauth2Config.Exchange(oidcContext(ctx), code)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "token exchange failed")
+	}
+	return token, err
+}
+
 func centralHandler(c *gin.Context) {
 	c.Data(http.StatusOK, "text/html", ui.NewCentral(title, bg, c.Request.Header).Parse())
 }
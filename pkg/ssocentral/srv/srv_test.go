@@ -0,0 +1,35 @@
+package srv
+
+import (
+	"github.com/spf13/viper"
+	"testing"
+)
+
+func TestInitOIDCClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		wantErr  bool
+	}{
+		{name: "defaults", settings: map[string]interface{}{}},
+		{name: "proxy", settings: map[string]interface{}{"proxy-url": "http://proxy:3128"}},
+		{name: "missing ca file", settings: map[string]interface{}{"tls-ca-files": []string{"/nonexistent/ca.pem"}}, wantErr: true},
+		{name: "client cert without key", settings: map[string]interface{}{"tls-client-cert": "/nonexistent/tls.crt"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+			oidcClient = nil
+			for key, value := range tt.settings {
+				viper.Set(key, value)
+			}
+			err := InitOIDCClient()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InitOIDCClient() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && oidcClient == nil {
+				t.Error("oidc client is not set")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ClientConfig holds the trust settings for an outbound HTTPS client,
+// e.g. a JWKS endpoint or an OIDC provider
+type ClientConfig struct {
+	CAFiles            []string `mapstructure:"ca-files"`
+	CertFile           string   `mapstructure:"cert-file"`
+	KeyFile            string   `mapstructure:"key-file"`
+	ServerName         string   `mapstructure:"server-name"`
+	ProxyURL           string   `mapstructure:"proxy-url"`
+	InsecureSkipVerify bool     `mapstructure:"insecure-skip-verify"`
+}
+
+// WithDefaults returns a copy of the config where every unset field
+// is taken from defaults. InsecureSkipVerify can only be turned on, never off.
+func (c ClientConfig) WithDefaults(defaults ClientConfig) ClientConfig {
+	if len(c.CAFiles) == 0 {
+		c.CAFiles = defaults.CAFiles
+	}
+	if c.CertFile == "" && c.KeyFile == "" {
+		c.CertFile = defaults.CertFile
+		c.KeyFile = defaults.KeyFile
+	}
+	if c.ServerName == "" {
+		c.ServerName = defaults.ServerName
+	}
+	if c.ProxyURL == "" {
+		c.ProxyURL = defaults.ProxyURL
+	}
+	c.InsecureSkipVerify = c.InsecureSkipVerify || defaults.InsecureSkipVerify
+	return c
+}
+
+func (c ClientConfig) TLSConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if len(c.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err := appendCAFiles(pool, c.CAFiles); err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("both client cert and client key must be set")
+		}
+		// load the key pair on every handshake, so rotated certificates are picked up
+		if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load client key pair: %w", err)
+		}
+		certFile, keyFile := c.CertFile, c.KeyFile
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+
+	return tlsCfg, nil
+}
+
+func (c ClientConfig) HTTPClient() (*http.Client, error) {
+	tlsCfg, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	if c.ProxyURL != "" {
+		proxyURL, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+func appendCAFiles(pool *x509.CertPool, caFiles []string) error {
+	for _, caFile := range caFiles {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read ca file %s: %w", caFile, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in ca file %s", caFile)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/Dimss/exa/pkg/fswatch"
+	"go.uber.org/zap"
+	"strings"
+	"sync/atomic"
+)
+
+// ServerConfig holds the settings of an inbound TLS listener,
+// client certificates are required when client CA files are set
+type ServerConfig struct {
+	CertFile      string   `mapstructure:"cert-file"`
+	KeyFile       string   `mapstructure:"key-file"`
+	ClientCAFiles []string `mapstructure:"client-ca-files"`
+	// AllowedClients are the SANs (dns names, uris, emails or ips) of the accepted client
+	// certificates, ex: spiffe://cluster.local/ns/istio-system/sa/gateway, a trailing *
+	// matches any suffix. Every verified client is accepted when empty
+	AllowedClients []string `mapstructure:"allowed-clients"`
+}
+
+func (c ServerConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// ClientAuth reports whether the listener verifies client certificates
+func (c ServerConfig) ClientAuth() bool {
+	return c.Enabled() && len(c.ClientCAFiles) > 0
+}
+
+// TLSConfig returns the listener config, the key pair and the client CAs are reloaded
+// whenever their files change, e.g. cert-manager rotating a mounted secret, a broken
+// rotation keeps the previous certificates. The ClientAuth of the returned config may be
+// changed by the caller, it is read on every handshake
+func (c ServerConfig) TLSConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("both server cert and server key must be set")
+	}
+	if len(c.AllowedClients) > 0 && len(c.ClientCAFiles) == 0 {
+		return nil, fmt.Errorf("allowed clients require client ca files")
+	}
+	r := &reloader{cfg: c}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	if _, err := fswatch.Watch(append([]string{c.CertFile, c.KeyFile}, c.ClientCAFiles...), r.reload); err != nil {
+		return nil, fmt.Errorf("failed to watch the server certificates: %w", err)
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(c.ClientCAFiles) > 0 {
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsCfg.VerifyPeerCertificate = c.verifyClient
+	}
+	tlsCfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		state := r.state.Load()
+		connCfg := tlsCfg.Clone()
+		connCfg.GetConfigForClient = nil
+		connCfg.Certificates = []tls.Certificate{*state.cert}
+		connCfg.ClientCAs = state.clientCAs
+		return connCfg, nil
+	}
+	return tlsCfg, nil
+}
+
+// verifyClient checks the verified client certificate against the allowed clients,
+// there is no certificate to check when the clients may authenticate otherwise
+func (c ServerConfig) verifyClient(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(c.AllowedClients) == 0 || len(verifiedChains) == 0 {
+		return nil
+	}
+	leaf := verifiedChains[0][0]
+	for _, san := range sans(leaf) {
+		if allowedClient(c.AllowedClients, san) {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate %s is not allowed", leaf.Subject)
+}
+
+func sans(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+func allowedClient(allowed []string, san string) bool {
+	for _, a := range allowed {
+		if prefix, ok := strings.CutSuffix(a, "*"); ok && strings.HasPrefix(san, prefix) {
+			return true
+		}
+		if a == san {
+			return true
+		}
+	}
+	return false
+}
+
+type serverState struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// reloader holds the last valid key pair and client CAs of a listener
+type reloader struct {
+	cfg   ServerConfig
+	state atomic.Pointer[serverState]
+}
+
+func (r *reloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load server key pair: %w", err)
+	}
+	state := &serverState{cert: &cert}
+	if len(r.cfg.ClientCAFiles) > 0 {
+		state.clientCAs = x509.NewCertPool()
+		if err := appendCAFiles(state.clientCAs, r.cfg.ClientCAFiles); err != nil {
+			return err
+		}
+	}
+	r.state.Store(state)
+	return nil
+}
+
+func (r *reloader) reload() {
+	if err := r.load(); err != nil {
+		zap.S().Errorf("failed to reload the server certificates of %s, keeping the previous ones: %s", r.cfg.CertFile, err)
+		return
+	}
+	zap.S().Infof("reloaded the server certificates of %s", r.cfg.CertFile)
+}
@@ -0,0 +1,81 @@
+package validator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/Dimss/exa/pkg/options"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// cacheKey hashes the token with the request attributes the verification depends on,
+// the host and the client certificate of certificate-bound tokens
+func (v *OAuth2Validator) cacheKey(token string) string {
+	h := sha256.New()
+	h.Write([]byte(token))
+	h.Write([]byte{0})
+	h.Write([]byte(v.request.Attributes.GetRequest().GetHttp().GetHost()))
+	h.Write([]byte{0})
+	h.Write([]byte(v.request.Attributes.GetSource().GetCertificate()))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (v *OAuth2Validator) cachedToken(ctx context.Context, key string) bool {
+	if v.opts.DecisionCache == nil {
+		return false
+	}
+	cached, ok := v.opts.DecisionCache.Get(key)
+	if !ok {
+		return false
+	}
+	v.claims = cached.Claims
+	v.issuer = cached.Issuer
+	trace.SpanFromContext(ctx).AddEvent("decision cache hit")
+	v.evaluateShadowPolicy(ctx, cached.Header, cached.Claims, cached.Issuer, true)
+	v.log.Debug("token verified from the decision cache")
+	return true
+}
+
+// cacheGeneration returns the generation of the decision cache, it is read before the
+// revocations check so a token revoked meanwhile is not cached
+func (v *OAuth2Validator) cacheGeneration() uint64 {
+	if v.opts.DecisionCache == nil {
+		return 0
+	}
+	return v.opts.DecisionCache.Generation()
+}
+
+// cacheToken caches the verified token, never past its exp or max age,
+// DPoP-bound tokens aren't cached since every request carries a new proof.
+// The token is dropped when the cache was purged since generation
+func (v *OAuth2Validator) cacheToken(key string, header map[string]interface{}, generation uint64) {
+	if v.opts.DecisionCache == nil {
+		return
+	}
+	if cnf, ok := v.claims["cnf"].(map[string]interface{}); ok && cnf["jkt"] != nil {
+		return
+	}
+
+	expiresAt := time.Now().Add(v.opts.DecisionCacheTTL)
+	if exp, err := timeClaim(v.claims, "exp"); err == nil && exp != nil && exp.Before(expiresAt) {
+		expiresAt = *exp
+	}
+	policy := v.opts.TokenPolicy
+	if v.issuer != nil {
+		policy = v.issuer.Policy()
+	}
+	if iat, err := timeClaim(v.claims, "iat"); err == nil && iat != nil && policy.MaxAge > 0 {
+		if maxAge := iat.Add(policy.MaxAge); maxAge.Before(expiresAt) {
+			expiresAt = maxAge
+		}
+	}
+	if !expiresAt.After(time.Now()) {
+		return
+	}
+
+	cached := &options.CachedToken{Claims: v.claims, Header: header, Issuer: v.issuer}
+	if !v.opts.DecisionCache.AddIfGeneration(key, cached, expiresAt, generation) {
+		v.log.Debug("decision cache was purged during the verification, the token is not cached")
+	}
+}
@@ -0,0 +1,88 @@
+package validator
+
+import (
+	"github.com/Dimss/exa/pkg/cache"
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/revocation"
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestCacheToken(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		maxAge time.Duration
+		want   bool
+	}{
+		{name: "valid token", claims: jwt.MapClaims{"exp": float64(now.Add(time.Hour).Unix())}, want: true},
+		{name: "expired token", claims: jwt.MapClaims{"exp": float64(now.Add(-time.Minute).Unix())}, want: false},
+		{name: "token past its max age", claims: jwt.MapClaims{"iat": float64(now.Add(-time.Hour).Unix())}, maxAge: time.Minute, want: false},
+		{name: "token within its max age", claims: jwt.MapClaims{"iat": float64(now.Unix())}, maxAge: time.Hour, want: true},
+		{name: "dpop bound token", claims: jwt.MapClaims{"cnf": map[string]interface{}{"jkt": "abc"}}, want: false},
+		{name: "certificate bound token", claims: jwt.MapClaims{"cnf": map[string]interface{}{"x5t#S256": "abc"}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &options.Options{
+				DecisionCache:    cache.NewLRU[*options.CachedToken](10),
+				DecisionCacheTTL: time.Minute * 5,
+				TokenPolicy:      options.TokenPolicy{MaxAge: tt.maxAge},
+			}
+			v := &OAuth2Validator{opts: opts, claims: tt.claims, log: zap.NewNop()}
+			v.cacheToken("key", nil, v.cacheGeneration())
+			if _, ok := opts.DecisionCache.Get("key"); ok != tt.want {
+				t.Errorf("cached = %t, want %t", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheTokenRevokedDuringVerification(t *testing.T) {
+	exp := time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		// revoke revokes the token between the revocations check and the cache add
+		revoke bool
+		want   bool
+	}{
+		{name: "not revoked", revoke: false, want: true},
+		{name: "revoked after the check", revoke: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocations, err := revocation.NewStore("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer revocations.Close()
+			opts := &options.Options{
+				DecisionCache:    cache.NewLRU[*options.CachedToken](10),
+				DecisionCacheTTL: time.Minute * 5,
+				Revocations:      revocations,
+			}
+			revocations.OnChange(opts.DecisionCache.Purge)
+			v := &OAuth2Validator{
+				opts:   opts,
+				claims: jwt.MapClaims{"jti": "a", "exp": float64(exp.Unix())},
+				log:    zap.NewNop(),
+			}
+			generation := v.cacheGeneration()
+			if v.revoked() {
+				t.Fatal("token is revoked before the revocation")
+			}
+			if tt.revoke {
+				if err := revocations.RevokeJTI("a", exp); err != nil {
+					t.Fatal(err)
+				}
+			}
+			v.cacheToken("key", nil, generation)
+			if _, ok := opts.DecisionCache.Get("key"); ok != tt.want {
+				t.Errorf("cached = %t, want %t", ok, tt.want)
+			}
+		})
+	}
+}
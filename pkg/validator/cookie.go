@@ -0,0 +1,39 @@
+package validator
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseCookies parses a Cookie header per RFC 6265, on duplicated names the first one wins
+func parseCookies(cookieHeader string) map[string]string {
+	cookies := map[string]string{}
+	if cookieHeader == "" {
+		return cookies
+	}
+	req := http.Request{Header: http.Header{"Cookie": {cookieHeader}}}
+	for _, cookie := range req.Cookies() {
+		if _, ok := cookies[cookie.Name]; !ok {
+			cookies[cookie.Name] = cookie.Value
+		}
+	}
+	return cookies
+}
+
+// cookieValue returns the value of the named cookie, a cookie split
+// into <name>_0, <name>_1, ... chunks (oauth2-proxy style) is joined back
+func cookieValue(cookies map[string]string, name string) string {
+	if value, ok := cookies[name]; ok {
+		return value
+	}
+	var chunks []string
+	for i := 0; ; i++ {
+		chunk, ok := cookies[fmt.Sprintf("%s_%d", name, i)]
+		if !ok {
+			break
+		}
+		chunks = append(chunks, chunk)
+	}
+	return strings.Join(chunks, "")
+}
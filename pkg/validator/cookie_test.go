@@ -0,0 +1,29 @@
+package validator
+
+import "testing"
+
+func TestCookieValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		want   string
+	}{
+		{name: "single cookie", header: "session=abc; other=x", cookie: "session", want: "abc"},
+		{name: "chunked cookie", header: "session_0=ab; session_1=cd; session_2=ef", cookie: "session", want: "abcdef"},
+		{name: "chunks out of order", header: "session_1=cd; session_0=ab", cookie: "session", want: "abcd"},
+		{name: "chunks stop at the first gap", header: "session_0=ab; session_2=ef", cookie: "session", want: "ab"},
+		{name: "chunks must start at zero", header: "session_1=cd", cookie: "session", want: ""},
+		{name: "whole cookie wins over chunks", header: "session_0=ab; session=whole", cookie: "session", want: "whole"},
+		{name: "first duplicate wins", header: "session=first; session=second", cookie: "session", want: "first"},
+		{name: "missing cookie", header: "other=x", cookie: "session", want: ""},
+		{name: "no cookie header", header: "", cookie: "session", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cookieValue(parseCookies(tt.header), tt.cookie); got != tt.want {
+				t.Errorf("cookieValue(%q) = %q, want %q", tt.cookie, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package validator
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/Dimss/exa/pkg/routes"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// verifyCSRF checks a cookie authenticated unsafe request came from an allowed origin,
+// the Referer is used when the browser didn't send the Origin
+func verifyCSRF(csrf *routes.CSRF, httpReq *authv3.AttributeContext_HttpRequest) error {
+	headers := httpReq.Headers
+	origin := headers["origin"]
+	if origin == "" {
+		origin = refererOrigin(headers["referer"])
+	}
+	if origin == "" {
+		return fmt.Errorf("no origin or referer header")
+	}
+	if !sameOrigin(origin, httpReq.Scheme, httpReq.Host) && !csrf.OriginAllowed(origin) {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	if csrf.DoubleSubmit {
+		cookie := parseCookies(headers["cookie"])[csrf.CookieName]
+		token := headers[csrf.HeaderName]
+		if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(token)) != 1 {
+			return fmt.Errorf("%s header doesn't match the %s cookie", csrf.HeaderName, csrf.CookieName)
+		}
+	}
+	return nil
+}
+
+func refererOrigin(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func sameOrigin(origin, scheme, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if scheme == "" {
+		scheme = "https"
+	}
+	return strings.EqualFold(u.Scheme, scheme) && normalizeHost(u.Host, u.Scheme) == normalizeHost(host, scheme)
+}
+
+// CSRFCookie returns the Set-Cookie response header of the double-submit token,
+// it is set on safe requests without one, so the client can read and echo it on unsafe requests
+func CSRFCookie(csrf *routes.CSRF, httpReq *authv3.AttributeContext_HttpRequest) *corev3.HeaderValueOption {
+	if csrf == nil || !csrf.DoubleSubmit || !routes.SafeMethod(httpReq.Method) {
+		return nil
+	}
+	if parseCookies(httpReq.Headers["cookie"])[csrf.CookieName] != "" {
+		return nil
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil
+	}
+	cookie := &http.Cookie{
+		Name:     csrf.CookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(token),
+		Path:     "/",
+		Secure:   !strings.EqualFold(httpReq.Scheme, "http"),
+		SameSite: http.SameSiteStrictMode,
+	}
+	return &corev3.HeaderValueOption{
+		Header:       &corev3.HeaderValue{Key: "Set-Cookie", Value: cookie.String()},
+		AppendAction: corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+	}
+}
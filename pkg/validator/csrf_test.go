@@ -0,0 +1,107 @@
+package validator
+
+import (
+	"github.com/Dimss/exa/pkg/routes"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"strings"
+	"testing"
+)
+
+func compiledCSRF(t *testing.T, csrf *routes.CSRF) *routes.CSRF {
+	t.Helper()
+	if _, err := routes.CompileRules([]*routes.Rule{{Name: "csrf", CSRF: csrf}}); err != nil {
+		t.Fatal(err)
+	}
+	return csrf
+}
+
+func TestVerifyCSRF(t *testing.T) {
+	tests := []struct {
+		name    string
+		csrf    routes.CSRF
+		headers map[string]string
+		wantErr bool
+	}{
+		{name: "same origin", headers: map[string]string{"origin": "https://kubeflow.example.com"}},
+		{name: "same origin with default port", headers: map[string]string{"origin": "https://kubeflow.example.com:443"}},
+		{name: "same origin referer", headers: map[string]string{"referer": "https://kubeflow.example.com/pipelines/?ns=a"}},
+		{name: "allowed origin", csrf: routes.CSRF{AllowOrigins: []string{"https://*.example.com"}}, headers: map[string]string{"origin": "https://admin.example.com"}},
+		{name: "cross origin", headers: map[string]string{"origin": "https://evil.com"}, wantErr: true},
+		{name: "other scheme", headers: map[string]string{"origin": "http://kubeflow.example.com"}, wantErr: true},
+		{name: "cross origin referer", headers: map[string]string{"referer": "https://evil.com/kubeflow.example.com"}, wantErr: true},
+		{name: "no origin nor referer", headers: map[string]string{}, wantErr: true},
+		{name: "opaque origin", headers: map[string]string{"origin": "null"}, wantErr: true},
+		{
+			name:    "double submit match",
+			csrf:    routes.CSRF{DoubleSubmit: true},
+			headers: map[string]string{"origin": "https://kubeflow.example.com", "cookie": "exa-csrf=t0k3n", "x-csrf-token": "t0k3n"},
+		},
+		{
+			name:    "double submit mismatch",
+			csrf:    routes.CSRF{DoubleSubmit: true},
+			headers: map[string]string{"origin": "https://kubeflow.example.com", "cookie": "exa-csrf=t0k3n", "x-csrf-token": "other"},
+			wantErr: true,
+		},
+		{
+			name:    "double submit without cookie",
+			csrf:    routes.CSRF{DoubleSubmit: true},
+			headers: map[string]string{"origin": "https://kubeflow.example.com", "x-csrf-token": ""},
+			wantErr: true,
+		},
+		{
+			name:    "double submit custom names",
+			csrf:    routes.CSRF{DoubleSubmit: true, CookieName: "xsrf", HeaderName: "X-XSRF-Token"},
+			headers: map[string]string{"origin": "https://kubeflow.example.com", "cookie": "xsrf=t0k3n", "x-xsrf-token": "t0k3n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csrf := compiledCSRF(t, &tt.csrf)
+			httpReq := &authv3.AttributeContext_HttpRequest{Method: "POST", Scheme: "https", Host: "kubeflow.example.com", Headers: tt.headers}
+			if err := verifyCSRF(csrf, httpReq); (err != nil) != tt.wantErr {
+				t.Errorf("verifyCSRF() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCSRFCookie(t *testing.T) {
+	tests := []struct {
+		name       string
+		csrf       *routes.CSRF
+		method     string
+		scheme     string
+		cookie     string
+		want       bool
+		wantSecure bool
+	}{
+		{name: "no policy", method: "GET", want: false},
+		{name: "origin check only", csrf: &routes.CSRF{}, method: "GET", want: false},
+		{name: "safe request", csrf: &routes.CSRF{DoubleSubmit: true}, method: "GET", scheme: "https", want: true, wantSecure: true},
+		{name: "plain http", csrf: &routes.CSRF{DoubleSubmit: true}, method: "GET", scheme: "http", want: true, wantSecure: false},
+		{name: "unsafe request", csrf: &routes.CSRF{DoubleSubmit: true}, method: "POST", want: false},
+		{name: "cookie already set", csrf: &routes.CSRF{DoubleSubmit: true}, method: "GET", cookie: "exa-csrf=t0k3n", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.csrf != nil {
+				compiledCSRF(t, tt.csrf)
+			}
+			httpReq := &authv3.AttributeContext_HttpRequest{Method: tt.method, Scheme: tt.scheme, Headers: map[string]string{"cookie": tt.cookie}}
+			header := CSRFCookie(tt.csrf, httpReq)
+			if (header != nil) != tt.want {
+				t.Fatalf("CSRFCookie() = %v, want a cookie %t", header, tt.want)
+			}
+			if header == nil {
+				return
+			}
+			value := header.Header.Value
+			if !strings.HasPrefix(value, "exa-csrf=") || !strings.Contains(value, "SameSite=Strict") {
+				t.Errorf("Set-Cookie = %q", value)
+			}
+			if got := strings.Contains(value, "Secure"); got != tt.wantSecure {
+				t.Errorf("Set-Cookie secure = %t, want %t: %q", got, tt.wantSecure, value)
+			}
+		})
+	}
+}
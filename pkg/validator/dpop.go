@@ -0,0 +1,190 @@
+package validator
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Dimss/exa/pkg/cache"
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/routes"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dpopHeader    = "dpop"
+	dpopProofType = "dpop+jwt"
+)
+
+// verifyBinding enforces the cnf claim of sender-constrained tokens:
+// jkt binds the token to a DPoP key (RFC 9449) and x5t#S256 to the mTLS client certificate (RFC 8705)
+func (v *OAuth2Validator) verifyBinding(accessToken string) bool {
+	cnf, _ := v.claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	x5t, _ := cnf["x5t#S256"].(string)
+
+	if jkt == "" && x5t == "" {
+		if v.opts.DPoP.Required {
+			v.reason = ReasonTokenNotBound
+			v.log.Info("token is not sender-constrained", zap.String("reason", string(v.reason)))
+			return false
+		}
+		return true
+	}
+
+	if x5t != "" {
+		if err := verifyCertificateBinding(v.request.Attributes.GetSource().GetCertificate(), x5t); err != nil {
+			v.reason = ReasonCertificateBindingMismatch
+			v.log.Info("certificate binding check failed", zap.String("reason", string(v.reason)), v.logError(err))
+			return false
+		}
+	}
+
+	if jkt != "" {
+		if err := verifyDPoPProof(v.request, accessToken, jkt, v.opts.DPoP); err != nil {
+			v.reason = reasonOf(err)
+			v.log.Info("dpop proof check failed", zap.String("reason", string(v.reason)), v.logError(err))
+			return false
+		}
+	}
+	return true
+}
+
+// verifyDPoPProof verifies the DPoP proof per RFC 9449, section 4.3
+func verifyDPoPProof(request *authv3.CheckRequest, accessToken, jkt string, cfg options.DPoP) error {
+	httpReq := request.Attributes.Request.Http
+	proof := httpReq.Headers[dpopHeader]
+	if proof == "" {
+		return newTokenError(ReasonDPoPProofMissing, "dpop proof header is missing")
+	}
+	if strings.Contains(proof, ",") {
+		return newTokenError(ReasonDPoPProofInvalid, "multiple dpop proofs")
+	}
+
+	var jwk jose.JSONWebKey
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(cfg.Algorithms), jwt.WithoutClaimsValidation())
+	_, err := parser.ParseWithClaims(proof, claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); !strings.EqualFold(typ, dpopProofType) {
+			return nil, fmt.Errorf("unexpected proof typ %s", typ)
+		}
+		rawJwk, err := json.Marshal(token.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		if err := jwk.UnmarshalJSON(rawJwk); err != nil {
+			return nil, fmt.Errorf("invalid proof jwk: %w", err)
+		}
+		if !jwk.IsPublic() || !jwk.Valid() {
+			return nil, fmt.Errorf("proof jwk must be a valid public key")
+		}
+		return jwk.Key, nil
+	})
+	if err != nil {
+		return &tokenError{reason: ReasonDPoPProofInvalid, err: err}
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return &tokenError{reason: ReasonDPoPProofInvalid, err: err}
+	}
+	if !equalB64(base64.RawURLEncoding.EncodeToString(thumbprint), jkt) {
+		return newTokenError(ReasonDPoPBindingMismatch, "proof key doesn't match the token cnf.jkt")
+	}
+
+	if htm, _ := claims["htm"].(string); htm != httpReq.Method {
+		return newTokenError(ReasonDPoPProofInvalid, "proof htm %s doesn't match %s", htm, httpReq.Method)
+	}
+	htu, _ := claims["htu"].(string)
+	if !sameURL(htu, httpReq.Scheme, httpReq.Host, httpReq.Path) {
+		return newTokenError(ReasonDPoPProofInvalid, "proof htu %s doesn't match the request url", htu)
+	}
+
+	ath := sha256.Sum256([]byte(accessToken))
+	if claimAth, _ := claims["ath"].(string); !equalB64(claimAth, base64.RawURLEncoding.EncodeToString(ath[:])) {
+		return newTokenError(ReasonDPoPBindingMismatch, "proof ath doesn't match the access token")
+	}
+
+	iat, err := timeClaim(claims, "iat")
+	if err != nil || iat == nil {
+		return newTokenError(ReasonDPoPProofInvalid, "proof iat is missing")
+	}
+	now := time.Now()
+	if iat.After(now.Add(cfg.Leeway)) || now.Sub(*iat) > cfg.ProofLifetime+cfg.Leeway {
+		return newTokenError(ReasonDPoPProofInvalid, "proof iat %s is out of the accepted window", iat)
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return newTokenError(ReasonDPoPProofInvalid, "proof jti is missing")
+	}
+	// scope the jti by the key, so different clients can't collide
+	err = cfg.Replays.Add(jkt+":"+jti, iat.Add(cfg.ProofLifetime+cfg.Leeway*2))
+	if errors.Is(err, cache.ErrReplayed) {
+		return newTokenError(ReasonDPoPReplay, "proof jti %s was already used", jti)
+	}
+	if err != nil {
+		return newTokenError(ReasonDPoPProofInvalid, "proof jti %s can't be recorded: %s", jti, err)
+	}
+	return nil
+}
+
+// verifyCertificateBinding compares the cnf x5t#S256 thumbprint with the
+// url encoded PEM peer certificate envoy reports in the check request source
+func verifyCertificateBinding(urlEncodedPem, x5t string) error {
+	if urlEncodedPem == "" {
+		return fmt.Errorf("no client certificate, enable include_peer_certificate in the ext_authz filter")
+	}
+	rawPem, err := url.QueryUnescape(urlEncodedPem)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode([]byte(rawPem))
+	if block == nil {
+		return fmt.Errorf("invalid client certificate pem")
+	}
+	thumbprint := sha256.Sum256(block.Bytes)
+	if !equalB64(base64.RawURLEncoding.EncodeToString(thumbprint[:]), x5t) {
+		return fmt.Errorf("client certificate doesn't match the token cnf.x5t#S256")
+	}
+	return nil
+}
+
+// sameURL compares the htu claim with the request url, ignoring query and fragment (RFC 9449, section 4.3)
+func sameURL(htu, scheme, host, path string) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	if scheme == "" {
+		scheme = "https"
+	}
+	return strings.EqualFold(u.Scheme, scheme) &&
+		normalizeHost(u.Host, u.Scheme) == normalizeHost(host, scheme) &&
+		u.EscapedPath() == routes.StripQuery(path)
+}
+
+func normalizeHost(host, scheme string) string {
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (port == "443" && strings.EqualFold(scheme, "https")) || (port == "80" && strings.EqualFold(scheme, "http")) {
+			return h
+		}
+	}
+	return host
+}
+
+func equalB64(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(strings.TrimRight(a, "=")), []byte(strings.TrimRight(b, "="))) == 1
+}
@@ -0,0 +1,184 @@
+package validator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/Dimss/exa/pkg/cache"
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/square/go-jose.v2"
+	"testing"
+	"time"
+)
+
+const dpopAccessToken = "access-token"
+
+// dpopKey returns a proof signing key and the jkt thumbprint of its public key
+func dpopKey(t *testing.T) (*ecdsa.PrivateKey, map[string]interface{}, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := jose.JSONWebKey{Key: key.Public()}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwk.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		t.Fatal(err)
+	}
+	return key, header, base64.RawURLEncoding.EncodeToString(thumbprint)
+}
+
+func dpopProof(t *testing.T, key *ecdsa.PrivateKey, jwk map[string]interface{}, typ string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = typ
+	token.Header["jwk"] = jwk
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestVerifyDPoPProof(t *testing.T) {
+	key, jwk, jkt := dpopKey(t)
+	_, _, otherJkt := dpopKey(t)
+	ath := sha256.Sum256([]byte(dpopAccessToken))
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"htm": "GET",
+			"htu": "https://kubeflow.example.com/api/v1",
+			"ath": base64.RawURLEncoding.EncodeToString(ath[:]),
+			"iat": time.Now().Unix(),
+			"jti": "proof-1",
+		}
+	}
+	with := func(name string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	tests := []struct {
+		name   string
+		typ    string
+		claims jwt.MapClaims
+		jkt    string
+		path   string
+		// replayed sends the proof a second time
+		replayed   bool
+		noProof    bool
+		wantReason DenyReason
+	}{
+		{name: "valid proof", claims: validClaims()},
+		{name: "port and query are ignored", claims: with("htu", "https://KUBEFLOW.example.com:443/api/v1"), path: "/api/v1?watch=true"},
+		{name: "missing proof", noProof: true, wantReason: ReasonDPoPProofMissing},
+		{name: "wrong typ", typ: "jwt", claims: validClaims(), wantReason: ReasonDPoPProofInvalid},
+		{name: "other key", claims: validClaims(), jkt: otherJkt, wantReason: ReasonDPoPBindingMismatch},
+		{name: "wrong method", claims: with("htm", "POST"), wantReason: ReasonDPoPProofInvalid},
+		{name: "wrong url", claims: with("htu", "https://kubeflow.example.com/other"), wantReason: ReasonDPoPProofInvalid},
+		{name: "wrong access token hash", claims: with("ath", "AAAA"), wantReason: ReasonDPoPBindingMismatch},
+		{name: "missing iat", claims: with("iat", nil), wantReason: ReasonDPoPProofInvalid},
+		{name: "stale iat", claims: with("iat", time.Now().Add(-time.Hour).Unix()), wantReason: ReasonDPoPProofInvalid},
+		{name: "future iat", claims: with("iat", time.Now().Add(time.Hour).Unix()), wantReason: ReasonDPoPProofInvalid},
+		{name: "missing jti", claims: with("jti", nil), wantReason: ReasonDPoPProofInvalid},
+		{name: "replayed proof", claims: validClaims(), replayed: true, wantReason: ReasonDPoPReplay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replays := cache.NewReplays(10)
+			defer replays.Close()
+			cfg := options.DPoP{
+				Algorithms:    []string{"ES256"},
+				ProofLifetime: time.Minute,
+				Leeway:        time.Second * 5,
+				Replays:       replays,
+			}
+			headers := map[string]string{}
+			if !tt.noProof {
+				typ := tt.typ
+				if typ == "" {
+					typ = dpopProofType
+				}
+				headers[dpopHeader] = dpopProof(t, key, jwk, typ, tt.claims)
+			}
+			path := tt.path
+			if path == "" {
+				path = "/api/v1"
+			}
+			request := checkRequest("10.0.0.9", headers)
+			request.Attributes.Request.Http.Method = "GET"
+			request.Attributes.Request.Http.Scheme = "https"
+			request.Attributes.Request.Http.Host = "kubeflow.example.com"
+			request.Attributes.Request.Http.Path = path
+			proofJkt := jkt
+			if tt.jkt != "" {
+				proofJkt = tt.jkt
+			}
+
+			err := verifyDPoPProof(request, dpopAccessToken, proofJkt, cfg)
+			if tt.replayed {
+				if err != nil {
+					t.Fatalf("first use of the proof failed: %s", err)
+				}
+				err = verifyDPoPProof(request, dpopAccessToken, proofJkt, cfg)
+			}
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Errorf("verifyDPoPProof() = %s, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("verifyDPoPProof() = nil, want %s", tt.wantReason)
+			}
+			if got := reasonOf(err); got != tt.wantReason {
+				t.Errorf("verifyDPoPProof() reason = %s, want %s: %s", got, tt.wantReason, err)
+			}
+		})
+	}
+}
+
+func TestVerifyCertificateBinding(t *testing.T) {
+	tests := []struct {
+		name    string
+		pem     string
+		x5t     string
+		wantErr bool
+	}{
+		{name: "no certificate", pem: "", x5t: "abc", wantErr: true},
+		{name: "invalid pem", pem: "not-a-pem", x5t: "abc", wantErr: true},
+		{name: "thumbprint mismatch", pem: "-----BEGIN%20CERTIFICATE-----%0AAAAA%0A-----END%20CERTIFICATE-----%0A", x5t: "abc", wantErr: true},
+		{
+			name: "thumbprint match",
+			pem:  "-----BEGIN%20CERTIFICATE-----%0AAAAA%0A-----END%20CERTIFICATE-----%0A",
+			x5t: func() string {
+				sum := sha256.Sum256([]byte{0, 0, 0})
+				return base64.RawURLEncoding.EncodeToString(sum[:])
+			}(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyCertificateBinding(tt.pem, tt.x5t); (err != nil) != tt.wantErr {
+				t.Errorf("verifyCertificateBinding() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
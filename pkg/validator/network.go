@@ -0,0 +1,46 @@
+package validator
+
+import (
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"go.uber.org/zap"
+	"net/netip"
+	"strings"
+)
+
+// NetworkAllowed checks the client address against the global and the route network lists
+func (ac *AuthContext) NetworkAllowed() bool {
+	if ac.opts.Network.Allowed(ac.ClientIP) && ac.Rule.Network.Allowed(ac.ClientIP) {
+		return true
+	}
+	ac.Reason = ReasonNetworkDenied
+	ac.Log.Info("client network is not allowed",
+		zap.String("client", ac.ClientIP.String()),
+		zap.String("rule", ac.Rule.Name),
+		zap.String("reason", string(ac.Reason)))
+	return false
+}
+
+// clientIP resolves the client address, with no trusted hops it is the envoy peer
+// address, otherwise the hops-th x-forwarded-for entry from the right. The entries
+// left of it are set by the client and can't be trusted. The peer is the closest
+// known address when the header is missing, too short or the entry is invalid.
+func clientIP(r *authv3.CheckRequest, hops int) netip.Addr {
+	peer, _ := netip.ParseAddr(r.Attributes.GetSource().GetAddress().GetSocketAddress().GetAddress())
+	if hops <= 0 {
+		return peer.Unmap()
+	}
+	header := strings.TrimSpace(r.Attributes.GetRequest().GetHttp().GetHeaders()["x-forwarded-for"])
+	if header == "" {
+		return peer.Unmap()
+	}
+	xff := strings.Split(header, ",")
+	// the request skipped some of the trusted proxies
+	if len(xff) < hops {
+		return peer.Unmap()
+	}
+	ip, err := netip.ParseAddr(strings.TrimSpace(xff[len(xff)-hops]))
+	if err != nil {
+		return peer.Unmap()
+	}
+	return ip.Unmap()
+}
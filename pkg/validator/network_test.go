@@ -0,0 +1,56 @@
+package validator
+
+import (
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"net/netip"
+	"testing"
+)
+
+func checkRequest(peer string, headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{
+				Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+					SocketAddress: &corev3.SocketAddress{Address: peer},
+				}},
+			},
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{Headers: headers},
+			},
+		},
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name string
+		peer string
+		xff  string
+		hops int
+		want string
+	}{
+		{name: "no hops uses the peer", peer: "10.0.0.9", xff: "1.1.1.1", hops: 0, want: "10.0.0.9"},
+		{name: "one hop", peer: "10.0.0.9", xff: "1.1.1.1", hops: 1, want: "1.1.1.1"},
+		{name: "one hop ignores spoofed entries", peer: "10.0.0.9", xff: "6.6.6.6, 1.1.1.1", hops: 1, want: "1.1.1.1"},
+		{name: "two hops", peer: "10.0.0.9", xff: "6.6.6.6, 1.1.1.1, 10.0.0.2", hops: 2, want: "1.1.1.1"},
+		{name: "missing header falls back to the peer", peer: "10.0.0.9", hops: 1, want: "10.0.0.9"},
+		{name: "blank header falls back to the peer", peer: "10.0.0.9", xff: "  ", hops: 1, want: "10.0.0.9"},
+		{name: "short header falls back to the peer", peer: "10.0.0.9", xff: "1.1.1.1", hops: 2, want: "10.0.0.9"},
+		{name: "invalid entry falls back to the peer", peer: "10.0.0.9", xff: "1.1.1.1, garbage", hops: 1, want: "10.0.0.9"},
+		{name: "empty entry falls back to the peer", peer: "10.0.0.9", xff: "1.1.1.1,", hops: 1, want: "10.0.0.9"},
+		{name: "ipv4 mapped ipv6", peer: "::ffff:10.0.0.9", hops: 0, want: "10.0.0.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.xff != "" {
+				headers["x-forwarded-for"] = tt.xff
+			}
+			got := clientIP(checkRequest(tt.peer, headers), tt.hops)
+			if got != netip.MustParseAddr(tt.want) {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,11 @@ package validator
 
 import (
 	"context"
+	"fmt"
 	"github.com/Dimss/exa/pkg/options"
-	"github.com/MicahParks/keyfunc"
+	"github.com/Dimss/exa/pkg/routes"
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	"github.com/golang-jwt/jwt/v4"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -16,125 +18,357 @@ type OAuth2Validator struct {
 	opts            *options.Options
 	log             *zap.Logger
 	claims          jwt.MapClaims
+	issuer          *options.Issuer
+	reason          DenyReason
+	encrypted       bool
 	rawIdentityData []byte
-	requestHeaders  map[string]string
+	request         *authv3.CheckRequest
+	rule            *routes.Rule
+	shadowReason    DenyReason
+	shadowEvaluated bool
 }
 
 func NewOAuth2Validator(
 	opts *options.Options,
-	requestHeaders map[string]string,
+	request *authv3.CheckRequest,
+	rule *routes.Rule,
 	log *zap.Logger) *OAuth2Validator {
 
 	return &OAuth2Validator{
-		opts:           opts,
-		log:            log,
-		requestHeaders: requestHeaders,
-		claims:         jwt.MapClaims{},
+		opts:    opts,
+		log:     log,
+		request: request,
+		rule:    rule,
+		claims:  jwt.MapClaims{},
 	}
 }
 
-func (v *OAuth2Validator) shouldValidate() bool {
-	if _, ok := v.requestHeaders[v.opts.AuthTokenSrcHeader]; ok {
+func (v *OAuth2Validator) Name() string {
+	return OAuth2Type
+}
+
+func (v *OAuth2Validator) isValid(ctx context.Context) bool {
+
+	rawToken, src, ok := v.jwtToken()
+	if !ok {
+		v.log.Info("not OAuth2 based authentication, aborting")
+		v.reason = ReasonNoToken
+		return false
+	}
+
+	if !v.csrfSafe(src) {
+		return false
+	}
+
+	// the claims of a cached encrypted token are redacted as well
+	v.encrypted = encryptedToken(rawToken)
+	cacheKey := v.cacheKey(rawToken)
+	if v.cachedToken(ctx, cacheKey) {
+		return true
+	}
+
+	b64JwtToken, ok := v.decrypt(rawToken)
+	if !ok {
+		return false
+	}
+
+	unverifiedClaims := jwt.MapClaims{}
+	unverifiedToken, _, err := jwt.NewParser().ParseUnverified(b64JwtToken, unverifiedClaims)
+	if err != nil {
+		v.log.Info("malformed token", v.logError(err))
+		v.reason = ReasonMalformedToken
+		return false
+	}
+
+	// tokens of a configured issuer are verified only with the issuer keys
+	var valid bool
+	issuer := v.issuerFor(unverifiedClaims)
+	if issuer != nil {
+		valid = v.validateIssuerToken(ctx, b64JwtToken, issuer)
+	} else {
+		valid = v.validateKeySourcesToken(ctx, b64JwtToken)
+	}
+	v.evaluateShadowPolicy(ctx, unverifiedToken.Header, unverifiedClaims, issuer, valid)
+	if !valid {
+		return false
+	}
+
+	if !v.verifyBinding(rawToken) {
+		return false
+	}
+
+	generation := v.cacheGeneration()
+	if v.revoked() {
+		return false
+	}
+
+	v.cacheToken(cacheKey, unverifiedToken.Header, generation)
+	return true
+}
+
+func (v *OAuth2Validator) issuerFor(claims jwt.MapClaims) *options.Issuer {
+	if iss, ok := claims["iss"].(string); ok {
+		return v.opts.IssuerFor(iss)
+	}
+	return nil
+}
+
+// revoked checks the verified token against the revocations store
+func (v *OAuth2Validator) revoked() bool {
+	if v.opts.Revocations == nil {
+		return false
+	}
+	jti, _ := v.claims["jti"].(string)
+	exp, err := timeClaim(v.claims, "exp")
+	if err != nil {
+		exp = nil
+	}
+	if v.opts.Revocations.JTIRevoked(jti, exp) {
+		v.reason = ReasonTokenRevoked
+		v.log.Info("token is revoked", v.logClaim("jti", jti), zap.String("reason", string(v.reason)))
 		return true
 	}
-	if len(v.getAuthCookie()) > 0 {
+	sub, _ := v.claims["sub"].(string)
+	iat, err := timeClaim(v.claims, "iat")
+	if err != nil {
+		iat = nil
+	}
+	if v.opts.Revocations.SubjectRevoked(sub, iat, exp) {
+		v.reason = ReasonSessionRevoked
+		v.log.Info("subject sessions are revoked", v.logClaim("sub", sub), zap.String("reason", string(v.reason)))
 		return true
 	}
 	return false
 }
 
-func (v *OAuth2Validator) isValid(ctx context.Context) bool {
-
-	if !v.shouldValidate() {
-		v.log.Info("not OAuth2 based authentication, aborting")
+func (v *OAuth2Validator) validateIssuerToken(ctx context.Context, b64JwtToken string, issuer *options.Issuer) bool {
+	claims, err := verifyTokenTraced(ctx, issuer.URL, b64JwtToken, issuer.Keyfunc, issuer.Policy())
+	if err != nil {
+		v.reason = reasonOf(err)
+		v.log.Info("not valid token",
+			zap.String("issuer", issuer.URL),
+			zap.String("reason", string(v.reason)),
+			v.logError(err))
 		return false
 	}
+	if !audienceAllowed(claims, issuer.Audiences) {
+		v.reason = ReasonInvalidAudience
+		v.log.Info("token audience is not allowed",
+			zap.String("issuer", issuer.URL),
+			zap.String("reason", string(v.reason)))
+		return false
+	}
+
+	v.claims = claims
+	v.issuer = issuer
+	return true
+}
 
+func (v *OAuth2Validator) validateKeySourcesToken(ctx context.Context, b64JwtToken string) bool {
 	var wg sync.WaitGroup
-	successValidationCh := make(chan bool)
-	defer close(successValidationCh)
-	b64JwtToken := v.jwtToken()
+	successValidationCh := make(chan jwt.MapClaims, len(v.opts.KeySources))
+	failedValidationCh := make(chan DenyReason, len(v.opts.KeySources))
 
-	// Validate JWT on each JWKS in parallel
-	for _, jwks := range v.opts.JwksServers {
+	// Validate JWT on each key source in parallel
+	for _, keySource := range v.opts.KeySources {
 		wg.Add(1)
-		go func(jwks *keyfunc.JWKS) {
+		go func(keySource options.KeySource) {
 
 			defer wg.Done()
 
-			token, err := jwt.ParseWithClaims(b64JwtToken, v.claims, jwks.Keyfunc)
+			claims, err := verifyTokenTraced(ctx, keySource.Name(), b64JwtToken, keySource.Keyfunc, v.opts.TokenPolicy)
 			if err != nil {
-				v.log.Info("not valid token", zap.Error(err))
+				v.log.Info("not valid token",
+					zap.String("keySource", keySource.Name()),
+					zap.String("reason", string(reasonOf(err))),
+					v.logError(err))
+				failedValidationCh <- reasonOf(err)
 				return
 			}
 
-			if !token.Valid {
-				v.log.Error("failed to get claims from token", zap.Error(err))
+			if v.opts.Oauth2TokenIssuer != "" && !claims.VerifyIssuer(v.opts.Oauth2TokenIssuer, true) {
+				v.log.Info("token issuer is not allowed", zap.String("reason", string(ReasonInvalidIssuer)))
+				failedValidationCh <- ReasonInvalidIssuer
 				return
-
 			}
 
-			successValidationCh <- true
+			successValidationCh <- claims
 
-		}(jwks)
+		}(keySource)
 	}
 
-	failedValidationCh := make(chan struct{})
+	doneCh := make(chan struct{})
 
 	go func() {
-		defer close(failedValidationCh)
 		wg.Wait()
-		failedValidationCh <- struct{}{}
+		close(doneCh)
 	}()
 
-	for {
+	select {
+	case claims := <-successValidationCh:
+		v.claims = claims
+		return true
+	case <-doneCh:
+		// the last validation might have succeeded right before done
 		select {
-		case <-successValidationCh:
+		case claims := <-successValidationCh:
+			v.claims = claims
 			return true
-		case <-failedValidationCh:
-			return false
+		default:
+		}
+	}
+
+	// report the most specific reason among the key sources
+	v.reason = ReasonUnknownKey
+	close(failedValidationCh)
+	for reason := range failedValidationCh {
+		if reason.specificity() > v.reason.specificity() {
+			v.reason = reason
 		}
 	}
+	return false
+}
+
+func (v *OAuth2Validator) DenyReason() DenyReason {
+	return v.reason
 }
 
 func (v *OAuth2Validator) ValidatedIdentity() (identityHeaders []*corev3.HeaderValueOption) {
 
-	email := ""
-	if e, ok := v.claims["email"]; ok {
-		email = e.(interface{}).(string)
-	} else {
-		v.log.Info("token doesn't contain email claim")
+	claimMappings := map[string]string{v.opts.UserIdHeader: "email"}
+	if v.issuer != nil {
+		claimMappings = v.issuer.ClaimMappings
 	}
 
-	identityHeaders = append(identityHeaders, &corev3.HeaderValueOption{
-		Header: &corev3.HeaderValue{
-			Key:   v.opts.UserIdHeader,
-			Value: email,
-		},
-	})
+	for header, claim := range claimMappings {
+		value, ok := claimValue(v.claims, claim)
+		if !ok {
+			v.log.Info("token doesn't contain claim", zap.String("claim", claim))
+		}
+		identityHeaders = append(identityHeaders, &corev3.HeaderValueOption{
+			Header: &corev3.HeaderValue{
+				Key:   header,
+				Value: value,
+			},
+		})
+	}
 
 	return
 }
 
-func (v *OAuth2Validator) jwtToken() string {
-	if authCookieValue := v.getAuthCookie(); len(authCookieValue) > 0 {
-		v.log = v.log.With(zap.Field{Key: "authType", Type: zapcore.StringType, String: "cookie"})
-		token := strings.Split(authCookieValue, "=")
-		if len(token) < 1 {
-			v.log.Error("wrong cookie format")
-			return ""
-		}
-		return token[1]
+// Subject returns the sub claim, or the email of tokens without sub
+func (v *OAuth2Validator) Subject() string {
+	if sub, ok := v.claims["sub"].(string); ok && sub != "" {
+		return sub
+	}
+	email, _ := v.claims["email"].(string)
+	return email
+}
+
+// Encrypted reports whether the token is an encrypted (JWE) token
+func (v *OAuth2Validator) Encrypted() bool {
+	return v.encrypted
+}
+
+// encryptedToken reports whether the raw token is a compact JWE, it has five parts, JWS three
+func encryptedToken(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// decrypt returns the nested token of an encrypted (JWE) token, other tokens are returned as is
+func (v *OAuth2Validator) decrypt(token string) (string, bool) {
+	if !encryptedToken(token) {
+		return token, true
+	}
+	if v.opts.DecryptionKeys == nil {
+		v.reason = ReasonUndecryptableToken
+		v.log.Info("encrypted token but no decryption keys configured", zap.String("reason", string(v.reason)))
+		return "", false
+	}
+	jws, err := v.opts.DecryptionKeys.Decrypt(token)
+	if err != nil {
+		v.reason = ReasonUndecryptableToken
+		v.log.Info("failed to decrypt token", zap.String("reason", string(v.reason)), zap.Error(err))
+		return "", false
+	}
+	return jws, true
+}
+
+// logClaim returns a claim value for logging, claims of encrypted tokens are never logged
+func (v *OAuth2Validator) logClaim(name, value string) zap.Field {
+	if v.encrypted {
+		return zap.String(name, "[redacted]")
+	}
+	return zap.String(name, value)
+}
+
+// logError returns a verification error for logging, the errors of encrypted
+// tokens may quote claims (e.g. exp), so only the deny reason is logged
+func (v *OAuth2Validator) logError(err error) zap.Field {
+	if v.encrypted {
+		return zap.Skip()
 	}
-	return strings.TrimSpace(strings.ReplaceAll(v.requestHeaders[v.opts.AuthTokenSrcHeader], "Bearer", ""))
+	return zap.Error(err)
+}
 
+// jwtToken returns the token from the first token source that holds one,
+// the token sources of the route rule win over the global ones
+func (v *OAuth2Validator) jwtToken() (string, routes.TokenSource, bool) {
+	httpReq := v.request.Attributes.Request.Http
+	sources := v.opts.TokenSources
+	if v.rule != nil {
+		sources = v.rule.TokenSourcesOr(sources)
+	}
+	token, src, ok := extractToken(sources, httpReq)
+	if ok {
+		v.log = v.log.With(zap.Field{Key: "authType", Type: zapcore.StringType, String: src.String()})
+	}
+	return token, src, ok
 }
 
-func (v *OAuth2Validator) getAuthCookie() string {
-	for _, cookie := range strings.Split(v.requestHeaders["cookie"], ";") {
-		if strings.Contains(cookie, v.opts.AuthCookie) {
-			return cookie
+// csrfSafe enforces the route CSRF policy, only cookies are sent by the browser
+// on cross-site requests, so tokens from the other sources are not checked
+func (v *OAuth2Validator) csrfSafe(src routes.TokenSource) bool {
+	httpReq := v.request.Attributes.Request.Http
+	if v.rule == nil || v.rule.CSRF == nil || src.Kind != routes.CookieTokenSource || routes.SafeMethod(httpReq.Method) {
+		return true
+	}
+	if err := verifyCSRF(v.rule.CSRF, httpReq); err != nil {
+		v.reason = ReasonCSRFViolation
+		v.log.Info("csrf check failed", zap.String("reason", string(v.reason)), zap.Error(err))
+		return false
+	}
+	return true
+}
+
+func audienceAllowed(claims jwt.MapClaims, audiences []string) bool {
+	if len(audiences) == 0 {
+		return true
+	}
+	for _, aud := range audiences {
+		if claims.VerifyAudience(aud, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimValue renders a claim as a header value, list claims (e.g. groups) are comma separated
+func claimValue(claims jwt.MapClaims, claim string) (string, bool) {
+	value, ok := claims[claim]
+	if !ok {
+		return "", false
+	}
+	switch val := value.(type) {
+	case string:
+		return val, true
+	case []interface{}:
+		var values []string
+		for _, item := range val {
+			values = append(values, fmt.Sprint(item))
 		}
+		return strings.Join(values, ","), true
+	default:
+		return fmt.Sprint(val), true
 	}
-	return ""
 }
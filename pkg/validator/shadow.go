@@ -0,0 +1,69 @@
+package validator
+
+import (
+	"context"
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/tracing"
+	"github.com/golang-jwt/jwt/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"time"
+)
+
+// policyReasons are the deny reasons of the token policy, the only ones a shadow policy can change
+var policyReasons = map[DenyReason]bool{
+	ReasonAlgorithmNotAllowed: true,
+	ReasonInvalidType:         true,
+	ReasonTokenExpired:        true,
+	ReasonTokenNotYetValid:    true,
+	ReasonTokenIssuedInFuture: true,
+	ReasonTokenTooOld:         true,
+	ReasonMissingClaim:        true,
+}
+
+// evaluateShadowPolicy evaluates the candidate token policy next to the active one.
+// The signature is verified by the active policy only, so the shadow decision is
+// evaluated when the active policy accepted the token or rejected it on a policy check.
+func (v *OAuth2Validator) evaluateShadowPolicy(ctx context.Context, header map[string]interface{}, claims jwt.MapClaims, issuer *options.Issuer, valid bool) {
+	if v.opts.ShadowTokenPolicy == nil || (!valid && !v.reason.IsPolicy()) {
+		return
+	}
+	active := v.opts.TokenPolicy
+	if issuer != nil {
+		active = issuer.Policy()
+	}
+	policy := v.opts.ShadowTokenPolicy.WithDefaults(active)
+
+	_, span := tracing.Tracer().Start(ctx, "policy.shadow")
+	defer span.End()
+	v.shadowEvaluated = true
+	v.shadowReason = ReasonNone
+	if err := verifyPolicy(header, claims, policy); err != nil {
+		span.SetAttributes(attribute.String("exa.reason", string(reasonOf(err))))
+		v.shadowReason = reasonOf(err)
+		v.log.Debug("shadow token policy rejects the token",
+			zap.String("shadowReason", string(v.shadowReason)),
+			v.logError(err))
+	}
+}
+
+// verifyPolicy applies the token policy checks of verifyToken, without the signature
+func verifyPolicy(header map[string]interface{}, claims jwt.MapClaims, policy options.TokenPolicy) error {
+	alg, _ := header["alg"].(string)
+	if len(policy.Algorithms) > 0 && !contains(policy.Algorithms, alg) {
+		return newTokenError(ReasonAlgorithmNotAllowed, "signing algorithm %s is not allowed", alg)
+	}
+	if len(policy.Types) > 0 && !typeAllowed(header["typ"], policy.Types) {
+		return newTokenError(ReasonInvalidType, "token type %v is not allowed", header["typ"])
+	}
+	return verifyClaims(claims, policy, time.Now())
+}
+
+// IsPolicy reports whether the token was rejected by the token policy, after or without the signature check
+func (r DenyReason) IsPolicy() bool {
+	return policyReasons[r]
+}
+
+func (v *OAuth2Validator) ShadowReason() (DenyReason, bool) {
+	return v.shadowReason, v.shadowEvaluated
+}
@@ -0,0 +1,233 @@
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/tracing"
+	"github.com/golang-jwt/jwt/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+type DenyReason string
+
+const (
+	ReasonNone                       DenyReason = ""
+	ReasonNoToken                    DenyReason = "no_token"
+	ReasonMalformedToken             DenyReason = "malformed_token"
+	ReasonUndecryptableToken         DenyReason = "undecryptable_token"
+	ReasonAlgorithmNotAllowed        DenyReason = "algorithm_not_allowed"
+	ReasonInvalidType                DenyReason = "invalid_token_type"
+	ReasonUnknownKey                 DenyReason = "unknown_key"
+	ReasonInvalidSignature           DenyReason = "invalid_signature"
+	ReasonTokenExpired               DenyReason = "token_expired"
+	ReasonTokenNotYetValid           DenyReason = "token_not_yet_valid"
+	ReasonTokenIssuedInFuture        DenyReason = "token_issued_in_future"
+	ReasonTokenTooOld                DenyReason = "token_too_old"
+	ReasonMissingClaim               DenyReason = "missing_required_claim"
+	ReasonInvalidAudience            DenyReason = "invalid_audience"
+	ReasonInvalidIssuer              DenyReason = "invalid_issuer"
+	ReasonTokenRevoked               DenyReason = "token_revoked"
+	ReasonSessionRevoked             DenyReason = "session_revoked"
+	ReasonTokenNotBound              DenyReason = "token_not_sender_constrained"
+	ReasonDPoPProofMissing           DenyReason = "dpop_proof_missing"
+	ReasonDPoPProofInvalid           DenyReason = "dpop_proof_invalid"
+	ReasonDPoPBindingMismatch        DenyReason = "dpop_binding_mismatch"
+	ReasonDPoPReplay                 DenyReason = "dpop_proof_replay"
+	ReasonCertificateBindingMismatch DenyReason = "certificate_binding_mismatch"
+	ReasonCSRFViolation              DenyReason = "csrf_violation"
+	ReasonNetworkDenied              DenyReason = "network_denied"
+	ReasonRateLimited                DenyReason = "rate_limited"
+	ReasonTooManyFailedAttempts      DenyReason = "too_many_failed_attempts"
+)
+
+// specificity ranks the reasons when a token is checked against several key sources,
+// a claims failure means the signature was verified, so it tells more than an unknown key
+func (r DenyReason) specificity() int {
+	switch r {
+	case ReasonNone:
+		return 0
+	case ReasonNoToken:
+		return 1
+	case ReasonUnknownKey:
+		return 2
+	case ReasonInvalidSignature, ReasonAlgorithmNotAllowed:
+		return 3
+	default:
+		return 4
+	}
+}
+
+type tokenError struct {
+	reason DenyReason
+	err    error
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.err)
+}
+
+func (e *tokenError) Unwrap() error {
+	return e.err
+}
+
+func newTokenError(reason DenyReason, format string, args ...interface{}) *tokenError {
+	return &tokenError{reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// reasonOf returns the deny reason of an error returned by verifyToken
+func reasonOf(err error) DenyReason {
+	var tErr *tokenError
+	if errors.As(err, &tErr) {
+		return tErr.reason
+	}
+	return ReasonInvalidSignature
+}
+
+// verifyTokenTraced evaluates the token policy of a key source in a span
+func verifyTokenTraced(ctx context.Context, keySource, raw string, keyfunc jwt.Keyfunc, policy options.TokenPolicy) (jwt.MapClaims, error) {
+	_, span := tracing.Tracer().Start(ctx, "policy.evaluate",
+		trace.WithAttributes(attribute.String("exa.key_source", keySource)))
+	defer span.End()
+	claims, err := verifyToken(raw, keyfunc, policy)
+	if err != nil {
+		span.SetAttributes(attribute.String("exa.reason", string(reasonOf(err))))
+	}
+	return claims, err
+}
+
+// verifyToken verifies the token signature and then enforces the token policy,
+// jwt claims validation is disabled since it has no leeway and verifies claims before the signature
+func verifyToken(raw string, keyfunc jwt.Keyfunc, policy options.TokenPolicy) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation())
+
+	token, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		alg, _ := token.Header["alg"].(string)
+		if len(policy.Algorithms) > 0 && !contains(policy.Algorithms, alg) {
+			return nil, newTokenError(ReasonAlgorithmNotAllowed, "signing algorithm %s is not allowed", alg)
+		}
+		if len(policy.Types) > 0 && !typeAllowed(token.Header["typ"], policy.Types) {
+			return nil, newTokenError(ReasonInvalidType, "token type %v is not allowed", token.Header["typ"])
+		}
+		key, err := keyfunc(token)
+		if err != nil {
+			return nil, &tokenError{reason: ReasonUnknownKey, err: err}
+		}
+		return key, nil
+	})
+	if err != nil {
+		var vErr *jwt.ValidationError
+		if errors.As(err, &vErr) {
+			var tErr *tokenError
+			switch {
+			case errors.As(vErr.Inner, &tErr):
+				return nil, tErr
+			case vErr.Errors&jwt.ValidationErrorMalformed != 0:
+				return nil, &tokenError{reason: ReasonMalformedToken, err: err}
+			case vErr.Errors&jwt.ValidationErrorUnverifiable != 0:
+				// the signing method isn't supported at all
+				return nil, &tokenError{reason: ReasonAlgorithmNotAllowed, err: err}
+			}
+		}
+		return nil, &tokenError{reason: ReasonInvalidSignature, err: err}
+	}
+	if !token.Valid {
+		return nil, newTokenError(ReasonInvalidSignature, "token is not valid")
+	}
+
+	if err := verifyClaims(claims, policy, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func verifyClaims(claims jwt.MapClaims, policy options.TokenPolicy, now time.Time) error {
+	exp, err := timeClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if exp != nil && now.After(exp.Add(policy.Leeway)) {
+		return newTokenError(ReasonTokenExpired, "token expired at %s", exp)
+	}
+
+	nbf, err := timeClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if nbf != nil && now.Add(policy.Leeway).Before(*nbf) {
+		return newTokenError(ReasonTokenNotYetValid, "token is not valid before %s", nbf)
+	}
+
+	iat, err := timeClaim(claims, "iat")
+	if err != nil {
+		return err
+	}
+	if iat != nil && now.Add(policy.Leeway).Before(*iat) {
+		return newTokenError(ReasonTokenIssuedInFuture, "token issued in the future at %s", iat)
+	}
+	if policy.MaxAge > 0 {
+		if iat == nil {
+			return newTokenError(ReasonMissingClaim, "iat claim is required to enforce max age")
+		}
+		if now.Sub(*iat) > policy.MaxAge+policy.Leeway {
+			return newTokenError(ReasonTokenTooOld, "token issued at %s exceeds max age %s", iat, policy.MaxAge)
+		}
+	}
+
+	for _, claim := range policy.RequiredClaims {
+		if value, ok := claims[claim]; !ok || value == nil || value == "" {
+			return newTokenError(ReasonMissingClaim, "required claim %s is missing", claim)
+		}
+	}
+	return nil
+}
+
+func timeClaim(claims jwt.MapClaims, name string) (*time.Time, error) {
+	value, ok := claims[name]
+	if !ok {
+		return nil, nil
+	}
+	var seconds float64
+	switch v := value.(type) {
+	case float64:
+		seconds = v
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil, newTokenError(ReasonMalformedToken, "%s claim is not a number", name)
+		}
+		seconds = f
+	default:
+		return nil, newTokenError(ReasonMalformedToken, "%s claim is not a number", name)
+	}
+	t := time.Unix(0, int64(seconds*float64(time.Second)))
+	return &t, nil
+}
+
+// typeAllowed compares the typ header case-insensitively, ignoring
+// the optional application/ prefix (RFC 7515, section 4.1.9)
+func typeAllowed(typ interface{}, types []string) bool {
+	t, _ := typ.(string)
+	t = strings.TrimPrefix(strings.ToLower(t), "application/")
+	for _, allowed := range types {
+		if strings.TrimPrefix(strings.ToLower(allowed), "application/") == t {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package validator
+
+import (
+	"encoding/base64"
+	"github.com/Dimss/exa/pkg/routes"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"net/url"
+	"strings"
+)
+
+// extractToken returns the token of the first source in the list which holds one
+func extractToken(sources []routes.TokenSource, httpReq *authv3.AttributeContext_HttpRequest) (string, routes.TokenSource, bool) {
+	for _, src := range sources {
+		if token := tokenFromSource(src, httpReq); token != "" {
+			return token, src, true
+		}
+	}
+	return "", routes.TokenSource{}, false
+}
+
+func tokenFromSource(src routes.TokenSource, httpReq *authv3.AttributeContext_HttpRequest) string {
+	headers := httpReq.Headers
+	switch src.Kind {
+	case routes.HeaderTokenSource:
+		return tokenFromHeader(headers[src.Name], src.Scheme)
+	case routes.CookieTokenSource:
+		return cookieValue(parseCookies(headers["cookie"]), src.Name)
+	case routes.QueryTokenSource:
+		// tokens in urls end up in access logs, accept them only where there is no alternative
+		if !isWebsocketUpgrade(headers) {
+			return ""
+		}
+		return queryParam(httpReq.Path, src.Name)
+	case routes.WebsocketProtocolTokenSource:
+		return tokenFromWebsocketProtocol(headers["sec-websocket-protocol"], src.Name)
+	}
+	return ""
+}
+
+// tokenFromHeader strips the auth scheme, when a scheme is set the header must use it,
+// otherwise the value is taken as is with an optional Bearer or DPoP scheme
+func tokenFromHeader(value, scheme string) string {
+	value = strings.TrimSpace(value)
+	if scheme != "" {
+		if !hasScheme(value, scheme) {
+			return ""
+		}
+		return strings.TrimSpace(value[len(scheme):])
+	}
+	for _, s := range []string{"Bearer", "DPoP"} {
+		if hasScheme(value, s) {
+			return strings.TrimSpace(value[len(s):])
+		}
+	}
+	return value
+}
+
+func hasScheme(value, scheme string) bool {
+	return len(value) > len(scheme) &&
+		strings.EqualFold(value[:len(scheme)], scheme) &&
+		value[len(scheme)] == ' '
+}
+
+func isWebsocketUpgrade(headers map[string]string) bool {
+	return strings.EqualFold(headers["upgrade"], "websocket")
+}
+
+func queryParam(path, name string) string {
+	i := strings.Index(path, "?")
+	if i < 0 {
+		return ""
+	}
+	query, err := url.ParseQuery(path[i+1:])
+	if err != nil {
+		return ""
+	}
+	return query.Get(name)
+}
+
+// tokenFromWebsocketProtocol finds the <prefix><base64url token> sub-protocol,
+// browsers can't set headers on websockets but can set sub-protocols
+func tokenFromWebsocketProtocol(value, prefix string) string {
+	for _, protocol := range strings.Split(value, ",") {
+		protocol = strings.TrimSpace(protocol)
+		if !strings.HasPrefix(protocol, prefix) {
+			continue
+		}
+		token, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protocol[len(prefix):], "="))
+		if err != nil {
+			return ""
+		}
+		return string(token)
+	}
+	return ""
+}
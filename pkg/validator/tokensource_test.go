@@ -0,0 +1,55 @@
+package validator
+
+import (
+	"encoding/base64"
+	"github.com/Dimss/exa/pkg/routes"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"testing"
+)
+
+func TestExtractToken(t *testing.T) {
+	header := routes.TokenSource{Kind: routes.HeaderTokenSource, Name: "authorization"}
+	bearer := routes.TokenSource{Kind: routes.HeaderTokenSource, Name: "authorization", Scheme: "Bearer"}
+	cookie := routes.TokenSource{Kind: routes.CookieTokenSource, Name: "session"}
+	query := routes.TokenSource{Kind: routes.QueryTokenSource, Name: "access_token"}
+	protocol := routes.TokenSource{Kind: routes.WebsocketProtocolTokenSource, Name: "base64url.bearer.authorization.k8s.io."}
+	websocket := map[string]string{"upgrade": "websocket"}
+	tests := []struct {
+		name    string
+		sources []routes.TokenSource
+		path    string
+		headers map[string]string
+		want    string
+		wantSrc routes.TokenSource
+	}{
+		{name: "bearer scheme is stripped", sources: []routes.TokenSource{header}, headers: map[string]string{"authorization": "Bearer abc"}, want: "abc", wantSrc: header},
+		{name: "dpop scheme is stripped", sources: []routes.TokenSource{header}, headers: map[string]string{"authorization": "DPoP abc"}, want: "abc", wantSrc: header},
+		{name: "raw header value", sources: []routes.TokenSource{header}, headers: map[string]string{"authorization": "abc"}, want: "abc", wantSrc: header},
+		{name: "required scheme", sources: []routes.TokenSource{bearer}, headers: map[string]string{"authorization": "bearer abc"}, want: "abc", wantSrc: bearer},
+		{name: "other scheme is ignored", sources: []routes.TokenSource{bearer}, headers: map[string]string{"authorization": "Basic abc"}},
+		{name: "first source wins", sources: []routes.TokenSource{cookie, header}, headers: map[string]string{"authorization": "Bearer abc", "cookie": "session=def"}, want: "def", wantSrc: cookie},
+		{name: "next source when the first is empty", sources: []routes.TokenSource{cookie, header}, headers: map[string]string{"authorization": "Bearer abc"}, want: "abc", wantSrc: header},
+		{name: "query on websocket upgrade", sources: []routes.TokenSource{query}, path: "/ws?access_token=abc", headers: websocket, want: "abc", wantSrc: query},
+		{name: "query ignored without upgrade", sources: []routes.TokenSource{query}, path: "/api?access_token=abc", headers: map[string]string{}},
+		{
+			name:    "websocket protocol",
+			sources: []routes.TokenSource{protocol},
+			headers: map[string]string{"sec-websocket-protocol": "base64.channel.k8s.io, base64url.bearer.authorization.k8s.io." + base64.RawURLEncoding.EncodeToString([]byte("abc"))},
+			want:    "abc",
+			wantSrc: protocol,
+		},
+		{name: "no token", sources: []routes.TokenSource{cookie, header}, headers: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpReq := &authv3.AttributeContext_HttpRequest{Path: tt.path, Headers: tt.headers}
+			got, src, ok := extractToken(tt.sources, httpReq)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Fatalf("extractToken() = %q, %t, want %q", got, ok, tt.want)
+			}
+			if src != tt.wantSrc {
+				t.Errorf("extractToken() source = %s, want %s", src, tt.wantSrc)
+			}
+		})
+	}
+}
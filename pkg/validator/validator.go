@@ -3,12 +3,16 @@ package validator
 import (
 	"context"
 	"github.com/Dimss/exa/pkg/options"
+	"github.com/Dimss/exa/pkg/routes"
+	"github.com/Dimss/exa/pkg/tracing"
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"regexp"
+	"net/netip"
 	"sync"
+	"time"
 )
 
 const (
@@ -16,37 +20,102 @@ const (
 	OAuth2Type     = "oauth2"
 )
 
-var (
-	SkipRoutePaths = []string{ // TODO(dimss): make this parameter
-		"/centralsso/dex-login",
-		"/dex-login",
-		"/dex/*",
-	}
-)
-
 type validator interface {
+	Name() string
 	isValid(context.Context) bool
 	ValidatedIdentity() (identityHeaders []*corev3.HeaderValueOption)
+	Subject() string
+	// Encrypted reports whether the identity comes from an encrypted token
+	Encrypted() bool
+	DenyReason() DenyReason
+	ShadowReason() (DenyReason, bool)
 }
 
 type AuthContext struct {
 	opts    *options.Options
 	request *authv3.CheckRequest
 	Log     *zap.Logger
+	// Reason is the reason of the denial, set when the context is not valid
+	Reason DenyReason
+	// Rule is the route rule matching the request
+	Rule *routes.Rule
+	// ClientIP is the resolved client address, it is invalid when it can't be resolved
+	ClientIP netip.Addr
+	// Subject is the validated identity, empty on anonymous requests
+	Subject string
+	// SubjectEncrypted is set when the subject comes from an encrypted (JWE) token,
+	// the subject is then never logged nor exported, see LoggableSubject
+	SubjectEncrypted bool
+	// ShadowReason is the decision of the shadow token policy, set when ShadowEvaluated
+	ShadowReason    DenyReason
+	ShadowEvaluated bool
+
+	mu       sync.Mutex
+	outcomes []Outcome
 }
 
-func (ac *AuthContext) Valid(ctx context.Context) (bool, []*corev3.HeaderValueOption) {
+// Outcome is the result of a single validator of the chain
+type Outcome struct {
+	Validator string
+	Valid     bool
+	Reason    DenyReason
+	Duration  time.Duration
+}
 
-	var validators []validator
+// Outcomes returns the results of the validators which completed
+func (ac *AuthContext) Outcomes() []Outcome {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return append([]Outcome(nil), ac.outcomes...)
+}
+
+// LoggableSubject returns the subject for the decision log, the dynamic metadata and
+// the spans, the claims of encrypted tokens are never logged so it is empty for them
+func (ac *AuthContext) LoggableSubject() string {
+	if ac.SubjectEncrypted {
+		return ""
+	}
+	return ac.Subject
+}
+
+func (ac *AuthContext) addOutcome(o Outcome) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.outcomes = append(ac.outcomes, o)
+}
+
+func (ac *AuthContext) Valid(ctx context.Context) (bool, []*corev3.HeaderValueOption) {
+	auth := ac.Rule.AuthFor(ac.ClientIP)
+	if auth == routes.AuthPublic {
+		ac.Log.Info("public route, authentication skipped", zap.String("rule", ac.Rule.Name))
+		return true, nil
+	}
 
-	if ac.skipAuthRoute() {
+	valid, identityHeaders := ac.validate(ctx)
+	// a csrf violation is denied even on optional routes, the request carried a session
+	if !valid && auth == routes.AuthOptional && ac.Reason != ReasonCSRFViolation {
+		ac.Log.Info("optional authentication route, request allowed anonymously",
+			zap.String("rule", ac.Rule.Name),
+			zap.String("reason", string(ac.Reason)))
 		return true, nil
 	}
+	return valid, identityHeaders
+}
+
+func (ac *AuthContext) Request() *authv3.CheckRequest {
+	return ac.request
+}
+
+// validate executes the validation chain
+func (ac *AuthContext) validate(ctx context.Context) (bool, []*corev3.HeaderValueOption) {
+
+	var validators []validator
 
 	if ac.opts.OAuth2ValidatorEnabled() {
 		validators = append(validators, NewOAuth2Validator(
 			ac.opts,
-			ac.request.Attributes.Request.Http.Headers,
+			ac.request,
+			ac.Rule,
 			ac.Log,
 		))
 	}
@@ -55,71 +124,93 @@ func (ac *AuthContext) Valid(ctx context.Context) (bool, []*corev3.HeaderValueOp
 	var wg sync.WaitGroup
 
 	type ValidationRes struct {
-		valid   bool
-		headers IdentityHeaders
+		valid     bool
+		headers   IdentityHeaders
+		subject   string
+		encrypted bool
 	}
 
-	resCh := make(chan ValidationRes)
-	defer close(resCh)
+	resCh := make(chan ValidationRes, len(validators))
+	reasonCh := make(chan DenyReason, len(validators))
+	// the shadow decision is sent before the validation result
+	shadowCh := make(chan DenyReason, len(validators))
+	shadowResult := func() {
+		select {
+		case reason := <-shadowCh:
+			ac.ShadowReason, ac.ShadowEvaluated = reason, true
+		default:
+		}
+	}
 
 	for _, val := range validators {
 		wg.Add(1)
 		v := val
 		go func() {
 			defer wg.Done()
-			if v.isValid(ctx) {
+			start := time.Now()
+			ctx, span := tracing.Tracer().Start(ctx, "validator."+v.Name())
+			valid := v.isValid(ctx)
+			span.SetAttributes(
+				attribute.Bool("exa.valid", valid),
+				attribute.String("exa.reason", string(v.DenyReason())))
+			span.End()
+			ac.addOutcome(Outcome{Validator: v.Name(), Valid: valid, Reason: v.DenyReason(), Duration: time.Since(start)})
+			if reason, evaluated := v.ShadowReason(); evaluated {
+				shadowCh <- reason
+			}
+			if valid {
 				ac.Log.Info("authentication context is valid, request allowed")
 				resCh <- ValidationRes{
-					valid:   true,
-					headers: v.ValidatedIdentity(),
+					valid:     true,
+					headers:   v.ValidatedIdentity(),
+					subject:   v.Subject(),
+					encrypted: v.Encrypted(),
 				}
+				return
 			}
+			reasonCh <- v.DenyReason()
 		}()
 	}
 
 	doneCh := make(chan struct{})
 	go func() {
-		defer close(doneCh)
 		wg.Wait()
-		doneCh <- struct{}{}
-
+		close(doneCh)
 	}()
 
-	for {
+	select {
+	case result := <-resCh:
+		ac.Subject, ac.SubjectEncrypted = result.subject, result.encrypted
+		shadowResult()
+		return result.valid, result.headers
+	case <-doneCh:
 		select {
 		case result := <-resCh:
+			ac.Subject, ac.SubjectEncrypted = result.subject, result.encrypted
+			shadowResult()
 			return result.valid, result.headers
-		case <-doneCh:
-			return false, nil
+		default:
 		}
 	}
-}
+	shadowResult()
 
-func (ac *AuthContext) skipAuthRoute() bool {
-	for _, skipPath := range SkipRoutePaths {
-		// TODO (dimssss) load regex at load time, make the part of options struct
-		skipPathRegex, err := regexp.Compile(skipPath)
-		if err != nil {
-			ac.Log.Error(err.Error(), []zap.Field{
-				{
-					Key:    "skipPath",
-					Type:   zapcore.StringType,
-					String: skipPath,
-				}}...)
-			continue
-		}
-		if skipPathRegex.Match([]byte(ac.request.Attributes.Request.Http.Path)) {
-			return true
+	ac.Reason = ReasonNoToken
+	close(reasonCh)
+	for reason := range reasonCh {
+		if reason.specificity() > ac.Reason.specificity() {
+			ac.Reason = reason
 		}
 	}
-	return false
+	return false, nil
 }
 
 func NewAuthContext(r *authv3.CheckRequest, opts *options.Options) *AuthContext {
-
+	httpReq := r.Attributes.Request.Http
 	return &AuthContext{
-		request: r,
-		opts:    opts,
+		request:  r,
+		opts:     opts,
+		Rule:     opts.Routes.Match(httpReq.Host, httpReq.Method, httpReq.Path),
+		ClientIP: clientIP(r, opts.XFFTrustedHops),
 		Log: zap.L().With(
 			[]zap.Field{
 				{
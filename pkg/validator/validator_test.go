@@ -0,0 +1,35 @@
+package validator
+
+import "testing"
+
+func TestLoggableSubject(t *testing.T) {
+	tests := []struct {
+		name string
+		ac   *AuthContext
+		want string
+	}{
+		{name: "anonymous", ac: &AuthContext{}, want: ""},
+		{name: "signed token", ac: &AuthContext{Subject: "jane"}, want: "jane"},
+		{name: "encrypted token", ac: &AuthContext{Subject: "jane", SubjectEncrypted: true}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ac.LoggableSubject(); got != tt.want {
+				t.Errorf("LoggableSubject() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptedToken(t *testing.T) {
+	tests := map[string]bool{
+		"h.p.s":      false,
+		"h.k.iv.c.t": true,
+		"opaque":     false,
+	}
+	for token, want := range tests {
+		if got := encryptedToken(token); got != want {
+			t.Errorf("encryptedToken(%q) = %t, want %t", token, got, want)
+		}
+	}
+}